@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions are buttons such as "Approve" / "Reject" rendered into a message.
+// Every button links to a signed, expiring callback URL. When it is clicked
+// the ActionHandler checks the token, makes sure no action of that message
+// was used before and runs the Go callback registered for the action.
+
+// Action is a button offered in a message. ID names the registered callback.
+type Action struct {
+	ID    string
+	Label string
+}
+
+// RenderedAction is an Action with its callback URL, as builders render it
+type RenderedAction struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	URL   string `json:"url"`
+}
+
+// ActionRenderer is implemented by builders that can render action buttons
+type ActionRenderer interface {
+	SetActions(actions []RenderedAction)
+}
+
+// MessageIDSetter is implemented by builders that put the message ID into the
+// body themselves, so decorators can agree with them on the ID
+type MessageIDSetter interface {
+	SetMessageID(id string)
+}
+
+var (
+	ErrActionToken   = errors.New("invalid action token")
+	ErrActionExpired = errors.New("action token expired")
+	ErrActionUsed    = errors.New("message action already used")
+	ErrActionUnknown = errors.New("unknown action")
+)
+
+// ActionSigner creates and verifies action tokens
+type ActionSigner struct {
+	// Callback URL, the token is added as the "t" query parameter
+	BaseURL string
+	Secret  []byte
+	// How long a token is valid
+	TTL time.Duration
+	// Clock, time.Now when nil
+	Now func() time.Time
+}
+
+type actionClaims struct {
+	MessageID string `json:"m"`
+	ActionID  string `json:"a"`
+	Expires   int64  `json:"e"`
+	Nonce     string `json:"n"`
+}
+
+func (s *ActionSigner) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// URL returns the signed callback URL of an action of a message
+func (s *ActionSigner) URL(messageID, actionID string) (string, error) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(actionClaims{
+		MessageID: messageID,
+		ActionID:  actionID,
+		Expires:   s.now().Add(s.TTL).Unix(),
+		Nonce:     hex.EncodeToString(nonce),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	token := encoded + "." + base64.RawURLEncoding.EncodeToString(s.mac(encoded))
+
+	u, err := url.Parse(s.BaseURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("t", token)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func (s *ActionSigner) mac(payload string) []byte {
+	m := hmac.New(sha256.New, s.Secret)
+	m.Write([]byte(payload))
+	return m.Sum(nil)
+}
+
+func (s *ActionSigner) verify(token string) (*actionClaims, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrActionToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, s.mac(payload)) {
+		return nil, ErrActionToken
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrActionToken
+	}
+	var claims actionClaims
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, ErrActionToken
+	}
+	if s.now().Unix() > claims.Expires {
+		return nil, ErrActionExpired
+	}
+	return &claims, nil
+}
+
+// ActionsBuilder decorates a builder that implements ActionRenderer and adds
+// signed action buttons to the built message
+type ActionsBuilder struct {
+	MessageBuilder
+	Signer  *ActionSigner
+	Actions []Action
+}
+
+func (b *ActionsBuilder) Message() (*Message, error) {
+	renderer, ok := b.MessageBuilder.(ActionRenderer)
+	if !ok {
+		return nil, fmt.Errorf("%T cannot render actions", b.MessageBuilder)
+	}
+
+	id := NewMessageID()
+	rendered := make([]RenderedAction, 0, len(b.Actions))
+	for _, a := range b.Actions {
+		u, err := b.Signer.URL(id, a.ID)
+		if err != nil {
+			return nil, err
+		}
+		rendered = append(rendered, RenderedAction{ID: a.ID, Label: a.Label, URL: u})
+	}
+
+	renderer.SetActions(rendered)
+	// builders may be pooled, do not leak the buttons into the next message
+	defer renderer.SetActions(nil)
+	if setter, ok := b.MessageBuilder.(MessageIDSetter); ok {
+		setter.SetMessageID(id)
+		defer setter.SetMessageID("")
+	}
+
+	msg, err := b.MessageBuilder.Message()
+	if err != nil {
+		return nil, err
+	}
+	msg.ID = id
+	return msg, nil
+}
+
+// ActionEvent is passed to action callbacks
+type ActionEvent struct {
+	MessageID string
+	ActionID  string
+	Request   *http.Request
+}
+
+// ActionCallback runs when an action is used
+type ActionCallback func(ctx context.Context, ev ActionEvent) error
+
+// ActionHandler receives action clicks. Only the first action used per message
+// is accepted, so "Approve" and "Reject" cannot both happen.
+type ActionHandler struct {
+	Signer *ActionSigner
+
+	mu        sync.Mutex
+	callbacks map[string]ActionCallback
+	used      map[string]time.Time // message ID -> expiry of the tokens
+}
+
+// Register sets the callback for an action ID
+func (h *ActionHandler) Register(actionID string, cb ActionCallback) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.callbacks == nil {
+		h.callbacks = make(map[string]ActionCallback)
+	}
+	h.callbacks[actionID] = cb
+}
+
+// Handle verifies a token and runs its callback
+func (h *ActionHandler) Handle(ctx context.Context, token string, r *http.Request) error {
+	claims, err := h.Signer.verify(token)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	cb, ok := h.callbacks[claims.ActionID]
+	if !ok {
+		h.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrActionUnknown, claims.ActionID)
+	}
+	if h.used == nil {
+		h.used = make(map[string]time.Time)
+	}
+	now := h.Signer.now()
+	for id, expires := range h.used {
+		// tokens of these messages are expired anyway
+		if now.After(expires) {
+			delete(h.used, id)
+		}
+	}
+	if _, done := h.used[claims.MessageID]; done {
+		h.mu.Unlock()
+		return ErrActionUsed
+	}
+	h.used[claims.MessageID] = time.Unix(claims.Expires, 0)
+	h.mu.Unlock()
+
+	err = cb(ctx, ActionEvent{MessageID: claims.MessageID, ActionID: claims.ActionID, Request: r})
+	if err != nil {
+		// let the user try again
+		h.mu.Lock()
+		delete(h.used, claims.MessageID)
+		h.mu.Unlock()
+	}
+	return err
+}
+
+// check verifies a token without using it
+func (h *ActionHandler) check(token string) (*actionClaims, error) {
+	claims, err := h.Signer.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.callbacks[claims.ActionID]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrActionUnknown, claims.ActionID)
+	}
+	if expires, done := h.used[claims.MessageID]; done && !h.Signer.now().After(expires) {
+		return nil, ErrActionUsed
+	}
+	return claims, nil
+}
+
+var actionConfirmPage = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Confirm</title></head>
+<body>
+<form method="post">
+<input type="hidden" name="t" value="{{.Token}}">
+<p>Please confirm: {{.Action}}</p>
+<button type="submit">Confirm</button>
+</form>
+</body></html>
+`))
+
+// ServeHTTP shows a confirmation page on GET and runs the action on POST. Mail
+// scanners and link previews follow GET links, so a GET never uses a token.
+func (h *ActionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		token := r.URL.Query().Get("t")
+		var claims *actionClaims
+		if claims, err = h.check(token); err == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			actionConfirmPage.Execute(w, map[string]string{"Token": token, "Action": claims.ActionID})
+			return
+		}
+	case http.MethodPost:
+		if err = h.Handle(r.Context(), r.FormValue("t"), r); err == nil {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintln(w, "Thank you, your response has been recorded.")
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case errors.Is(err, ErrActionToken), errors.Is(err, ErrActionUnknown):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrActionExpired):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.Is(err, ErrActionUsed):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "action failed", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActionHandlerConfirmsBeforeRunning(t *testing.T) {
+	signer := &ActionSigner{BaseURL: "https://example.com/act", Secret: []byte("secret"), TTL: time.Hour}
+	h := &ActionHandler{Signer: signer}
+	runs := 0
+	h.Register("approve", func(ctx context.Context, ev ActionEvent) error {
+		runs++
+		return nil
+	})
+	link, err := signer.URL("m1", "approve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := u.Query().Get("t")
+	form := url.Values{"t": {token}}.Encode()
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		wantCode int
+		wantRuns int
+	}{
+		{"preview", http.MethodGet, "/act?" + u.RawQuery, "", http.StatusOK, 0},
+		{"second preview", http.MethodGet, "/act?" + u.RawQuery, "", http.StatusOK, 0},
+		{"bad token", http.MethodGet, "/act?t=x.y", "", http.StatusBadRequest, 0},
+		{"put", http.MethodPut, "/act?" + u.RawQuery, "", http.StatusMethodNotAllowed, 0},
+		{"confirm", http.MethodPost, "/act", form, http.StatusOK, 1},
+		{"confirm again", http.MethodPost, "/act", form, http.StatusConflict, 1},
+		{"preview after use", http.MethodGet, "/act?" + u.RawQuery, "", http.StatusConflict, 1},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		if tt.body != "" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+		if runs != tt.wantRuns {
+			t.Errorf("%s: callback ran %d times, want %d", tt.name, runs, tt.wantRuns)
+		}
+		if tt.name == "preview" && !strings.Contains(w.Body.String(), `method="post"`) {
+			t.Errorf("preview page has no form: %s", w.Body)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sensitive messages go through a four-eyes workflow: a built message is
+// submitted for approval instead of being sent, the approvers are notified,
+// and only once a second person (never the requester) approved it is it
+// handed to the transport. Requests nobody decided on expire.
+
+// ApprovalState is the state of an approval request
+type ApprovalState string
+
+const (
+	ApprovalPending  ApprovalState = "pending"
+	ApprovalApproved ApprovalState = "approved"
+	ApprovalRejected ApprovalState = "rejected"
+	ApprovalExpired  ApprovalState = "expired"
+	ApprovalSent     ApprovalState = "sent"
+)
+
+var (
+	ErrApprovalNotFound = errors.New("approval request not found")
+	ErrNotPending       = errors.New("approval request is not pending")
+	ErrSelfApproval     = errors.New("requester cannot approve their own message")
+	ErrNotApprover      = errors.New("not an approver")
+	ErrNotResendable    = errors.New("approval request has no failed send")
+)
+
+// ApprovalDecision is a recorded approval or rejection
+type ApprovalDecision struct {
+	By       string    `json:"by"`
+	Approved bool      `json:"approved"`
+	Reason   string    `json:"reason,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// ApprovalRequest is a message waiting for approval
+type ApprovalRequest struct {
+	ID          string             `json:"id"`
+	Message     *Message           `json:"message"`
+	RequestedBy string             `json:"requested_by"`
+	State       ApprovalState      `json:"state"`
+	Decisions   []ApprovalDecision `json:"decisions,omitempty"`
+	CreatedAt   time.Time          `json:"created_at"`
+	ExpiresAt   time.Time          `json:"expires_at"`
+	// Set when sending the approved message failed
+	SendError string `json:"send_error,omitempty"`
+}
+
+// ApprovalNotifier tells approvers that a request is waiting for them
+type ApprovalNotifier interface {
+	NotifyApprovers(ctx context.Context, req *ApprovalRequest, approvers []string) error
+}
+
+// ApprovalWorkflow holds messages until they are approved
+type ApprovalWorkflow struct {
+	Transport Transport
+	Notifier  ApprovalNotifier
+	// Who may approve, anyone but the requester when empty
+	Approvers []string
+	// How long a request waits for a decision, 72 hours when zero
+	TTL time.Duration
+	// Clock, time.Now when nil
+	Now func() time.Time
+
+	mu       sync.Mutex
+	requests map[string]*ApprovalRequest
+}
+
+func (w *ApprovalWorkflow) now() time.Time {
+	if w.Now != nil {
+		return w.Now()
+	}
+	return time.Now()
+}
+
+// Submit puts a built message into pending approval and notifies the approvers
+func (w *ApprovalWorkflow) Submit(ctx context.Context, msg *Message, requestedBy string) (*ApprovalRequest, error) {
+	if msg.ID == "" {
+		msg.ID = NewMessageID()
+	}
+	ttl := w.TTL
+	if ttl <= 0 {
+		ttl = 72 * time.Hour
+	}
+	now := w.now()
+	// a copy, what gets approved must not change afterwards
+	req := &ApprovalRequest{
+		ID:          NewMessageID(),
+		Message:     copyMessage(msg),
+		RequestedBy: requestedBy,
+		State:       ApprovalPending,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	}
+
+	w.mu.Lock()
+	if w.requests == nil {
+		w.requests = make(map[string]*ApprovalRequest)
+	}
+	w.requests[req.ID] = req
+	w.mu.Unlock()
+
+	if w.Notifier != nil {
+		var approvers []string
+		for _, a := range w.Approvers {
+			if !strings.EqualFold(a, requestedBy) {
+				approvers = append(approvers, a)
+			}
+		}
+		if err := w.Notifier.NotifyApprovers(ctx, w.snapshot(req), approvers); err != nil {
+			return w.snapshot(req), fmt.Errorf("notify approvers: %w", err)
+		}
+	}
+	return w.snapshot(req), nil
+}
+
+// Approve records an approval and sends the message
+func (w *ApprovalWorkflow) Approve(ctx context.Context, id, approver, reason string) (*ApprovalRequest, error) {
+	req, err := w.decide(id, approver, true, reason)
+	if err != nil {
+		return nil, err
+	}
+	return w.send(ctx, req)
+}
+
+// Resend retries sending an approved message whose send failed. The approval
+// stands, nobody has to decide again.
+func (w *ApprovalWorkflow) Resend(ctx context.Context, id string) (*ApprovalRequest, error) {
+	w.mu.Lock()
+	req, ok := w.requests[id]
+	if !ok {
+		w.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrApprovalNotFound, id)
+	}
+	if req.State != ApprovalApproved || req.SendError == "" {
+		// no failed send, or another send is in flight
+		w.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s is %s", ErrNotResendable, id, req.State)
+	}
+	req.SendError = ""
+	w.mu.Unlock()
+	return w.send(ctx, req)
+}
+
+// Failed returns the approved requests whose send failed, oldest first
+func (w *ApprovalWorkflow) Failed() []*ApprovalRequest {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var list []*ApprovalRequest
+	for _, req := range w.requests {
+		if req.State == ApprovalApproved && req.SendError != "" {
+			list = append(list, w.snapshotLocked(req))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+func (w *ApprovalWorkflow) send(ctx context.Context, req *ApprovalRequest) (*ApprovalRequest, error) {
+	sendErr := w.Transport.Send(ctx, copyMessage(req.Message))
+
+	w.mu.Lock()
+	if sendErr != nil {
+		req.SendError = sendErr.Error()
+	} else {
+		req.State = ApprovalSent
+		req.SendError = ""
+	}
+	snap := w.snapshotLocked(req)
+	w.mu.Unlock()
+	return snap, sendErr
+}
+
+// Reject records a rejection. The message is dropped.
+func (w *ApprovalWorkflow) Reject(id, approver, reason string) (*ApprovalRequest, error) {
+	req, err := w.decide(id, approver, false, reason)
+	if err != nil {
+		return nil, err
+	}
+	return w.snapshot(req), nil
+}
+
+func (w *ApprovalWorkflow) decide(id, approver string, approved bool, reason string) (*ApprovalRequest, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	req, ok := w.requests[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrApprovalNotFound, id)
+	}
+	now := w.now()
+	if req.State == ApprovalPending && now.After(req.ExpiresAt) {
+		req.State = ApprovalExpired
+	}
+	if req.State != ApprovalPending {
+		return nil, fmt.Errorf("%w: %s is %s", ErrNotPending, id, req.State)
+	}
+	if strings.EqualFold(approver, req.RequestedBy) {
+		return nil, ErrSelfApproval
+	}
+	if len(w.Approvers) > 0 && !containsFold(w.Approvers, approver) {
+		return nil, fmt.Errorf("%w: %s", ErrNotApprover, approver)
+	}
+
+	req.Decisions = append(req.Decisions, ApprovalDecision{By: approver, Approved: approved, Reason: reason, At: now})
+	if approved {
+		req.State = ApprovalApproved
+	} else {
+		req.State = ApprovalRejected
+	}
+	return req, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns a request
+func (w *ApprovalWorkflow) Get(id string) (*ApprovalRequest, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	req, ok := w.requests[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrApprovalNotFound, id)
+	}
+	return w.snapshotLocked(req), nil
+}
+
+// Pending returns the requests waiting for a decision, oldest first
+func (w *ApprovalWorkflow) Pending() []*ApprovalRequest {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var list []*ApprovalRequest
+	for _, req := range w.requests {
+		if req.State == ApprovalPending {
+			list = append(list, w.snapshotLocked(req))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// ExpireStale marks pending requests past their expiry as expired and returns
+// how many there were
+func (w *ApprovalWorkflow) ExpireStale() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.now()
+	expired := 0
+	for _, req := range w.requests {
+		if req.State == ApprovalPending && now.After(req.ExpiresAt) {
+			req.State = ApprovalExpired
+			expired++
+		}
+	}
+	return expired
+}
+
+// StartExpiry runs ExpireStale every interval until the context is done
+func (w *ApprovalWorkflow) StartExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.ExpireStale()
+		}
+	}
+}
+
+func (w *ApprovalWorkflow) snapshot(req *ApprovalRequest) *ApprovalRequest {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.snapshotLocked(req)
+}
+
+func (w *ApprovalWorkflow) snapshotLocked(req *ApprovalRequest) *ApprovalRequest {
+	c := *req
+	c.Message = copyMessage(req.Message)
+	c.Decisions = append([]ApprovalDecision(nil), req.Decisions...)
+	return &c
+}
+
+// copyMessage copies the message including its body and headers
+func copyMessage(msg *Message) *Message {
+	if msg == nil {
+		return nil
+	}
+	c := *msg
+	c.Body = append([]byte(nil), msg.Body...)
+	if msg.Headers != nil {
+		c.Headers = make(map[string]string, len(msg.Headers))
+		for k, v := range msg.Headers {
+			c.Headers[k] = v
+		}
+	}
+	return &c
+}
+
+// ApprovalTransport is a Transport submitting every message for approval
+// instead of sending it, so it can be dropped in where a transport is expected
+type ApprovalTransport struct {
+	Workflow    *ApprovalWorkflow
+	RequestedBy string
+}
+
+func (t *ApprovalTransport) Send(ctx context.Context, msg *Message) error {
+	_, err := t.Workflow.Submit(ctx, msg, t.RequestedBy)
+	return err
+}
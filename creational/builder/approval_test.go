@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type failingNotifier struct{}
+
+func (failingNotifier) NotifyApprovers(ctx context.Context, req *ApprovalRequest, approvers []string) error {
+	return errors.New("mail down")
+}
+
+func TestApprovalDefaultTTL(t *testing.T) {
+	clock := newFakeClock()
+	w := &ApprovalWorkflow{Transport: &recordingTransport{}, Now: clock.Now}
+	req, err := w.Submit(context.Background(), &Message{Recipient: "santa@example.com"}, "elf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	if n := w.ExpireStale(); n != 0 {
+		t.Fatalf("expired %d requests after an hour", n)
+	}
+	if _, err := w.Approve(context.Background(), req.ID, "boss", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApprovalSubmitReturnsCopy(t *testing.T) {
+	w := &ApprovalWorkflow{Transport: &recordingTransport{}, Notifier: failingNotifier{}}
+	req, err := w.Submit(context.Background(), &Message{Recipient: "santa@example.com"}, "elf")
+	if err == nil {
+		t.Fatal("notifier error not returned")
+	}
+	req.State = ApprovalSent
+	got, err := w.Get(req.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != ApprovalPending {
+		t.Errorf("state = %s, want %s", got.State, ApprovalPending)
+	}
+}
+
+func TestApprovalSendsTheApprovedMessage(t *testing.T) {
+	transport := &recordingTransport{}
+	w := &ApprovalWorkflow{Transport: transport}
+	msg := &Message{Recipient: "santa@example.com", Body: []byte("a sled"), Headers: map[string]string{"Subject": "wish"}}
+	req, err := w.Submit(context.Background(), msg, "elf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// changes after the submit, to the original and to a snapshot
+	msg.Body[2] = 'b'
+	msg.Headers["Subject"] = "changed"
+	msg.Recipient = "grinch@example.com"
+	req.Message.Body[2] = 'c'
+	req.Message.Headers["Bcc"] = "grinch@example.com"
+
+	approved, err := w.Approve(context.Background(), req.ID, "boss", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, got := range []*Message{approved.Message, transport.sent[0]} {
+		if string(got.Body) != "a sled" || got.Recipient != "santa@example.com" ||
+			len(got.Headers) != 1 || got.Headers["Subject"] != "wish" {
+			t.Errorf("message = %q to %s with %v", got.Body, got.Recipient, got.Headers)
+		}
+	}
+}
+
+func TestApprovalResend(t *testing.T) {
+	transport := &recordingTransport{fail: func(*Message) error { return errors.New("down") }}
+	w := &ApprovalWorkflow{Transport: transport}
+	req, err := w.Submit(context.Background(), &Message{Recipient: "santa@example.com"}, "elf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Resend(context.Background(), req.ID); !errors.Is(err, ErrNotResendable) {
+		t.Errorf("resend of pending request: err = %v, want %v", err, ErrNotResendable)
+	}
+
+	if _, err := w.Approve(context.Background(), req.ID, "boss", ""); err == nil {
+		t.Fatal("send error not returned")
+	}
+	if failed := w.Failed(); len(failed) != 1 || failed[0].ID != req.ID {
+		t.Fatalf("Failed = %v", failed)
+	}
+
+	transport.fail = nil
+	got, err := w.Resend(context.Background(), req.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != ApprovalSent || got.SendError != "" {
+		t.Errorf("state %s, send error %q", got.State, got.SendError)
+	}
+	if transport.count() != 1 {
+		t.Errorf("sent %d messages, want 1", transport.count())
+	}
+	if _, err := w.Resend(context.Background(), req.ID); !errors.Is(err, ErrNotResendable) {
+		t.Errorf("resend of sent request: err = %v, want %v", err, ErrNotResendable)
+	}
+}
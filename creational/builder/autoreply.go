@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Auto replies answer inbound messages automatically, e.g. acknowledgements or
+// out of office notes. Replies are marked with Auto-Submitted (RFC 3834) and
+// never sent to messages that are themselves automatic, and every sender gets
+// at most one reply per RateLimit, so two auto responders cannot ping-pong.
+// Only mail is answered: on other channels the sender is an identity rather
+// than an address to reply to.
+
+// AutoReplyRule decides whether and how to answer a message
+type AutoReplyRule struct {
+	Name string
+	// Matches the sender, any sender when nil
+	Sender *regexp.Regexp
+	// Matches the message text, any text when nil
+	Content *regexp.Regexp
+	// Rule is only active in this period, zero values leave it open
+	ActiveFrom  time.Time
+	ActiveUntil time.Time
+	// Only active on these week days, every day when empty
+	Weekdays []time.Weekday
+	// Only active in [FromHour, UntilHour), all day when both are zero
+	FromHour  int
+	UntilHour int
+	// Reply text, a text/template executed with the InboundMessage
+	Reply *template.Template
+}
+
+func (r *AutoReplyRule) matches(msg *InboundMessage, now time.Time) bool {
+	if r.Sender != nil && !r.Sender.MatchString(msg.Sender) {
+		return false
+	}
+	if r.Content != nil && !r.Content.MatchString(msg.Text) {
+		return false
+	}
+	if !r.ActiveFrom.IsZero() && now.Before(r.ActiveFrom) {
+		return false
+	}
+	if !r.ActiveUntil.IsZero() && !now.Before(r.ActiveUntil) {
+		return false
+	}
+	if len(r.Weekdays) > 0 {
+		found := false
+		for _, d := range r.Weekdays {
+			if now.Weekday() == d {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.FromHour != 0 || r.UntilHour != 0 {
+		h := now.Hour()
+		if r.FromHour <= r.UntilHour {
+			if h < r.FromHour || h >= r.UntilHour {
+				return false
+			}
+		} else if h < r.FromHour && h >= r.UntilHour {
+			// window spans midnight, e.g. 18 to 8
+			return false
+		}
+	}
+	return true
+}
+
+// AutoResponder is an InboundHandler sending auto replies. The first matching
+// rule wins.
+type AutoResponder struct {
+	Rules     []*AutoReplyRule
+	Transport Transport
+	// Minimum time between two replies to the same sender, a day when zero.
+	// There is no way to turn this off, it is what stops reply loops.
+	RateLimit time.Duration
+	// Clock, time.Now when nil
+	Now func() time.Time
+
+	mu        sync.Mutex
+	lastReply map[string]time.Time
+	pruned    time.Time
+}
+
+func (a *AutoResponder) HandleInbound(ctx context.Context, msg *InboundMessage) error {
+	now := time.Now()
+	if a.Now != nil {
+		now = a.Now()
+	}
+	if msg.Channel != "smtp" || isAutomatic(msg) {
+		return nil
+	}
+
+	for _, rule := range a.Rules {
+		if !rule.matches(msg, now) {
+			continue
+		}
+		prev, ok := a.allow(msg.Sender, now)
+		if !ok {
+			return nil
+		}
+		if err := a.reply(ctx, rule, msg); err != nil {
+			// nothing went out, the next message may be answered
+			a.undo(msg.Sender, prev, now)
+			return err
+		}
+		return nil
+	}
+	return nil
+}
+
+func (a *AutoResponder) reply(ctx context.Context, rule *AutoReplyRule, msg *InboundMessage) error {
+	var text strings.Builder
+	if err := rule.Reply.Execute(&text, msg); err != nil {
+		return err
+	}
+
+	builder, err := NewReplyBuilder(msg)
+	if err != nil {
+		return err
+	}
+	builder.Headers = map[string]string{"Auto-Submitted": "auto-replied"}
+	builder.SetText(text.String())
+	reply, err := builder.Message()
+	if err != nil {
+		return err
+	}
+	return a.Transport.Send(ctx, reply)
+}
+
+// allow reserves the reply to a sender, so concurrent messages from the same
+// sender get one reply. It returns the time of the previous reply for undo.
+func (a *AutoResponder) allow(sender string, now time.Time) (time.Time, bool) {
+	limit := a.RateLimit
+	if limit <= 0 {
+		limit = 24 * time.Hour
+	}
+	key := strings.ToLower(sender)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lastReply == nil {
+		a.lastReply = make(map[string]time.Time)
+	}
+	a.prune(now, limit)
+	last, ok := a.lastReply[key]
+	if ok && now.Sub(last) < limit {
+		return time.Time{}, false
+	}
+	a.lastReply[key] = now
+	return last, true
+}
+
+// prune drops senders last answered before the rate limit, a.mu must be held.
+// It walks the map at most ten times per limit.
+func (a *AutoResponder) prune(now time.Time, limit time.Duration) {
+	if now.Sub(a.pruned) < limit/10 {
+		return
+	}
+	a.pruned = now
+	for key, last := range a.lastReply {
+		if now.Sub(last) >= limit {
+			delete(a.lastReply, key)
+		}
+	}
+}
+
+// undo drops the reservation of a reply that was not sent
+func (a *AutoResponder) undo(sender string, prev, now time.Time) {
+	key := strings.ToLower(sender)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.lastReply[key].Equal(now) {
+		return
+	}
+	if prev.IsZero() {
+		delete(a.lastReply, key)
+	} else {
+		a.lastReply[key] = prev
+	}
+}
+
+// isAutomatic reports whether a message must not be auto replied to: it is an
+// auto reply, bulk or list mail, or comes from a system address
+func isAutomatic(msg *InboundMessage) bool {
+	if msg.Sender == "" {
+		return true
+	}
+	if v := strings.ToLower(strings.TrimSpace(msg.Headers.Get("Auto-Submitted"))); v != "" && v != "no" {
+		return true
+	}
+	switch strings.ToLower(msg.Headers.Get("Precedence")) {
+	case "bulk", "list", "junk", "auto_reply":
+		return true
+	}
+	if msg.Headers.Get("List-Id") != "" || msg.Headers.Get("X-Auto-Response-Suppress") != "" {
+		return true
+	}
+	local := strings.ToLower(msg.Sender)
+	if i := strings.IndexByte(local, '@'); i >= 0 {
+		local = local[:i]
+	}
+	switch local {
+	case "mailer-daemon", "postmaster", "noreply", "no-reply", "donotreply":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func newInboundMail(sender string, headers textproto.MIMEHeader) *InboundMessage {
+	return &InboundMessage{
+		Message: &Message{ID: "in1", Format: "TEXT"},
+		Text:    "where is my present?",
+		Sender:  sender,
+		Channel: "smtp",
+		Headers: headers,
+	}
+}
+
+func TestAutoResponderRateLimit(t *testing.T) {
+	clock := newFakeClock()
+	transport := &recordingTransport{}
+	a := &AutoResponder{
+		Rules:     []*AutoReplyRule{{Reply: template.Must(template.New("").Parse("thanks"))}},
+		Transport: transport,
+		Now:       clock.Now,
+	}
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		fail    bool
+		want    int
+	}{
+		{"first message", 0, false, 1},
+		// the default limit applies when RateLimit is zero
+		{"same hour", time.Hour, false, 1},
+		{"next day", 24 * time.Hour, true, 1},
+		{"after failed send", time.Minute, false, 2},
+	}
+	for _, tt := range tests {
+		clock.Advance(tt.advance)
+		transport.fail = nil
+		if tt.fail {
+			transport.fail = func(*Message) error { return errors.New("down") }
+		}
+		err := a.HandleInbound(context.Background(), newInboundMail("kid@example.com", textproto.MIMEHeader{}))
+		if (err != nil) != tt.fail {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+		if got := transport.count(); got != tt.want {
+			t.Errorf("%s: sent %d replies, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAutoResponderSkipsAutomatic(t *testing.T) {
+	transport := &recordingTransport{}
+	a := &AutoResponder{
+		Rules:     []*AutoReplyRule{{Reply: template.Must(template.New("").Parse("thanks"))}},
+		Transport: transport,
+	}
+	tests := []struct {
+		sender  string
+		headers textproto.MIMEHeader
+	}{
+		{"bot@example.com", textproto.MIMEHeader{"Auto-Submitted": {"auto-replied"}}},
+		{"list@example.com", textproto.MIMEHeader{"Precedence": {"bulk"}}},
+		{"MAILER-DAEMON@example.com", textproto.MIMEHeader{}},
+		{"", textproto.MIMEHeader{}},
+	}
+	for _, tt := range tests {
+		if err := a.HandleInbound(context.Background(), newInboundMail(tt.sender, tt.headers)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the sender of an HTTP post is not an address
+	posted := newInboundMail("client-cert-cn", textproto.MIMEHeader{})
+	posted.Channel = "http"
+	if err := a.HandleInbound(context.Background(), posted); err != nil {
+		t.Fatal(err)
+	}
+	if n := transport.count(); n != 0 {
+		t.Errorf("sent %d replies, want 0", n)
+	}
+}
+
+func TestAutoResponderForgetsOldSenders(t *testing.T) {
+	clock := newFakeClock()
+	a := &AutoResponder{
+		Rules:     []*AutoReplyRule{{Reply: template.Must(template.New("").Parse("thanks"))}},
+		Transport: &recordingTransport{},
+		RateLimit: time.Hour,
+		Now:       clock.Now,
+	}
+	for _, sender := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		if err := a.HandleInbound(context.Background(), newInboundMail(sender, textproto.MIMEHeader{})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock.Advance(2 * time.Hour)
+	if err := a.HandleInbound(context.Background(), newInboundMail("d@example.com", textproto.MIMEHeader{})); err != nil {
+		t.Fatal(err)
+	}
+	a.mu.Lock()
+	n := len(a.lastReply)
+	a.mu.Unlock()
+	if n != 1 {
+		t.Errorf("remembered %d senders, want 1", n)
+	}
+}
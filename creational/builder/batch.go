@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// A transactional batch is all or nothing: every message is built, validated
+// and staged first, and only when all of them made it is the batch released to
+// the transport. A single failure rolls back everything staged so far. Sending
+// itself cannot be undone: when the transport fails part way, the messages not
+// sent yet stay staged and Resume sends them later.
+
+// BatchItem is one message of a batch
+type BatchItem struct {
+	Builder   MessageBuilder
+	Recipient string
+	Text      string
+}
+
+// StagingArea keeps built messages until the batch is released. The
+// MessageStore outbox satisfies it.
+type StagingArea interface {
+	Save(name string, msg *Message) error
+	Load(name string) (*Message, error)
+	Delete(name string) error
+}
+
+// MemoryStaging is a StagingArea kept in memory
+type MemoryStaging struct {
+	mu       sync.Mutex
+	messages map[string]*Message
+}
+
+func (s *MemoryStaging) Save(name string, msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.messages == nil {
+		s.messages = make(map[string]*Message)
+	}
+	s.messages[name] = msg
+	return nil
+}
+
+func (s *MemoryStaging) Load(name string) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg, ok := s.messages[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotStaged, name)
+	}
+	return msg, nil
+}
+
+func (s *MemoryStaging) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.messages, name)
+	return nil
+}
+
+// Len returns the number of staged messages
+func (s *MemoryStaging) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages)
+}
+
+// ItemFailure explains why a single batch item failed
+type ItemFailure struct {
+	Index     int
+	Recipient string
+	Stage     string
+	Err       error
+}
+
+// BatchError is returned when a batch did not go through. It lists every item
+// that failed, not only the first one.
+type BatchError struct {
+	// Phase the batch failed in: "build", "stage", "release" or "resume"
+	Phase    string
+	Failures []ItemFailure
+	// Items that were already handed to the transport when release failed
+	Released int
+	// IDs of the messages still staged after release failed, for Resume
+	Pending []string
+}
+
+func (e *BatchError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "batch failed during %s: %d item(s) failed", e.Phase, len(e.Failures))
+	for _, f := range e.Failures {
+		fmt.Fprintf(&b, "\n  #%d %s (%s): %v", f.Index, f.Recipient, f.Stage, f.Err)
+	}
+	if e.Phase == "release" {
+		fmt.Fprintf(&b, "\n  %d sent, %d still staged", e.Released, len(e.Pending))
+	}
+	return b.String()
+}
+
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f.Err
+	}
+	return errs
+}
+
+var (
+	ErrEmptyBatch = errors.New("batch has no items")
+	ErrNotStaged  = errors.New("message is not staged")
+)
+
+// TransactionalBatch builds, stages and releases batches
+type TransactionalBatch struct {
+	Staging   StagingArea
+	Transport Transport
+	// DefaultRetrier when nil
+	Retrier *Retrier
+	// Optional extra validation of each built message
+	Validate func(*Message) error
+
+	defaultRetrier sync.Once
+}
+
+// Run processes the items as a single transaction and returns the released
+// messages.
+func (t *TransactionalBatch) Run(ctx context.Context, items []BatchItem) ([]*Message, error) {
+	if len(items) == 0 {
+		return nil, ErrEmptyBatch
+	}
+
+	// Build and validate everything before touching the staging area
+	built := make([]*Message, len(items))
+	var failures []ItemFailure
+	for i, item := range items {
+		msg, err := t.build(item)
+		if err != nil {
+			failures = append(failures, ItemFailure{Index: i, Recipient: item.Recipient, Stage: "build", Err: err})
+			continue
+		}
+		built[i] = msg
+	}
+	if len(failures) > 0 {
+		return nil, &BatchError{Phase: "build", Failures: failures}
+	}
+
+	// Stage, rolling back on the first failure
+	for i, msg := range built {
+		if err := ctx.Err(); err != nil {
+			t.rollback(built[:i])
+			return nil, err
+		}
+		if err := t.Staging.Save(msg.ID, msg); err != nil {
+			t.rollback(built[:i])
+			return nil, &BatchError{Phase: "stage", Failures: []ItemFailure{
+				{Index: i, Recipient: items[i].Recipient, Stage: "stage", Err: err},
+			}}
+		}
+	}
+
+	return t.release(ctx, built)
+}
+
+// Resume sends the messages a failed release left staged, as listed in
+// BatchError.Pending. A failure stops it again the same way.
+func (t *TransactionalBatch) Resume(ctx context.Context, pending []string) ([]*Message, error) {
+	if len(pending) == 0 {
+		return nil, ErrEmptyBatch
+	}
+	msgs := make([]*Message, len(pending))
+	var failures []ItemFailure
+	for i, id := range pending {
+		msg, err := t.Staging.Load(id)
+		if err != nil {
+			failures = append(failures, ItemFailure{Index: i, Stage: "load", Err: err})
+			continue
+		}
+		msgs[i] = msg
+	}
+	if len(failures) > 0 {
+		return nil, &BatchError{Phase: "resume", Failures: failures, Pending: pending}
+	}
+	return t.release(ctx, msgs)
+}
+
+// release sends the staged messages in order. Messages already handed to the
+// transport cannot be taken back, so on failure the rest stays staged.
+func (t *TransactionalBatch) release(ctx context.Context, msgs []*Message) ([]*Message, error) {
+	t.defaultRetrier.Do(func() {
+		if t.Retrier == nil {
+			t.Retrier = DefaultRetrier()
+		}
+	})
+	for i, msg := range msgs {
+		err := t.Retrier.Do(ctx, func(ctx context.Context) error {
+			return t.Transport.Send(ctx, msg)
+		})
+		if err != nil {
+			pending := make([]string, 0, len(msgs)-i)
+			for _, m := range msgs[i:] {
+				pending = append(pending, m.ID)
+			}
+			return msgs[:i], &BatchError{Phase: "release", Released: i, Pending: pending, Failures: []ItemFailure{
+				{Index: i, Recipient: msg.Recipient, Stage: "send", Err: err},
+			}}
+		}
+		t.Staging.Delete(msg.ID)
+	}
+	return msgs, nil
+}
+
+func (t *TransactionalBatch) build(item BatchItem) (*Message, error) {
+	if item.Builder == nil {
+		return nil, errors.New("no builder")
+	}
+	if item.Recipient == "" {
+		return nil, errors.New("empty recipient")
+	}
+	if item.Text == "" {
+		return nil, errors.New("empty text")
+	}
+
+	item.Builder.SetRecipient(item.Recipient)
+	item.Builder.SetText(item.Text)
+	msg, err := item.Builder.Message()
+	if err != nil {
+		return nil, err
+	}
+	if t.Validate != nil {
+		if err := t.Validate(msg); err != nil {
+			return nil, err
+		}
+	}
+	if msg.ID == "" {
+		msg.ID = NewMessageID()
+	}
+	return msg, nil
+}
+
+func (t *TransactionalBatch) rollback(staged []*Message) {
+	for _, msg := range staged {
+		t.Staging.Delete(msg.ID)
+	}
+}
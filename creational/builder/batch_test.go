@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func batchItems(texts ...string) []BatchItem {
+	items := make([]BatchItem, len(texts))
+	for i, text := range texts {
+		items[i] = BatchItem{Builder: &JSONMessageBuilder{}, Recipient: "user" + string(rune('a'+i)), Text: text}
+	}
+	return items
+}
+
+func TestTransactionalBatchBuildFailures(t *testing.T) {
+	staging := &MemoryStaging{}
+	sent := 0
+	b := &TransactionalBatch{
+		Staging:   staging,
+		Transport: TransportFunc(func(ctx context.Context, msg *Message) error { sent++; return nil }),
+	}
+
+	_, err := b.Run(context.Background(), batchItems("a", "", "c", ""))
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("err = %v, want a BatchError", err)
+	}
+	if batchErr.Phase != "build" || len(batchErr.Failures) != 2 {
+		t.Errorf("phase = %s, failures = %d, want build and 2", batchErr.Phase, len(batchErr.Failures))
+	}
+	if sent != 0 || staging.Len() != 0 {
+		t.Errorf("sent %d, staged %d, want nothing", sent, staging.Len())
+	}
+}
+
+type failingStaging struct {
+	MemoryStaging
+	failAt int
+	saves  int
+}
+
+func (s *failingStaging) Save(name string, msg *Message) error {
+	s.saves++
+	if s.saves == s.failAt {
+		return errors.New("disk full")
+	}
+	return s.MemoryStaging.Save(name, msg)
+}
+
+func TestTransactionalBatchStageRollback(t *testing.T) {
+	staging := &failingStaging{failAt: 3}
+	sent := 0
+	b := &TransactionalBatch{
+		Staging:   staging,
+		Transport: TransportFunc(func(ctx context.Context, msg *Message) error { sent++; return nil }),
+	}
+
+	_, err := b.Run(context.Background(), batchItems("a", "b", "c", "d"))
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || batchErr.Phase != "stage" {
+		t.Fatalf("err = %v, want a stage BatchError", err)
+	}
+	if sent != 0 || staging.Len() != 0 {
+		t.Errorf("sent %d, staged %d, want nothing", sent, staging.Len())
+	}
+}
+
+func TestTransactionalBatchResume(t *testing.T) {
+	staging := &MemoryStaging{}
+	down := true
+	var sent []string
+	b := &TransactionalBatch{
+		Staging: staging,
+		Transport: TransportFunc(func(ctx context.Context, msg *Message) error {
+			if down && len(sent) == 2 {
+				return errors.New("connection reset")
+			}
+			sent = append(sent, msg.Recipient)
+			return nil
+		}),
+	}
+
+	released, err := b.Run(context.Background(), batchItems("a", "b", "c", "d"))
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || batchErr.Phase != "release" {
+		t.Fatalf("err = %v, want a release BatchError", err)
+	}
+	if len(released) != 2 || batchErr.Released != 2 || len(batchErr.Pending) != 2 {
+		t.Fatalf("released %d, Released %d, Pending %v", len(released), batchErr.Released, batchErr.Pending)
+	}
+	if staging.Len() != 2 {
+		t.Errorf("staged %d, want 2", staging.Len())
+	}
+
+	down = false
+	released, err = b.Resume(context.Background(), batchErr.Pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 2 || staging.Len() != 0 {
+		t.Errorf("resumed %d, staged %d", len(released), staging.Len())
+	}
+	want := []string{"usera", "userb", "userc", "userd"}
+	for i := range want {
+		if i >= len(sent) || sent[i] != want[i] {
+			t.Fatalf("sent %v, want %v", sent, want)
+		}
+	}
+
+	if _, err := b.Resume(context.Background(), []string{"gone"}); !errors.Is(err, ErrNotStaged) {
+		t.Errorf("err = %v, want %v", err, ErrNotStaged)
+	}
+}
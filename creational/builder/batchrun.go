@@ -0,0 +1,451 @@
+// The HTTP APIs use method and wildcard patterns, which the GOPATH build
+// would otherwise turn off
+//go:debug httpmuxgo121=0
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Batch runs send a long list of messages through the Sender and record their
+// progress in a checkpoint file after every item. After a crash the run is
+// started again with the same checkpoint and continues where it stopped:
+// completed items are never rebuilt or resent. Message IDs are derived from the
+// run and item keys, so an item that was sent right before a crash (but not
+// yet checkpointed) carries the same ID when resent and transports can drop it.
+
+// RunStatus is the state of a batch run
+type RunStatus string
+
+const (
+	RunPending   RunStatus = "pending"
+	RunRunning   RunStatus = "running"
+	RunPaused    RunStatus = "paused"
+	RunCancelled RunStatus = "cancelled"
+	RunCompleted RunStatus = "completed"
+	// Every item was attempted but some failed, running again retries them
+	RunCompletedWithFailures RunStatus = "completed-with-failures"
+)
+
+var (
+	ErrRunCancelled = errors.New("batch run cancelled")
+	ErrRunNotFound  = errors.New("batch run not found")
+)
+
+// RunItem is one message of a batch run. Key identifies the item across
+// restarts and must be unique within the run.
+type RunItem struct {
+	Key       string `json:"key"`
+	Recipient string `json:"recipient"`
+	Text      string `json:"text"`
+}
+
+// Checkpoint is the durable progress of a batch run
+type Checkpoint struct {
+	RunID  string    `json:"run_id"`
+	Status RunStatus `json:"status"`
+	Total  int       `json:"total"`
+	// Item key -> ID of the sent message
+	Completed map[string]string `json:"completed"`
+	// Item key -> last error
+	Failed    map[string]string `json:"failed,omitempty"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// LoadCheckpoint reads a checkpoint file
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cp, nil
+}
+
+func (c *Checkpoint) save(path string) error {
+	c.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	// the checkpoint is only worth something if it survives a crash
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// BatchRun sends items through the Sender with checkpoints
+type BatchRun struct {
+	ID             string
+	Items          []RunItem
+	CheckpointPath string
+	Sender         *Sender
+	NewBuilder     func() MessageBuilder
+	Transport      Transport
+	// DefaultRetrier when nil
+	Retrier *Retrier
+
+	defaultRetrier sync.Once
+
+	mu         sync.Mutex
+	checkpoint *Checkpoint
+	paused     bool
+	resume     chan struct{}
+	cancel     context.CancelFunc
+	cancelled  bool
+}
+
+// Run processes all items not yet completed. It returns once every item has
+// been attempted, the run is cancelled or the context is done.
+func (r *BatchRun) Run(ctx context.Context) error {
+	if err := r.load(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	r.mu.Lock()
+	if r.checkpoint.Status == RunCancelled || r.cancelled {
+		r.mu.Unlock()
+		return ErrRunCancelled
+	}
+	r.cancel = cancel
+	if r.checkpoint.Status == RunPaused {
+		r.paused = true
+	}
+	if r.paused {
+		r.checkpoint.Status = RunPaused
+	} else {
+		r.checkpoint.Status = RunRunning
+	}
+	err := r.checkpoint.save(r.CheckpointPath)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range r.Items {
+		if err := r.waitWhilePaused(ctx); err != nil {
+			return r.stopped(err)
+		}
+
+		r.mu.Lock()
+		_, done := r.checkpoint.Completed[item.Key]
+		r.mu.Unlock()
+		if done {
+			continue
+		}
+
+		id, err := r.send(ctx, item)
+
+		r.mu.Lock()
+		if err != nil {
+			if ctx.Err() != nil {
+				r.mu.Unlock()
+				return r.stopped(ctx.Err())
+			}
+			r.checkpoint.Failed[item.Key] = err.Error()
+		} else {
+			r.checkpoint.Completed[item.Key] = id
+			delete(r.checkpoint.Failed, item.Key)
+		}
+		err = r.checkpoint.save(r.CheckpointPath)
+		r.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checkpoint.Status = RunCompleted
+	if len(r.checkpoint.Failed) > 0 {
+		r.checkpoint.Status = RunCompletedWithFailures
+	}
+	return r.checkpoint.save(r.CheckpointPath)
+}
+
+func (r *BatchRun) load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.loadLocked()
+}
+
+// loadLocked reads the checkpoint, r.mu must be held
+func (r *BatchRun) loadLocked() error {
+	seen := make(map[string]bool, len(r.Items))
+	for _, item := range r.Items {
+		if seen[item.Key] {
+			return fmt.Errorf("duplicate item key %q", item.Key)
+		}
+		seen[item.Key] = true
+	}
+
+	cp, err := LoadCheckpoint(r.CheckpointPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		cp = &Checkpoint{RunID: r.ID, Status: RunPending}
+	case err != nil:
+		return err
+	case cp.RunID != r.ID:
+		return fmt.Errorf("checkpoint %s belongs to run %s, not %s", r.CheckpointPath, cp.RunID, r.ID)
+	}
+	if cp.Completed == nil {
+		cp.Completed = make(map[string]string)
+	}
+	if cp.Failed == nil {
+		cp.Failed = make(map[string]string)
+	}
+	cp.Total = len(r.Items)
+	r.checkpoint = cp
+	return nil
+}
+
+func (r *BatchRun) send(ctx context.Context, item RunItem) (string, error) {
+	builder := r.NewBuilder()
+	msg, err := r.Sender.Build(builder, item.Recipient, item.Text)
+	if err != nil {
+		return "", err
+	}
+	msg.ID = runMessageID(r.ID, item.Key)
+
+	r.defaultRetrier.Do(func() {
+		if r.Retrier == nil {
+			r.Retrier = DefaultRetrier()
+		}
+	})
+	err = r.Retrier.Do(ctx, func(ctx context.Context) error {
+		return r.Transport.Send(ctx, msg)
+	})
+	if err != nil {
+		return "", err
+	}
+	return msg.ID, nil
+}
+
+func runMessageID(runID, key string) string {
+	sum := sha256.Sum256([]byte(runID + "\x00" + key))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (r *BatchRun) waitWhilePaused(ctx context.Context) error {
+	for {
+		r.mu.Lock()
+		if r.cancelled {
+			r.mu.Unlock()
+			return ErrRunCancelled
+		}
+		if !r.paused {
+			r.mu.Unlock()
+			return ctx.Err()
+		}
+		if r.resume == nil {
+			r.resume = make(chan struct{})
+		}
+		resume := r.resume
+		r.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-resume:
+		}
+	}
+}
+
+// stopped records a cancellation. An interrupted context (e.g. shutdown) leaves
+// the run as it was so it continues on the next start.
+func (r *BatchRun) stopped(err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancelled {
+		r.checkpoint.Status = RunCancelled
+		if saveErr := r.checkpoint.save(r.CheckpointPath); saveErr != nil {
+			return saveErr
+		}
+		return ErrRunCancelled
+	}
+	return err
+}
+
+// Pause stops the run before the next item
+func (r *BatchRun) Pause() error {
+	return r.setStatus(RunPaused)
+}
+
+// Resume continues a paused run
+func (r *BatchRun) Resume() error {
+	return r.setStatus(RunRunning)
+}
+
+// Cancel stops the run for good. A cancelled run cannot be resumed.
+func (r *BatchRun) Cancel() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cancelled = true
+	if r.cancel != nil {
+		r.cancel()
+	}
+	if r.resume != nil {
+		close(r.resume)
+		r.resume = nil
+	}
+	if r.checkpoint == nil {
+		// not started yet, the cancel must still survive a restart
+		if err := r.loadLocked(); err != nil {
+			return err
+		}
+	}
+	r.checkpoint.Status = RunCancelled
+	return r.checkpoint.save(r.CheckpointPath)
+}
+
+func (r *BatchRun) setStatus(status RunStatus) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancelled {
+		return ErrRunCancelled
+	}
+	r.paused = status == RunPaused
+	if !r.paused && r.resume != nil {
+		close(r.resume)
+		r.resume = nil
+	}
+	if r.checkpoint == nil || r.checkpoint.Status == RunCompleted || r.checkpoint.Status == RunCompletedWithFailures {
+		return nil
+	}
+	r.checkpoint.Status = status
+	return r.checkpoint.save(r.CheckpointPath)
+}
+
+// Progress returns a copy of the current checkpoint
+func (r *BatchRun) Progress() Checkpoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.checkpoint == nil {
+		return Checkpoint{RunID: r.ID, Status: RunPending, Total: len(r.Items)}
+	}
+	cp := *r.checkpoint
+	cp.Completed = make(map[string]string, len(r.checkpoint.Completed))
+	for k, v := range r.checkpoint.Completed {
+		cp.Completed[k] = v
+	}
+	cp.Failed = make(map[string]string, len(r.checkpoint.Failed))
+	for k, v := range r.checkpoint.Failed {
+		cp.Failed[k] = v
+	}
+	return cp
+}
+
+// BatchRuns keeps track of the runs of a process and exposes them over HTTP:
+//
+//	GET  /runs
+//	GET  /runs/{id}
+//	POST /runs/{id}/pause
+//	POST /runs/{id}/resume
+//	POST /runs/{id}/cancel
+type BatchRuns struct {
+	mu   sync.RWMutex
+	runs map[string]*BatchRun
+}
+
+func NewBatchRuns() *BatchRuns {
+	return &BatchRuns{runs: make(map[string]*BatchRun)}
+}
+
+func (b *BatchRuns) Add(run *BatchRun) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.runs[run.ID] = run
+}
+
+func (b *BatchRuns) Get(id string) (*BatchRun, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	run, ok := b.runs[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRunNotFound, id)
+	}
+	return run, nil
+}
+
+func (b *BatchRuns) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /runs", func(w http.ResponseWriter, r *http.Request) {
+		b.mu.RLock()
+		progress := make([]Checkpoint, 0, len(b.runs))
+		for _, run := range b.runs {
+			progress = append(progress, run.Progress())
+		}
+		b.mu.RUnlock()
+		sort.Slice(progress, func(i, j int) bool { return progress[i].RunID < progress[j].RunID })
+		writeJSON(w, http.StatusOK, progress)
+	})
+	mux.HandleFunc("GET /runs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		run, err := b.Get(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, run.Progress())
+	})
+	mux.HandleFunc("POST /runs/{id}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		run, err := b.Get(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		switch r.PathValue("action") {
+		case "pause":
+			err = run.Pause()
+		case "resume":
+			err = run.Resume()
+		case "cancel":
+			err = run.Cancel()
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, http.StatusOK, run.Progress())
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
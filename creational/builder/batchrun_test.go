@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingTransport struct {
+	mu   sync.Mutex
+	sent []*Message
+	fail func(*Message) error
+}
+
+func (t *recordingTransport) Send(ctx context.Context, msg *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.fail != nil {
+		if err := t.fail(msg); err != nil {
+			return err
+		}
+	}
+	t.sent = append(t.sent, msg)
+	return nil
+}
+
+func (t *recordingTransport) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.sent)
+}
+
+func newTestRun(t *testing.T, transport Transport, keys ...string) *BatchRun {
+	items := make([]RunItem, len(keys))
+	for i, key := range keys {
+		items[i] = RunItem{Key: key, Recipient: key + "@example.com", Text: "hello " + key}
+	}
+	return &BatchRun{
+		ID:             "run1",
+		Items:          items,
+		CheckpointPath: filepath.Join(t.TempDir(), "run1.json"),
+		Sender:         &Sender{},
+		NewBuilder:     func() MessageBuilder { return &JSONMessageBuilder{} },
+		Transport:      transport,
+	}
+}
+
+func TestBatchRunContinuesFromCheckpoint(t *testing.T) {
+	transport := &recordingTransport{}
+	run := newTestRun(t, transport, "a", "b", "c")
+	transport.fail = func(msg *Message) error {
+		if msg.Recipient == "b@example.com" {
+			return errors.New("mailbox unavailable")
+		}
+		return nil
+	}
+
+	if err := run.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := LoadCheckpoint(run.CheckpointPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Status != RunCompletedWithFailures || len(cp.Completed) != 2 || len(cp.Failed) != 1 {
+		t.Fatalf("checkpoint = %+v", cp)
+	}
+
+	// a restart only retries the failed item, with the same message ID
+	transport.fail = nil
+	restarted := newTestRun(t, transport, "a", "b", "c")
+	restarted.CheckpointPath = run.CheckpointPath
+	if err := restarted.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if transport.count() != 3 {
+		t.Errorf("sent %d messages, want 3", transport.count())
+	}
+	last := transport.sent[len(transport.sent)-1]
+	if last.ID != runMessageID("run1", "b") {
+		t.Errorf("resent ID = %s, want %s", last.ID, runMessageID("run1", "b"))
+	}
+	if p := restarted.Progress(); p.Status != RunCompleted || len(p.Failed) != 0 {
+		t.Errorf("progress = %+v", p)
+	}
+}
+
+func TestBatchRunCancelBeforeRun(t *testing.T) {
+	transport := &recordingTransport{}
+	run := newTestRun(t, transport, "a", "b")
+	if err := run.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := LoadCheckpoint(run.CheckpointPath)
+	if err != nil {
+		t.Fatalf("cancel not persisted: %v", err)
+	}
+	if cp.Status != RunCancelled {
+		t.Errorf("status = %s, want %s", cp.Status, RunCancelled)
+	}
+
+	// a new process picking up the checkpoint must not send anything
+	restarted := newTestRun(t, transport, "a", "b")
+	restarted.CheckpointPath = run.CheckpointPath
+	if err := restarted.Run(context.Background()); !errors.Is(err, ErrRunCancelled) {
+		t.Errorf("err = %v, want %v", err, ErrRunCancelled)
+	}
+	if transport.count() != 0 {
+		t.Errorf("sent %d messages", transport.count())
+	}
+}
+
+func TestBatchRunPauseResume(t *testing.T) {
+	transport := &recordingTransport{}
+	run := newTestRun(t, transport, "a", "b", "c")
+	if err := run.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- run.Run(context.Background()) }()
+
+	time.Sleep(20 * time.Millisecond)
+	if transport.count() != 0 {
+		t.Fatalf("paused run sent %d messages", transport.count())
+	}
+	if p := run.Progress(); p.Status != RunPaused {
+		t.Errorf("status = %s, want %s", p.Status, RunPaused)
+	}
+	if err := run.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if transport.count() != 3 {
+		t.Errorf("sent %d messages, want 3", transport.count())
+	}
+}
+
+func TestBatchRunsHandler(t *testing.T) {
+	runs := NewBatchRuns()
+	run := newTestRun(t, &recordingTransport{}, "a")
+	runs.Add(run)
+	h := runs.Handler()
+
+	tests := []struct {
+		method, path string
+		code         int
+		body         string
+	}{
+		{"GET", "/runs", http.StatusOK, `"run_id":"run1"`},
+		{"GET", "/runs/run1", http.StatusOK, `"status":"pending"`},
+		{"GET", "/runs/nope", http.StatusNotFound, ""},
+		{"POST", "/runs/run1/cancel", http.StatusOK, `"status":"cancelled"`},
+		{"POST", "/runs/run1/resume", http.StatusConflict, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%s %s = %d %s, want %d %s", tt.method, tt.path, w.Code, w.Body, tt.code, tt.body)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BulkTransport sends many messages in one provider request
+type BulkTransport interface {
+	// SendBatch returns one result per message, in order. A non nil error
+	// means the whole request failed and applies to every message.
+	SendBatch(ctx context.Context, msgs []*Message) ([]error, error)
+}
+
+// BulkTransportFunc adapts a plain function to the BulkTransport interface
+type BulkTransportFunc func(ctx context.Context, msgs []*Message) ([]error, error)
+
+func (f BulkTransportFunc) SendBatch(ctx context.Context, msgs []*Message) ([]error, error) {
+	return f(ctx, msgs)
+}
+
+var (
+	ErrMessageTooLarge = errors.New("message larger than the batch byte limit")
+	ErrNoBatchResult   = errors.New("provider returned no result for message")
+	ErrBatchingClosed  = errors.New("batching transport closed")
+)
+
+// BatchingTransport is a Transport that collects messages into batches per
+// destination and hands them to a BulkTransport. A batch goes out when it is
+// full by count or bytes, or when its oldest message waited MaxLatency. Send
+// blocks until the message's own result is known. With a Retrier only the
+// messages that failed transiently are retried, as a smaller batch.
+type BatchingTransport struct {
+	Bulk BulkTransport
+	// Groups messages, the recipient's domain when nil
+	Destination func(*Message) string
+	// Messages per batch, 100 when zero
+	MaxCount int
+	// Body bytes per batch, no limit when zero
+	MaxBytes int
+	// Longest a message waits for its batch to fill, 100ms when zero
+	MaxLatency time.Duration
+	// Retries failed messages, leave nil when a Dispatcher retries already
+	Retrier *Retrier
+
+	mu     sync.Mutex
+	groups map[string]*pendingBatch
+	closed bool
+	wg     sync.WaitGroup
+	// outlives the callers waiting on a batch, cancelled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type pendingBatch struct {
+	items []*batchedMessage
+	bytes int
+	timer *time.Timer
+}
+
+type batchedMessage struct {
+	msg  *Message
+	err  error
+	done chan error
+}
+
+// RecipientDomain groups messages by the part of the recipient after the @
+func RecipientDomain(msg *Message) string {
+	if _, domain, ok := strings.Cut(msg.Recipient, "@"); ok {
+		return strings.ToLower(domain)
+	}
+	return msg.Recipient
+}
+
+func (b *BatchingTransport) Send(ctx context.Context, msg *Message) error {
+	if b.MaxBytes > 0 && len(msg.Body) > b.MaxBytes {
+		return PermanentError(fmt.Errorf("%w: %d > %d bytes", ErrMessageTooLarge, len(msg.Body), b.MaxBytes))
+	}
+	item := &batchedMessage{msg: msg, done: make(chan error, 1)}
+	if err := b.add(item); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-item.done:
+		return err
+	case <-ctx.Done():
+		// the batch may still carry the message, the caller just stops waiting
+		return ctx.Err()
+	}
+}
+
+func (b *BatchingTransport) add(item *batchedMessage) error {
+	destination := b.Destination
+	if destination == nil {
+		destination = RecipientDomain
+	}
+	maxCount := b.MaxCount
+	if maxCount <= 0 {
+		maxCount = 100
+	}
+	latency := b.MaxLatency
+	if latency <= 0 {
+		latency = 100 * time.Millisecond
+	}
+	key := destination(item.msg)
+	size := len(item.msg.Body)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return PermanentError(ErrBatchingClosed)
+	}
+	if b.groups == nil {
+		b.groups = make(map[string]*pendingBatch)
+		b.ctx, b.cancel = context.WithCancel(context.Background())
+	}
+
+	batch := b.groups[key]
+	if batch != nil && b.MaxBytes > 0 && batch.bytes+size > b.MaxBytes {
+		b.release(key)
+		batch = nil
+	}
+	if batch == nil {
+		batch = &pendingBatch{}
+		b.groups[key] = batch
+		batch.timer = time.AfterFunc(latency, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			// the batch may have been released by size in the meantime
+			if b.groups[key] == batch {
+				b.release(key)
+			}
+		})
+	}
+	batch.items = append(batch.items, item)
+	batch.bytes += size
+	if len(batch.items) >= maxCount {
+		b.release(key)
+	}
+	return nil
+}
+
+// release sends the pending batch of a destination, b.mu must be held
+func (b *BatchingTransport) release(key string) {
+	batch := b.groups[key]
+	delete(b.groups, key)
+	batch.timer.Stop()
+	ctx := b.ctx
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.send(ctx, batch.items)
+	}()
+}
+
+func (b *BatchingTransport) send(ctx context.Context, items []*batchedMessage) {
+	retrier := b.Retrier
+	if retrier == nil {
+		// one attempt, every failure goes back to its caller
+		retrier = &Retrier{Policy: ConstantPolicy{MaxAttempts: 1}}
+	}
+	classify := retrier.Classify
+	if classify == nil {
+		classify = ClassifyError
+	}
+
+	pending := items
+	retrier.Do(ctx, func(ctx context.Context) error {
+		msgs := make([]*Message, len(pending))
+		for i, item := range pending {
+			msgs[i] = item.msg
+		}
+		// Close only stops the retries, a request under way is completed
+		results, err := b.Bulk.SendBatch(context.WithoutCancel(ctx), msgs)
+
+		var failed []*batchedMessage
+		for i, item := range pending {
+			itemErr := err
+			if itemErr == nil {
+				if i < len(results) {
+					itemErr = results[i]
+				} else {
+					itemErr = ErrNoBatchResult
+				}
+			}
+			switch {
+			case itemErr == nil:
+				item.done <- nil
+			case classify(itemErr) == Permanent:
+				item.done <- itemErr
+			default:
+				item.err = itemErr
+				failed = append(failed, item)
+			}
+		}
+		pending = failed
+		if len(pending) > 0 {
+			return TransientError(fmt.Errorf("%d of %d messages failed: %w", len(pending), len(msgs), pending[0].err))
+		}
+		return nil
+	})
+
+	// out of retries
+	for _, item := range pending {
+		item.done <- item.err
+	}
+}
+
+// Flush sends every pending batch right away
+func (b *BatchingTransport) Flush() {
+	b.mu.Lock()
+	for key := range b.groups {
+		b.release(key)
+	}
+	b.mu.Unlock()
+}
+
+// Close sends the pending batches and waits until they are done. Batches are
+// not retried from then on, messages that fail get their error. Send fails
+// with ErrBatchingClosed afterwards.
+func (b *BatchingTransport) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	for key := range b.groups {
+		b.release(key)
+	}
+	if b.cancel != nil {
+		b.cancel()
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingBulk fails the messages whose recipient is in fail, once each
+type recordingBulk struct {
+	mu      sync.Mutex
+	batches [][]string
+	fail    map[string]error
+}
+
+func (b *recordingBulk) SendBatch(ctx context.Context, msgs []*Message) ([]error, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var batch []string
+	results := make([]error, len(msgs))
+	for i, msg := range msgs {
+		batch = append(batch, msg.Recipient)
+		if err, ok := b.fail[msg.Recipient]; ok {
+			results[i] = err
+			delete(b.fail, msg.Recipient)
+		}
+	}
+	b.batches = append(b.batches, batch)
+	return results, nil
+}
+
+func (b *recordingBulk) sizes() []int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var sizes []int
+	for _, batch := range b.batches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
+
+func sendAll(b *BatchingTransport, recipients ...string) map[string]error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(map[string]error)
+	for _, r := range recipients {
+		wg.Add(1)
+		go func(r string) {
+			defer wg.Done()
+			err := b.Send(context.Background(), &Message{Recipient: r})
+			mu.Lock()
+			errs[r] = err
+			mu.Unlock()
+		}(r)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestBatchingTransportRetries(t *testing.T) {
+	busy := TransientError(errors.New("busy"))
+	tests := []struct {
+		name      string
+		retrier   *Retrier
+		wantSizes []int
+		wantErr   error
+	}{
+		// a Dispatcher in front does the retrying
+		{"no retrier", nil, []int{3}, busy},
+		{"retrier", &Retrier{Policy: ConstantPolicy{Delay: time.Millisecond, MaxAttempts: 2}}, []int{3, 1}, nil},
+	}
+	for _, tt := range tests {
+		bulk := &recordingBulk{fail: map[string]error{"b@example.com": busy}}
+		b := &BatchingTransport{Bulk: bulk, MaxCount: 3, MaxLatency: time.Hour, Retrier: tt.retrier}
+		errs := sendAll(b, "a@example.com", "b@example.com", "c@example.com")
+		b.Close()
+
+		if errs["a@example.com"] != nil || errs["c@example.com"] != nil {
+			t.Errorf("%s: errors = %v", tt.name, errs)
+		}
+		if !errors.Is(errs["b@example.com"], tt.wantErr) {
+			t.Errorf("%s: b: err = %v, want %v", tt.name, errs["b@example.com"], tt.wantErr)
+		}
+		sizes := bulk.sizes()
+		if len(sizes) != len(tt.wantSizes) {
+			t.Errorf("%s: batch sizes %v, want %v", tt.name, sizes, tt.wantSizes)
+			continue
+		}
+		for i := range sizes {
+			if sizes[i] != tt.wantSizes[i] {
+				t.Errorf("%s: batch sizes %v, want %v", tt.name, sizes, tt.wantSizes)
+				break
+			}
+		}
+	}
+}
+
+func TestBatchingTransportCloseStopsRetries(t *testing.T) {
+	busy := TransientError(errors.New("busy"))
+	bulk := BulkTransportFunc(func(ctx context.Context, msgs []*Message) ([]error, error) {
+		return nil, busy
+	})
+	b := &BatchingTransport{
+		Bulk:       bulk,
+		MaxLatency: time.Millisecond,
+		Retrier:    &Retrier{Policy: ConstantPolicy{Delay: time.Minute, MaxAttempts: 10}},
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- b.Send(context.Background(), &Message{Recipient: "a@example.com"}) }()
+	// let the first attempt fail and the retry wait start
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		b.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for the retry delay")
+	}
+	if err := <-done; !errors.Is(err, busy) {
+		t.Errorf("Send: err = %v, want %v", err, busy)
+	}
+
+	err := b.Send(context.Background(), &Message{Recipient: "a@example.com"})
+	if !errors.Is(err, ErrBatchingClosed) || ClassifyError(err) != Permanent {
+		t.Errorf("Send after Close: err = %v, want a permanent %v", err, ErrBatchingClosed)
+	}
+}
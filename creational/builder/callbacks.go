@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Providers report back what happened to the messages we handed them. Every
+// provider has its own payload shape, so an adapter turns the raw request into
+// DeliveryEvents; the receiver verifies the signature, maps the provider's
+// reference to our message ID, drops duplicates and updates the lifecycle.
+
+// DeliveryEvent is a provider callback in a provider independent shape
+type DeliveryEvent struct {
+	// Provider's unique event ID, used to drop redelivered callbacks
+	EventID string
+	// Provider's reference for the message
+	ProviderRef string
+	// Our message ID, if the provider echoes it back
+	MessageID string
+	State     MessageState
+	At        time.Time
+	Reason    string
+}
+
+// CallbackAdapter parses a provider specific callback payload
+type CallbackAdapter interface {
+	Parse(header http.Header, body []byte) ([]DeliveryEvent, error)
+}
+
+// CallbackVerifier checks that a callback really comes from the provider
+type CallbackVerifier interface {
+	Verify(header http.Header, body []byte) error
+}
+
+var (
+	ErrBadSignature    = errors.New("callback signature mismatch")
+	ErrUnmappedMessage = errors.New("callback does not map to a message")
+)
+
+// JSONCallbackAdapter handles a single JSON event per request:
+//
+//	{"id": "...", "message_id": "...", "status": "delivered", "timestamp": "RFC3339", "reason": "..."}
+type JSONCallbackAdapter struct{}
+
+func (JSONCallbackAdapter) Parse(header http.Header, body []byte) ([]DeliveryEvent, error) {
+	var p struct {
+		ID        string    `json:"id"`
+		MessageID string    `json:"message_id"`
+		Status    string    `json:"status"`
+		Timestamp time.Time `json:"timestamp"`
+		Reason    string    `json:"reason"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	state, err := parseCallbackState(p.Status)
+	if err != nil {
+		return nil, err
+	}
+	return []DeliveryEvent{{
+		EventID:   p.ID,
+		MessageID: p.MessageID,
+		State:     state,
+		At:        p.Timestamp,
+		Reason:    p.Reason,
+	}}, nil
+}
+
+// BatchCallbackAdapter handles an array of events referencing the provider's
+// own message reference and unix timestamps:
+//
+//	[{"event_id": "...", "ref": "...", "event": "bounce", "ts": 1700000000, "error": "..."}]
+type BatchCallbackAdapter struct{}
+
+func (BatchCallbackAdapter) Parse(header http.Header, body []byte) ([]DeliveryEvent, error) {
+	var items []struct {
+		EventID string `json:"event_id"`
+		Ref     string `json:"ref"`
+		Event   string `json:"event"`
+		TS      int64  `json:"ts"`
+		Error   string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, err
+	}
+
+	events := make([]DeliveryEvent, 0, len(items))
+	for _, it := range items {
+		state, err := parseCallbackState(it.Event)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, DeliveryEvent{
+			EventID:     it.EventID,
+			ProviderRef: it.Ref,
+			State:       state,
+			At:          time.Unix(it.TS, 0).UTC(),
+			Reason:      it.Error,
+		})
+	}
+	return events, nil
+}
+
+// FormCallbackAdapter handles form encoded callbacks as sent by SMS providers:
+//
+//	MessageSid=...&MessageStatus=delivered&ErrorCode=...
+//
+// Such providers do not send an event ID, so reference and status are used.
+type FormCallbackAdapter struct{}
+
+func (FormCallbackAdapter) Parse(header http.Header, body []byte) ([]DeliveryEvent, error) {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	ref := values.Get("MessageSid")
+	if ref == "" {
+		return nil, errors.New("missing MessageSid")
+	}
+	state, err := parseCallbackState(values.Get("MessageStatus"))
+	if err != nil {
+		return nil, err
+	}
+	return []DeliveryEvent{{
+		EventID:     ref + "/" + string(state),
+		ProviderRef: ref,
+		State:       state,
+		At:          time.Now().UTC(),
+		Reason:      values.Get("ErrorCode"),
+	}}, nil
+}
+
+func parseCallbackState(status string) (MessageState, error) {
+	switch strings.ToLower(status) {
+	case "sent", "accepted", "queued":
+		return StateSent, nil
+	case "delivered", "delivery":
+		return StateDelivered, nil
+	case "failed", "bounce", "bounced", "undelivered", "rejected", "dropped":
+		return StateFailed, nil
+	case "opened", "open", "read":
+		return StateOpened, nil
+	}
+	return "", fmt.Errorf("unknown callback status %q", status)
+}
+
+// HMACVerifier checks a hex encoded HMAC-SHA256 of the body carried in a
+// header, optionally prefixed, e.g. "sha256=..."
+type HMACVerifier struct {
+	Header string
+	Prefix string
+	Secret []byte
+}
+
+func (v *HMACVerifier) Verify(header http.Header, body []byte) error {
+	got := strings.TrimPrefix(header.Get(v.Header), v.Prefix)
+	sig, err := hex.DecodeString(got)
+	if err != nil {
+		return ErrBadSignature
+	}
+	mac := hmac.New(sha256.New, v.Secret)
+	mac.Write(body)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// ProviderRefs maps provider references to our message IDs. The Dispatcher
+// records the reference a RefTransport gets back when handing over a message.
+type ProviderRefs struct {
+	mu   sync.RWMutex
+	refs map[string]string
+}
+
+func NewProviderRefs() *ProviderRefs {
+	return &ProviderRefs{refs: make(map[string]string)}
+}
+
+func (p *ProviderRefs) Record(providerRef, messageID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refs[providerRef] = messageID
+}
+
+func (p *ProviderRefs) Lookup(providerRef string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	id, ok := p.refs[providerRef]
+	return id, ok
+}
+
+// CallbackReceiver is the HTTP handler for one provider's callbacks
+type CallbackReceiver struct {
+	Adapter  CallbackAdapter
+	Verifier CallbackVerifier
+	Refs     *ProviderRefs
+	Store    *LifecycleStore
+	// Maximum accepted body size, 1MB when zero
+	MaxBodySize int64
+	// How long event keys are remembered to drop redeliveries, 24h when zero
+	DedupeWindow time.Duration
+
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+func (c *CallbackReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := c.MaxBodySize
+	if limit <= 0 {
+		limit = 1 << 20
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		http.Error(w, "cannot read body", http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > limit {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if c.Verifier != nil {
+		if err := c.Verifier.Verify(r.Header, body); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	events, err := c.Adapter.Parse(r.Header, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	processed := 0
+	for _, ev := range events {
+		done, err := c.Process(ev)
+		if errors.Is(err, ErrUnmappedMessage) || errors.Is(err, ErrUnknownMessage) {
+			// Answering with an error would only make the provider retry forever
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrInvalidTransition) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if done {
+			processed++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"received": len(events), "processed": processed})
+}
+
+// Process applies a single event. It reports false for events that have been
+// seen before.
+func (c *CallbackReceiver) Process(ev DeliveryEvent) (bool, error) {
+	messageID := ev.MessageID
+	if messageID == "" && c.Refs != nil {
+		messageID, _ = c.Refs.Lookup(ev.ProviderRef)
+	}
+	if messageID == "" {
+		return false, fmt.Errorf("%w: ref %q", ErrUnmappedMessage, ev.ProviderRef)
+	}
+
+	key := ev.EventID
+	if key == "" {
+		key = messageID + "/" + string(ev.State) + "/" + strconv.FormatInt(ev.At.UnixNano(), 10)
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	if c.seen == nil {
+		c.seen = make(map[string]time.Time)
+	}
+	c.prune(now)
+	if _, ok := c.seen[key]; ok {
+		c.mu.Unlock()
+		return false, nil
+	}
+	c.seen[key] = now
+	c.mu.Unlock()
+
+	at := ev.At
+	if at.IsZero() {
+		at = now
+	}
+	if err := c.Store.Transition(messageID, ev.State, at, ev.Reason); err != nil {
+		if !errors.Is(err, ErrInvalidTransition) {
+			// let a redelivery of the event try again
+			c.mu.Lock()
+			delete(c.seen, key)
+			c.mu.Unlock()
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// prune forgets event keys older than the dedupe window, c.mu must be held
+func (c *CallbackReceiver) prune(now time.Time) {
+	window := c.DedupeWindow
+	if window <= 0 {
+		window = 24 * time.Hour
+	}
+	// a full scan at most ten times per window
+	if now.Sub(c.pruned) < window/10 {
+		return
+	}
+	c.pruned = now
+	for key, at := range c.seen {
+		if now.Sub(at) > window {
+			delete(c.seen, key)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallbackAdapters(t *testing.T) {
+	tests := []struct {
+		name    string
+		adapter CallbackAdapter
+		body    string
+		want    []DeliveryEvent
+	}{
+		{
+			"json",
+			JSONCallbackAdapter{},
+			`{"id": "e1", "message_id": "m1", "status": "delivered", "timestamp": "2024-01-01T00:00:00Z"}`,
+			[]DeliveryEvent{{EventID: "e1", MessageID: "m1", State: StateDelivered}},
+		},
+		{
+			"batch",
+			BatchCallbackAdapter{},
+			`[{"event_id": "e1", "ref": "r1", "event": "bounce", "ts": 1700000000, "error": "mailbox full"},
+			  {"event_id": "e2", "ref": "r2", "event": "open", "ts": 1700000000}]`,
+			[]DeliveryEvent{
+				{EventID: "e1", ProviderRef: "r1", State: StateFailed, Reason: "mailbox full"},
+				{EventID: "e2", ProviderRef: "r2", State: StateOpened},
+			},
+		},
+		{
+			"form",
+			FormCallbackAdapter{},
+			`MessageSid=SM1&MessageStatus=undelivered&ErrorCode=30003`,
+			[]DeliveryEvent{{EventID: "SM1/failed", ProviderRef: "SM1", State: StateFailed, Reason: "30003"}},
+		},
+	}
+	for _, tt := range tests {
+		got, err := tt.adapter.Parse(nil, []byte(tt.body))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: got %d events, want %d", tt.name, len(got), len(tt.want))
+		}
+		for i := range got {
+			got[i].At = time.Time{}
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: event %d = %+v, want %+v", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestHMACVerifier(t *testing.T) {
+	v := &HMACVerifier{Header: "X-Signature", Prefix: "sha256=", Secret: []byte("secret")}
+	body := []byte(`{"id": "e1"}`)
+	mac := hmac.New(sha256.New, v.Secret)
+	mac.Write(body)
+	good := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name string
+		sig  string
+		body []byte
+		ok   bool
+	}{
+		{"valid", good, body, true},
+		{"other body", good, []byte(`{"id": "e2"}`), false},
+		{"missing", "", body, false},
+		{"not hex", "sha256=zz", body, false},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		header.Set("X-Signature", tt.sig)
+		err := v.Verify(header, tt.body)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestCallbackReceiverDropsDuplicates(t *testing.T) {
+	store := NewLifecycleStore()
+	store.Track(LifecycleRecord{MessageID: "m1", State: StateSent})
+	c := &CallbackReceiver{Adapter: JSONCallbackAdapter{}, Store: store}
+
+	body := `{"id": "e1", "message_id": "m1", "status": "delivered", "timestamp": "2024-01-01T00:00:00Z"}`
+	for i, want := range []string{`"processed":1`, `"processed":0`} {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, httptest.NewRequest("POST", "/callbacks", strings.NewReader(body)))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("request %d: %d %s, want %s", i, w.Code, w.Body, want)
+		}
+	}
+	rec, _ := store.Get("m1")
+	if len(rec.History) != 2 {
+		t.Errorf("history = %+v", rec.History)
+	}
+}
+
+func TestCallbackReceiverForgetsOldEvents(t *testing.T) {
+	store := NewLifecycleStore()
+	store.Track(LifecycleRecord{MessageID: "m1", State: StateSent})
+	c := &CallbackReceiver{Adapter: JSONCallbackAdapter{}, Store: store, DedupeWindow: time.Millisecond}
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.Process(DeliveryEvent{EventID: "e" + string(rune('0'+i)), MessageID: "m1", State: StateDelivered}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	c.mu.Lock()
+	n := len(c.seen)
+	c.mu.Unlock()
+	if n > 1 {
+		t.Errorf("remembered %d events, want at most 1", n)
+	}
+}
+
+func TestDispatchedMessageFollowsProviderCallback(t *testing.T) {
+	store := NewLifecycleStore()
+	refs := NewProviderRefs()
+	transport := RefTransportFunc(func(ctx context.Context, msg *Message) (string, error) {
+		return "SM" + msg.ID, nil
+	})
+	d := &Dispatcher{Transport: transport, Lifecycle: store, Refs: refs, Channel: "sms"}
+	msg := &Message{Recipient: "+15550100", Format: "TEXT"}
+	if err := d.Dispatch(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := refs.Lookup("SM" + msg.ID); !ok || id != msg.ID {
+		t.Fatalf("ref maps to %q, %v, want %q", id, ok, msg.ID)
+	}
+
+	c := &CallbackReceiver{Adapter: FormCallbackAdapter{}, Refs: refs, Store: store}
+	body := "MessageSid=SM" + msg.ID + "&MessageStatus=delivered"
+	r := httptest.NewRequest("POST", "/callbacks", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"processed":1`) {
+		t.Fatalf("callback: %d %s", w.Code, w.Body)
+	}
+
+	rec, err := store.Get(msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.State != StateDelivered {
+		t.Errorf("state = %s, want %s", rec.State, StateDelivered)
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Campaigns replace scripts calling the Sender in a loop. A campaign combines
+// a recipe (format and text template), an audience query, an optional start
+// time, a throttle and a budget, and moves through
+//
+//	draft -> scheduled -> running <-> paused -> completed
+//
+// while its progress and statistics are tracked.
+
+// CampaignState is where a campaign is in its lifecycle
+type CampaignState string
+
+const (
+	CampaignDraft     CampaignState = "draft"
+	CampaignScheduled CampaignState = "scheduled"
+	CampaignRunning   CampaignState = "running"
+	CampaignPaused    CampaignState = "paused"
+	CampaignCompleted CampaignState = "completed"
+)
+
+var (
+	ErrCampaignNotFound = errors.New("campaign not found")
+	ErrCampaignState    = errors.New("operation not allowed in campaign state")
+	ErrCampaignThrottle = errors.New("invalid campaign throttle")
+)
+
+// Throttles a campaign accepts besides zero, in messages per second: from one
+// message a day to a million a second
+const (
+	MinCampaignThrottle = 1.0 / (24 * 60 * 60)
+	MaxCampaignThrottle = 1e6
+)
+
+// Recipe says how a campaign's messages are built. Text is a text/template
+// executed with the Contact. When the manager has a RecipeStore and the store
+// knows the recipe's name, the versioned recipe is used instead.
+type Recipe struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+	Text   string `json:"text"`
+}
+
+// Contact is somebody a campaign can target
+type Contact struct {
+	ID         string            `json:"id"`
+	Address    string            `json:"address"`
+	Tenant     string            `json:"tenant,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// AudienceResolver turns an audience query into contacts
+type AudienceResolver interface {
+	Resolve(ctx context.Context, query string) ([]Contact, error)
+}
+
+// AudienceFunc adapts a function to AudienceResolver
+type AudienceFunc func(ctx context.Context, query string) ([]Contact, error)
+
+func (f AudienceFunc) Resolve(ctx context.Context, query string) ([]Contact, error) {
+	return f(ctx, query)
+}
+
+// CampaignStats are the per campaign statistics
+type CampaignStats struct {
+	Audience int `json:"audience"`
+	Sent     int `json:"sent"`
+	Failed   int `json:"failed"`
+	// Contacts not messaged because the budget ran out
+	OverBudget  int       `json:"over_budget"`
+	StartedAt   time.Time `json:"started_at,omitempty"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+}
+
+// Progress is the share of the audience processed, between 0 and 1
+func (s CampaignStats) Progress() float64 {
+	if s.Audience == 0 {
+		return 0
+	}
+	return float64(s.Sent+s.Failed+s.OverBudget) / float64(s.Audience)
+}
+
+// Campaign is one campaign
+type Campaign struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Recipe   Recipe    `json:"recipe"`
+	Audience string    `json:"audience"`
+	Schedule time.Time `json:"schedule,omitempty"`
+	// Messages per second, unlimited when zero, else between
+	// MinCampaignThrottle and MaxCampaignThrottle
+	Throttle float64 `json:"throttle,omitempty"`
+	// Maximum number of messages, unlimited when zero
+	Budget int           `json:"budget,omitempty"`
+	State  CampaignState `json:"state"`
+	Stats  CampaignStats `json:"stats"`
+
+	contacts []Contact
+	next     int
+	cancel   context.CancelFunc
+	done     chan struct{}
+	// between two sends, from Throttle
+	interval time.Duration
+}
+
+// CampaignManager runs campaigns
+type CampaignManager struct {
+	Audience   AudienceResolver
+	Factory    *BuilderFactory
+	Dispatcher *Dispatcher
+	// Versioned recipes, optional
+	Recipes *RecipeStore
+	// Clock, time.Now when nil
+	Now func() time.Time
+
+	mu        sync.Mutex
+	campaigns map[string]*Campaign
+}
+
+func (m *CampaignManager) now() time.Time {
+	if m.Now != nil {
+		return m.Now()
+	}
+	return time.Now()
+}
+
+// Create adds a campaign as a draft
+func (m *CampaignManager) Create(c Campaign) (*Campaign, error) {
+	if c.Name == "" {
+		return nil, errors.New("campaign needs a name")
+	}
+	if _, err := template.New(c.Name).Parse(c.Recipe.Text); err != nil {
+		return nil, fmt.Errorf("recipe text: %w", err)
+	}
+	c.interval = 0
+	if c.Throttle != 0 {
+		// also rejects NaN, which fails every comparison
+		if !(c.Throttle >= MinCampaignThrottle && c.Throttle <= MaxCampaignThrottle) {
+			return nil, fmt.Errorf("%w: %v messages per second, want 0 or %v to %v",
+				ErrCampaignThrottle, c.Throttle, MinCampaignThrottle, MaxCampaignThrottle)
+		}
+		c.interval = time.Duration(float64(time.Second) / c.Throttle)
+	}
+	if c.ID == "" {
+		c.ID = NewMessageID()[:12]
+	}
+	c.State = CampaignDraft
+	c.Stats = CampaignStats{}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.campaigns == nil {
+		m.campaigns = make(map[string]*Campaign)
+	}
+	if _, exists := m.campaigns[c.ID]; exists {
+		return nil, fmt.Errorf("campaign %s already exists", c.ID)
+	}
+	m.campaigns[c.ID] = &c
+	return c.snapshot(), nil
+}
+
+// ScheduleAt schedules a draft campaign. It starts on the first Tick at or
+// after the given time.
+func (m *CampaignManager) ScheduleAt(id string, at time.Time) (*Campaign, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if c.State != CampaignDraft && c.State != CampaignScheduled {
+		return nil, fmt.Errorf("%w: schedule %s campaign", ErrCampaignState, c.State)
+	}
+	c.Schedule = at
+	c.State = CampaignScheduled
+	return c.snapshot(), nil
+}
+
+// Start runs a draft or scheduled campaign right away
+func (m *CampaignManager) Start(ctx context.Context, id string) (*Campaign, error) {
+	m.mu.Lock()
+	c, err := m.get(id)
+	if err == nil && c.State != CampaignDraft && c.State != CampaignScheduled {
+		err = fmt.Errorf("%w: start %s campaign", ErrCampaignState, c.State)
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	contacts, err := m.Audience.Resolve(ctx, c.Audience)
+	if err != nil {
+		return nil, fmt.Errorf("resolve audience: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c.State != CampaignDraft && c.State != CampaignScheduled {
+		return nil, fmt.Errorf("%w: start %s campaign", ErrCampaignState, c.State)
+	}
+	c.contacts = contacts
+	c.Stats.Audience = len(contacts)
+	c.Stats.StartedAt = m.now()
+	m.run(c)
+	return c.snapshot(), nil
+}
+
+// Pause stops a running campaign. The message in flight is sent, Pause
+// returns once it is done.
+func (m *CampaignManager) Pause(id string) (*Campaign, error) {
+	m.mu.Lock()
+	c, err := m.get(id)
+	if err == nil && c.State != CampaignRunning {
+		err = fmt.Errorf("%w: pause %s campaign", ErrCampaignState, c.State)
+	}
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	c.State = CampaignPaused
+	c.cancel()
+	done := c.done
+	m.mu.Unlock()
+
+	<-done
+	return m.Get(id)
+}
+
+// Resume continues a paused campaign where it stopped
+func (m *CampaignManager) Resume(id string) (*Campaign, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if c.State != CampaignPaused {
+		return nil, fmt.Errorf("%w: resume %s campaign", ErrCampaignState, c.State)
+	}
+	m.run(c)
+	return c.snapshot(), nil
+}
+
+// Tick starts every scheduled campaign that is due
+func (m *CampaignManager) Tick(ctx context.Context) []error {
+	now := m.now()
+	m.mu.Lock()
+	var due []string
+	for id, c := range m.campaigns {
+		if c.State == CampaignScheduled && !now.Before(c.Schedule) {
+			due = append(due, id)
+		}
+	}
+	m.mu.Unlock()
+
+	var errs []error
+	for _, id := range due {
+		if _, err := m.Start(ctx, id); err != nil {
+			errs = append(errs, fmt.Errorf("campaign %s: %w", id, err))
+		}
+	}
+	return errs
+}
+
+// StartScheduler calls Tick every interval until the context is done
+func (m *CampaignManager) StartScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.Tick(ctx)
+		}
+	}
+}
+
+// Wait blocks until the campaign's current run stopped
+func (m *CampaignManager) Wait(id string) error {
+	m.mu.Lock()
+	c, err := m.get(id)
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	done := c.done
+	m.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+	return nil
+}
+
+// run starts the send loop, m.mu must be held
+func (m *CampaignManager) run(c *Campaign) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	c.State = CampaignRunning
+	go m.loop(ctx, c, c.done)
+}
+
+func (m *CampaignManager) loop(ctx context.Context, c *Campaign, done chan struct{}) {
+	defer close(done)
+
+	tmpl, err := template.New(c.Name).Parse(c.Recipe.Text)
+	if err != nil {
+		// checked on Create, cannot happen
+		panic(err)
+	}
+
+	var tick <-chan time.Time
+	if c.interval > 0 {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		m.mu.Lock()
+		if c.next >= len(c.contacts) {
+			c.State = CampaignCompleted
+			c.Stats.CompletedAt = m.now()
+			m.mu.Unlock()
+			return
+		}
+		contact := c.contacts[c.next]
+		if c.Budget > 0 && c.Stats.Sent+c.Stats.Failed >= c.Budget {
+			c.Stats.OverBudget += len(c.contacts) - c.next
+			c.next = len(c.contacts)
+			m.mu.Unlock()
+			continue
+		}
+		m.mu.Unlock()
+
+		if tick != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// ctx only stops the loop, a pause must not abort a send halfway
+		err := m.send(context.WithoutCancel(ctx), c, tmpl, contact)
+
+		m.mu.Lock()
+		if err != nil {
+			c.Stats.Failed++
+		} else {
+			c.Stats.Sent++
+		}
+		c.next++
+		m.mu.Unlock()
+	}
+}
+
+func (m *CampaignManager) send(ctx context.Context, c *Campaign, tmpl *template.Template, contact Contact) error {
+	format := c.Recipe.Format
+	var version *RecipeVersion
+	if m.Recipes != nil && c.Recipe.Name != "" {
+		v, err := m.Recipes.Select(c.Recipe.Name, contact.Address)
+		if err == nil {
+			version = v
+			format, tmpl = v.Format, v.Template()
+		} else if !errors.Is(err, ErrRecipeNotFound) {
+			return err
+		}
+	}
+
+	err := m.build(ctx, format, tmpl, contact)
+	if version != nil {
+		m.Recipes.RecordResult(version.Name, version.Version, err)
+	}
+	return err
+}
+
+func (m *CampaignManager) build(ctx context.Context, format string, tmpl *template.Template, contact Contact) error {
+	var text strings.Builder
+	if err := tmpl.Execute(&text, contact); err != nil {
+		return err
+	}
+	msg, err := m.Factory.Build(ctx, format, contact.Address, text.String())
+	if err != nil {
+		return err
+	}
+	if msg.ID == "" {
+		msg.ID = NewMessageID()
+	}
+	if m.Dispatcher.Lifecycle != nil {
+		m.Dispatcher.Lifecycle.Track(LifecycleRecord{
+			MessageID: msg.ID,
+			Format:    msg.Format,
+			Channel:   m.Dispatcher.Channel,
+			Tenant:    contact.Tenant,
+			Recipient: msg.Recipient,
+		})
+	}
+	return m.Dispatcher.Dispatch(ctx, msg)
+}
+
+// Get returns a campaign
+func (m *CampaignManager) Get(id string) (*Campaign, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.snapshot(), nil
+}
+
+// List returns all campaigns ordered by name
+func (m *CampaignManager) List() []*Campaign {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]*Campaign, 0, len(m.campaigns))
+	for _, c := range m.campaigns {
+		list = append(list, c.snapshot())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (m *CampaignManager) get(id string) (*Campaign, error) {
+	c, ok := m.campaigns[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrCampaignNotFound, id)
+	}
+	return c, nil
+}
+
+func (c *Campaign) snapshot() *Campaign {
+	return &Campaign{
+		ID:       c.ID,
+		Name:     c.Name,
+		Recipe:   c.Recipe,
+		Audience: c.Audience,
+		Schedule: c.Schedule,
+		Throttle: c.Throttle,
+		Budget:   c.Budget,
+		State:    c.State,
+		Stats:    c.Stats,
+	}
+}
+
+// Handler exposes the campaigns over HTTP:
+//
+//	GET  /campaigns
+//	POST /campaigns                  create from a JSON Campaign
+//	GET  /campaigns/{id}
+//	POST /campaigns/{id}/schedule    body {"at": "RFC3339"}
+//	POST /campaigns/{id}/start
+//	POST /campaigns/{id}/pause
+//	POST /campaigns/{id}/resume
+func (m *CampaignManager) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /campaigns", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, m.List())
+	})
+	mux.HandleFunc("POST /campaigns", func(w http.ResponseWriter, r *http.Request) {
+		var c Campaign
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		created, err := m.Create(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, created)
+	})
+	mux.HandleFunc("GET /campaigns/{id}", func(w http.ResponseWriter, r *http.Request) {
+		c, err := m.Get(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, c)
+	})
+	mux.HandleFunc("POST /campaigns/{id}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		var c *Campaign
+		var err error
+		switch r.PathValue("action") {
+		case "schedule":
+			var body struct {
+				At time.Time `json:"at"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			c, err = m.ScheduleAt(id, body.At)
+		case "start":
+			c, err = m.Start(r.Context(), id)
+		case "pause":
+			c, err = m.Pause(id)
+		case "resume":
+			c, err = m.Resume(id)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case errors.Is(err, ErrCampaignNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrCampaignState):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			writeJSON(w, http.StatusOK, c)
+		}
+	})
+	return mux
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+)
+
+func newTestCampaignManager(transport Transport, contacts ...Contact) *CampaignManager {
+	return &CampaignManager{
+		Audience: AudienceFunc(func(ctx context.Context, query string) ([]Contact, error) {
+			return contacts, nil
+		}),
+		Factory:    NewBuilderFactory(2),
+		Dispatcher: &Dispatcher{Transport: transport, Lifecycle: NewLifecycleStore()},
+	}
+}
+
+func TestCampaignCreateValidatesThrottle(t *testing.T) {
+	m := newTestCampaignManager(&recordingTransport{})
+	tests := []struct {
+		throttle float64
+		ok       bool
+	}{
+		{0, true},
+		{0.5, true},
+		{MinCampaignThrottle, true},
+		{MaxCampaignThrottle, true},
+		{-1, false},
+		// the send interval would overflow
+		{1e-10, false},
+		{2e9, false},
+		{math.NaN(), false},
+		{math.Inf(1), false},
+	}
+	for _, tt := range tests {
+		_, err := m.Create(Campaign{Name: "c", Recipe: Recipe{Format: "JSON", Text: "hi"}, Throttle: tt.throttle})
+		if tt.ok && err != nil {
+			t.Errorf("throttle %v: %v", tt.throttle, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrCampaignThrottle) {
+			t.Errorf("throttle %v: err = %v, want %v", tt.throttle, err, ErrCampaignThrottle)
+		}
+	}
+}
+
+func TestCampaignPauseFinishesInFlightSend(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	sent := 0
+	transport := TransportFunc(func(ctx context.Context, msg *Message) error {
+		if sent == 0 {
+			close(started)
+			<-release
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		sent++
+		return nil
+	})
+	m := newTestCampaignManager(transport,
+		Contact{ID: "1", Address: "a@example.com"},
+		Contact{ID: "2", Address: "b@example.com"},
+	)
+	c, err := m.Create(Campaign{Name: "c", Recipe: Recipe{Format: "JSON", Text: "hi {{.ID}}"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Start(context.Background(), c.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	<-started
+	paused := make(chan *Campaign)
+	go func() {
+		c, err := m.Pause(c.ID)
+		if err != nil {
+			t.Error(err)
+		}
+		paused <- c
+	}()
+	// let Pause cancel the loop before the send returns
+	for {
+		if got, _ := m.Get(c.ID); got.State == CampaignPaused {
+			break
+		}
+	}
+	close(release)
+
+	got := <-paused
+	if got.Stats.Sent != 1 || got.Stats.Failed != 0 {
+		t.Fatalf("after pause: stats = %+v, want the in-flight message sent", got.Stats)
+	}
+
+	if _, err := m.Resume(c.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Wait(c.ID); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = m.Get(c.ID)
+	if got.State != CampaignCompleted || got.Stats.Sent != 2 {
+		t.Errorf("state %s, stats %+v", got.State, got.Stats)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Command line sub commands, e.g. "builder report -history history.json"
+var commands = map[string]func(args []string, stdout io.Writer) error{
+	"report":   reportCommand,
+	"batch":    batchCommand,
+	"campaign": campaignCommand,
+	"recipe":   recipeCommand,
+	"segment":  segmentCommand,
+	"serve":    serveCommand,
+}
+
+func runCommand(args []string, stdout io.Writer) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q, available: %v", args[0], names)
+	}
+	return cmd(args[1:], stdout)
+}
+
+func reportCommand(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	history := fs.String("history", "", "JSON file with the message history, as written by LifecycleStore.Save")
+	format := fs.String("format", "json", "output format: json, csv or html")
+	from := fs.String("from", "", "first day to include, YYYY-MM-DD (default: 7 days ago)")
+	to := fs.String("to", "", "day after the last day to include, YYYY-MM-DD (default: tomorrow)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *history == "" {
+		return errors.New("report: -history is required")
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	fromTime, err := parseDay(*from, today.AddDate(0, 0, -7))
+	if err != nil {
+		return err
+	}
+	toTime, err := parseDay(*to, today.AddDate(0, 0, 1))
+	if err != nil {
+		return err
+	}
+
+	store, err := LoadLifecycleStore(*history)
+	if err != nil {
+		return err
+	}
+
+	report := BuildReport(store.Records(), fromTime, toTime)
+	switch *format {
+	case "json":
+		return report.WriteJSON(stdout)
+	case "csv":
+		return report.WriteCSV(stdout)
+	case "html":
+		return report.WriteHTML(stdout)
+	}
+	return fmt.Errorf("report: unknown format %q", *format)
+}
+
+func parseDay(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// serve -listen ADDR [-history FILE] [-contacts FILE] [-segments FILE] [-smtp HOST:PORT -from ADDRESS]
+//
+// Serves the API the batch, campaign, recipe and segment commands talk to.
+// Without -smtp, campaign messages are written to stdout instead of sent.
+func serveCommand(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	listen := fs.String("listen", "localhost:8080", "address to listen on")
+	history := fs.String("history", "", "JSON file with the message history, loaded at start and saved on exit")
+	contactsFile := fs.String("contacts", "", "JSON file with an array of contacts")
+	segmentsFile := fs.String("segments", "", "JSON file mapping segment names to queries")
+	smtpAddr := fs.String("smtp", "", "SMTP server used to send campaigns, host:port")
+	from := fs.String("from", "", "envelope sender for SMTP")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	lifecycle := NewLifecycleStore()
+	if *history != "" {
+		store, err := LoadLifecycleStore(*history)
+		switch {
+		case err == nil:
+			lifecycle = store
+		case !errors.Is(err, os.ErrNotExist):
+			return err
+		}
+	}
+
+	contacts := NewContactStore(LifecycleHistory{Store: lifecycle})
+	if *contactsFile != "" {
+		var list []Contact
+		if err := readJSONFile(*contactsFile, &list); err != nil {
+			return err
+		}
+		for _, c := range list {
+			contacts.Put(c)
+		}
+	}
+	if *segmentsFile != "" {
+		var segments map[string]string
+		if err := readJSONFile(*segmentsFile, &segments); err != nil {
+			return err
+		}
+		for name, query := range segments {
+			if _, err := contacts.SaveSegment(name, query); err != nil {
+				return err
+			}
+		}
+	}
+
+	var transport Transport
+	if *smtpAddr != "" {
+		if *from == "" {
+			return errors.New("serve: -from is required with -smtp")
+		}
+		transport = NewSMTPTransport(*smtpAddr, *from, nil, 4, time.Minute)
+	} else {
+		var mu sync.Mutex
+		transport = TransportFunc(func(ctx context.Context, msg *Message) error {
+			mu.Lock()
+			defer mu.Unlock()
+			_, err := fmt.Fprintf(stdout, "--- %s to %s (%s)\n%s\n", msg.ID, msg.Recipient, msg.Format, msg.Body)
+			return err
+		})
+	}
+
+	recipes := NewRecipeStore()
+	campaigns := &CampaignManager{
+		Audience:   contacts,
+		Factory:    NewBuilderFactory(4),
+		Dispatcher: &Dispatcher{Transport: transport, Lifecycle: lifecycle, Channel: "smtp"},
+		Recipes:    recipes,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go campaigns.StartScheduler(ctx, 10*time.Second)
+
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           apiHandler(NewBatchRuns(), campaigns, recipes, contacts),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	fmt.Fprintf(stdout, "serving on %s\n", *listen)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	if *history != "" {
+		err = errors.Join(err, lifecycle.Save(*history))
+	}
+	return err
+}
+
+// apiHandler mounts the HTTP APIs of the stores under one handler
+func apiHandler(runs *BatchRuns, campaigns *CampaignManager, recipes *RecipeStore, contacts *ContactStore) http.Handler {
+	mux := http.NewServeMux()
+	for prefix, h := range map[string]http.Handler{
+		"/runs":      runs.Handler(),
+		"/campaigns": campaigns.Handler(),
+		"/recipes":   recipes.Handler(),
+		"/segments":  contacts.Handler(),
+	} {
+		mux.Handle(prefix, h)
+		mux.Handle(prefix+"/", h)
+	}
+	return mux
+}
+
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// batch status -checkpoint FILE
+// batch pause|resume|cancel -addr URL -run ID
+func batchCommand(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("batch: expected status, pause, resume or cancel")
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("batch "+action, flag.ContinueOnError)
+	checkpoint := fs.String("checkpoint", "", "checkpoint file of the run (status only)")
+	addr := fs.String("addr", "http://localhost:8080", "base URL of the batch run API")
+	run := fs.String("run", "", "ID of the run")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if action == "status" && *checkpoint != "" {
+		cp, err := LoadCheckpoint(*checkpoint)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "run %s: %s, %d/%d completed, %d failed\n",
+			cp.RunID, cp.Status, len(cp.Completed), cp.Total, len(cp.Failed))
+		return nil
+	}
+	if *run == "" {
+		return errors.New("batch: -run is required")
+	}
+
+	method, path := http.MethodPost, "/runs/"+url.PathEscape(*run)+"/"+action
+	switch action {
+	case "status":
+		method, path = http.MethodGet, "/runs/"+url.PathEscape(*run)
+	case "pause", "resume", "cancel":
+	default:
+		return fmt.Errorf("batch: unknown action %q", action)
+	}
+	data, err := callAPI("batch "+action, method, *addr+path, nil)
+	if err != nil {
+		return err
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "run %s: %s, %d/%d completed, %d failed\n",
+		cp.RunID, cp.Status, len(cp.Completed), cp.Total, len(cp.Failed))
+	return nil
+}
+
+// campaign list|show|start|pause|resume -addr URL [-id ID]
+// campaign create -addr URL -file campaign.json
+// campaign schedule -addr URL -id ID -at RFC3339
+func campaignCommand(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("campaign: expected list, show, create, schedule, start, pause or resume")
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("campaign "+action, flag.ContinueOnError)
+	addr := fs.String("addr", "http://localhost:8080", "base URL of the campaign API")
+	id := fs.String("id", "", "ID of the campaign")
+	file := fs.String("file", "", "JSON file describing the campaign (create only)")
+	at := fs.String("at", "", "start time in RFC3339 (schedule only)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	var method, path string
+	var body io.Reader
+	switch action {
+	case "list":
+		method, path = http.MethodGet, "/campaigns"
+	case "create":
+		if *file == "" {
+			return errors.New("campaign create: -file is required")
+		}
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		method, path, body = http.MethodPost, "/campaigns", f
+	case "show", "schedule", "start", "pause", "resume":
+		if *id == "" {
+			return fmt.Errorf("campaign %s: -id is required", action)
+		}
+		if action == "show" {
+			method, path = http.MethodGet, "/campaigns/"+url.PathEscape(*id)
+			break
+		}
+		method, path = http.MethodPost, "/campaigns/"+url.PathEscape(*id)+"/"+action
+		if action == "schedule" {
+			t, err := time.Parse(time.RFC3339, *at)
+			if err != nil {
+				return fmt.Errorf("campaign schedule: -at: %w", err)
+			}
+			b, _ := json.Marshal(map[string]time.Time{"at": t})
+			body = bytes.NewReader(b)
+		}
+	default:
+		return fmt.Errorf("campaign: unknown action %q", action)
+	}
+	return printAPI(stdout, "campaign "+action, method, *addr+path, body)
+}
+
+// recipe show|rollback|promote -addr URL -name NAME [-reason TEXT]
+func recipeCommand(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("recipe: expected show, rollback or promote")
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("recipe "+action, flag.ContinueOnError)
+	addr := fs.String("addr", "http://localhost:8080", "base URL of the recipe API")
+	name := fs.String("name", "", "name of the recipe")
+	reason := fs.String("reason", "", "why the recipe is rolled back (rollback only)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *name == "" {
+		return fmt.Errorf("recipe %s: -name is required", action)
+	}
+
+	base := *addr + "/recipes/" + url.PathEscape(*name)
+	var path string
+	switch action {
+	case "show":
+		return printAPI(stdout, "recipe show", http.MethodGet, base, nil)
+	case "rollback":
+		path = base + "/rollback?reason=" + url.QueryEscape(*reason)
+	case "promote":
+		path = base + "/promote"
+	default:
+		return fmt.Errorf("recipe: unknown action %q", action)
+	}
+	return printAPI(stdout, "recipe "+action, http.MethodPost, path, nil)
+}
+
+// segment list -addr URL
+// segment count -addr URL -query QUERY
+func segmentCommand(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("segment: expected list or count")
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("segment "+action, flag.ContinueOnError)
+	addr := fs.String("addr", "http://localhost:8080", "base URL of the segment API")
+	query := fs.String("query", "", `segment query or "segment:NAME" (count only)`)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	var path string
+	switch action {
+	case "list":
+		path = "/segments"
+	case "count":
+		if *query == "" {
+			return errors.New("segment count: -query is required")
+		}
+		path = "/segments/count?query=" + url.QueryEscape(*query)
+	default:
+		return fmt.Errorf("segment: unknown action %q", action)
+	}
+	return printAPI(stdout, "segment "+action, http.MethodGet, *addr+path, nil)
+}
+
+// callAPI sends a request to the API started by "serve" and returns the
+// response body, or an error named after the command for non 2xx answers
+func callAPI(command, method, url string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s: %s: %s", command, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// printAPI is callAPI writing the response body to stdout
+func printAPI(stdout io.Writer, command, method, url string, body io.Reader) error {
+	data, err := callAPI(command, method, url, body)
+	if err != nil {
+		return err
+	}
+	_, err = stdout.Write(data)
+	return err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCommandsAgainstAPIHandler(t *testing.T) {
+	recipes := NewRecipeStore()
+	if _, err := recipes.Publish("welcome", "JSON", "Hello {{.Address}}"); err != nil {
+		t.Fatal(err)
+	}
+	contacts := newTestContactStore(nil)
+	if _, err := contacts.SaveSegment("everyone", "tenant = x"); err != nil {
+		t.Fatal(err)
+	}
+	campaigns := newTestCampaignManager(&recordingTransport{})
+	if _, err := campaigns.Create(Campaign{Name: "advent", Recipe: Recipe{Format: "JSON", Text: "hi"}}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(apiHandler(NewBatchRuns(), campaigns, recipes, contacts))
+	defer srv.Close()
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"campaign", "list"}, `"advent"`},
+		{[]string{"recipe", "show", "-name", "welcome"}, `"welcome"`},
+		{[]string{"segment", "list"}, `"everyone"`},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := runCommand(append(tt.args, "-addr", srv.URL), &out); err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+		if !strings.Contains(out.String(), tt.want) {
+			t.Errorf("%v: output %q does not contain %s", tt.args, out.String(), tt.want)
+		}
+	}
+
+	err := runCommand([]string{"batch", "status", "-addr", srv.URL, "-run", "missing"}, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("unknown run: err = %v, want a 404", err)
+	}
+}
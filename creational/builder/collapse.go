@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CollapsePolicy decides what happens when a message is queued while another
+// one with the same collapse key and recipient is still pending
+type CollapsePolicy string
+
+const (
+	// The newer message takes the place of the pending one
+	CollapseReplace CollapsePolicy = "replace"
+	// The pending message wins and the newer one is dropped
+	CollapseDropNewer CollapsePolicy = "drop-newer"
+	// Both messages are sent
+	CollapseKeepBoth CollapsePolicy = "keep-both"
+)
+
+var ErrUnknownCollapsePolicy = errors.New("unknown collapse policy")
+
+// FlushFailure is a message Flush could not dispatch
+type FlushFailure struct {
+	Message *Message
+	Err     error
+}
+
+// FlushError lists the messages a Flush could not dispatch. They are off the
+// queue, the caller decides whether to Enqueue them again.
+type FlushError struct {
+	Failures []FlushFailure
+}
+
+func (e *FlushError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "flush: %d message(s) failed", len(e.Failures))
+	for _, f := range e.Failures {
+		fmt.Fprintf(&b, "\n  %s (%s): %v", f.Message.ID, f.Message.Recipient, f.Err)
+	}
+	return b.String()
+}
+
+func (e *FlushError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f.Err
+	}
+	return errs
+}
+
+// SupersededMessage is the audit record of a message that was not sent
+// because of another one
+type SupersededMessage struct {
+	MessageID    string         `json:"message_id"`
+	SupersededBy string         `json:"superseded_by"`
+	CollapseKey  string         `json:"collapse_key"`
+	Recipient    string         `json:"recipient"`
+	Policy       CollapsePolicy `json:"policy"`
+	At           time.Time      `json:"at"`
+}
+
+// Enqueue queues the message for the next Flush. Pending messages with the
+// same collapse key and recipient are collapsed according to the policy, the
+// returned record tells which message lost, if any.
+func (d *Dispatcher) Enqueue(msg *Message) (*SupersededMessage, error) {
+	if msg.ID == "" {
+		msg.ID = NewMessageID()
+	}
+	policy := d.Collapse
+	if policy == "" {
+		policy = CollapseReplace
+	}
+	switch policy {
+	case CollapseReplace, CollapseDropNewer, CollapseKeepBoth:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCollapsePolicy, policy)
+	}
+
+	// tracked from here, so a superseded message has a record to move
+	if d.Lifecycle != nil {
+		d.Lifecycle.TrackIfNew(LifecycleRecord{
+			MessageID: msg.ID,
+			Format:    msg.Format,
+			Channel:   d.Channel,
+			Recipient: msg.Recipient,
+		})
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if msg.CollapseKey == "" || policy == CollapseKeepBoth {
+		d.queue = append(d.queue, msg)
+		return nil, nil
+	}
+	for i, pending := range d.queue {
+		if pending.CollapseKey != msg.CollapseKey || pending.Recipient != msg.Recipient {
+			continue
+		}
+		rec := SupersededMessage{
+			CollapseKey: msg.CollapseKey,
+			Recipient:   msg.Recipient,
+			Policy:      policy,
+			At:          time.Now(),
+		}
+		if policy == CollapseReplace {
+			// the replacement keeps the place in the queue
+			d.queue[i] = msg
+			rec.MessageID, rec.SupersededBy = pending.ID, msg.ID
+		} else {
+			rec.MessageID, rec.SupersededBy = msg.ID, pending.ID
+		}
+		d.superseded = append(d.superseded, rec)
+		if d.Lifecycle != nil {
+			d.Lifecycle.Transition(rec.MessageID, StateSuperseded, rec.At, "superseded by "+rec.SupersededBy)
+		}
+		return &rec, nil
+	}
+	d.queue = append(d.queue, msg)
+	return nil, nil
+}
+
+// Pending returns the queued messages in send order
+func (d *Dispatcher) Pending() []*Message {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*Message(nil), d.queue...)
+}
+
+// Superseded returns the audit trail of collapsed messages
+func (d *Dispatcher) Superseded() []SupersededMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]SupersededMessage(nil), d.superseded...)
+}
+
+// Flush dispatches the queued messages. A message is taken off the queue
+// right before it is sent, from then on it can no longer be superseded. The
+// messages that failed are returned in a *FlushError.
+func (d *Dispatcher) Flush(ctx context.Context) error {
+	var failures []FlushFailure
+	for ctx.Err() == nil {
+		d.mu.Lock()
+		if len(d.queue) == 0 {
+			d.mu.Unlock()
+			break
+		}
+		msg := d.queue[0]
+		d.queue[0] = nil
+		d.queue = d.queue[1:]
+		d.mu.Unlock()
+
+		if err := d.Dispatch(ctx, msg); err != nil {
+			failures = append(failures, FlushFailure{Message: msg, Err: err})
+		}
+	}
+	if len(failures) > 0 {
+		return &FlushError{Failures: failures}
+	}
+	return nil
+}
+
+// StartFlushing flushes the queue every interval until the context is done,
+// giving newer messages that long to supersede pending ones. Errors are
+// handed to onError, which may be nil; a *FlushError carries the messages
+// that were not sent. The interval is a second when zero or negative.
+func (d *Dispatcher) StartFlushing(ctx context.Context, interval time.Duration, onError func(error)) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.Flush(ctx); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDispatcherCollapse(t *testing.T) {
+	tests := []struct {
+		policy         CollapsePolicy
+		wantSent       []string
+		wantSuperseded string
+	}{
+		{CollapseReplace, []string{"new"}, "old"},
+		{CollapseDropNewer, []string{"old"}, "new"},
+		{CollapseKeepBoth, []string{"old", "new"}, ""},
+	}
+	for _, tt := range tests {
+		store := NewLifecycleStore()
+		transport := &recordingTransport{}
+		d := &Dispatcher{Transport: transport, Lifecycle: store, Collapse: tt.policy}
+		for _, id := range []string{"old", "new"} {
+			if _, err := d.Enqueue(&Message{ID: id, Recipient: "kid@example.com", CollapseKey: "score"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		var sent []string
+		for _, msg := range transport.sent {
+			sent = append(sent, msg.ID)
+		}
+		if len(sent) != len(tt.wantSent) {
+			t.Errorf("%s: sent %v, want %v", tt.policy, sent, tt.wantSent)
+		}
+		for i := range sent {
+			if i < len(tt.wantSent) && sent[i] != tt.wantSent[i] {
+				t.Errorf("%s: sent %v, want %v", tt.policy, sent, tt.wantSent)
+				break
+			}
+		}
+		if tt.wantSuperseded == "" {
+			continue
+		}
+		rec, err := store.Get(tt.wantSuperseded)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.policy, err)
+		}
+		if rec.State != StateSuperseded {
+			t.Errorf("%s: %s is %s, want %s", tt.policy, tt.wantSuperseded, rec.State, StateSuperseded)
+		}
+	}
+}
+
+func TestDispatcherFlushReturnsFailedMessages(t *testing.T) {
+	down := errors.New("down")
+	transport := &recordingTransport{fail: func(msg *Message) error {
+		if msg.ID == "b" {
+			return PermanentError(down)
+		}
+		return nil
+	}}
+	d := &Dispatcher{Transport: transport, Retrier: &Retrier{Policy: ConstantPolicy{Delay: time.Millisecond, MaxAttempts: 1}}}
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := d.Enqueue(&Message{ID: id, Recipient: id + "@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := d.Flush(context.Background())
+	var flushErr *FlushError
+	if !errors.As(err, &flushErr) {
+		t.Fatalf("err = %v, want a *FlushError", err)
+	}
+	if !errors.Is(err, down) {
+		t.Errorf("err = %v, want it to wrap %v", err, down)
+	}
+	if len(flushErr.Failures) != 1 || flushErr.Failures[0].Message.ID != "b" {
+		t.Fatalf("failures = %+v, want b", flushErr.Failures)
+	}
+	if transport.count() != 2 {
+		t.Errorf("sent %d messages, want 2", transport.count())
+	}
+
+	// the caller can queue the failed message again
+	transport.fail = nil
+	for _, f := range flushErr.Failures {
+		if _, err := d.Enqueue(f.Message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if transport.count() != 3 {
+		t.Errorf("sent %d messages, want 3", transport.count())
+	}
+}
+
+func TestStartFlushingDefaultInterval(t *testing.T) {
+	transport := &recordingTransport{}
+	d := &Dispatcher{Transport: transport}
+	if _, err := d.Enqueue(&Message{ID: "a", Recipient: "a@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.StartFlushing(ctx, 0, nil)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for transport.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if transport.count() != 1 {
+		t.Errorf("sent %d messages, want 1", transport.count())
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conversations link the messages we send and receive into threads, across
+// channels. A message joins the thread of the message it replies to or
+// references; otherwise it starts a new thread. Received messages only join
+// threads through replies to messages we sent to the same participant, so
+// nobody can write themselves into someone else's conversation.
+
+// Direction of a message in a conversation
+type Direction string
+
+const (
+	Outbound Direction = "outbound"
+	Inbound  Direction = "inbound"
+)
+
+// ConversationEntry is one message within a conversation
+type ConversationEntry struct {
+	MessageID  string    `json:"message_id"`
+	ThreadID   string    `json:"thread_id"`
+	InReplyTo  string    `json:"in_reply_to,omitempty"`
+	References []string  `json:"references,omitempty"`
+	Direction  Direction `json:"direction"`
+	// The other party: recipient of outbound, sender of inbound messages
+	Participant string    `json:"participant"`
+	Channel     string    `json:"channel,omitempty"`
+	Format      string    `json:"format,omitempty"`
+	Text        string    `json:"text,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// Conversation is a thread of entries ordered by time
+type Conversation struct {
+	ThreadID     string              `json:"thread_id"`
+	Participant  string              `json:"participant"`
+	Entries      []ConversationEntry `json:"entries"`
+	LastActivity time.Time           `json:"last_activity"`
+}
+
+// ConversationStore keeps conversations in memory
+type ConversationStore struct {
+	// Maps an address (mail address, phone number, ...) to the participant it
+	// belongs to, so a person's mails and texts end up together. Addresses are
+	// used as they are when nil.
+	Participant func(address string) string
+	// Domains of the Message-IDs our mails go out with, the domain of the
+	// sender address. They are stripped so replies match the IDs we recorded;
+	// IDs from other domains are kept whole.
+	Domains []string
+
+	mu        sync.RWMutex
+	threads   map[string][]ConversationEntry
+	messages  map[string]string // message ID -> thread ID
+	sent      map[string]bool   // IDs of outbound messages
+	byPerson  map[string]map[string]bool
+	threadFor map[string]string // thread ID -> participant
+}
+
+func NewConversationStore() *ConversationStore {
+	return &ConversationStore{
+		threads:   make(map[string][]ConversationEntry),
+		messages:  make(map[string]string),
+		sent:      make(map[string]bool),
+		byPerson:  make(map[string]map[string]bool),
+		threadFor: make(map[string]string),
+	}
+}
+
+// Add records an entry and returns the thread it joined. Recording a message
+// ID again returns its thread without adding a second entry, entries without
+// a message ID get a new one.
+func (s *ConversationStore) Add(e ConversationEntry) string {
+	e.MessageID = s.normalizeMessageID(e.MessageID)
+	e.InReplyTo = s.normalizeMessageID(e.InReplyTo)
+	refs := make([]string, 0, len(e.References))
+	for _, ref := range e.References {
+		if ref = s.normalizeMessageID(ref); ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+	e.References = refs
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+	participant := strings.ToLower(e.Participant)
+	if s.Participant != nil {
+		participant = s.Participant(e.Participant)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e.Direction == Inbound && s.sent[e.MessageID] {
+		// claims the ID of a message we sent
+		e.MessageID = ""
+	}
+	if e.MessageID == "" {
+		e.MessageID = NewMessageID()
+	}
+	if thread, ok := s.messages[e.MessageID]; ok {
+		// redelivered mail or a retried send
+		return thread
+	}
+	if e.ThreadID == "" {
+		e.ThreadID = s.findThread(e, participant)
+	}
+	if e.ThreadID == "" {
+		e.ThreadID = e.MessageID
+	}
+
+	s.threads[e.ThreadID] = append(s.threads[e.ThreadID], e)
+	s.messages[e.MessageID] = e.ThreadID
+	if e.Direction == Outbound {
+		s.sent[e.MessageID] = true
+	}
+	if _, ok := s.threadFor[e.ThreadID]; !ok {
+		s.threadFor[e.ThreadID] = participant
+	}
+	if s.byPerson[participant] == nil {
+		s.byPerson[participant] = make(map[string]bool)
+	}
+	s.byPerson[participant][e.ThreadID] = true
+	return e.ThreadID
+}
+
+// normalizeMessageID reduces a mail Message-ID such as "<id@example.com>" in
+// one of our Domains to the ID we gave the message, so outbound IDs and the
+// headers of replies to them match
+func (s *ConversationStore) normalizeMessageID(id string) string {
+	id = strings.Trim(id, "<> ")
+	local, domain, ok := strings.Cut(id, "@")
+	if !ok {
+		return id
+	}
+	for _, d := range s.Domains {
+		if strings.EqualFold(domain, d) {
+			return local
+		}
+	}
+	return id
+}
+
+func (s *ConversationStore) findThread(e ConversationEntry, participant string) string {
+	// most recent reference first
+	candidates := []string{e.InReplyTo}
+	for i := len(e.References) - 1; i >= 0; i-- {
+		candidates = append(candidates, e.References[i])
+	}
+	for _, id := range candidates {
+		thread, ok := s.messages[id]
+		if !ok {
+			continue
+		}
+		if e.Direction == Inbound && (!s.sent[id] || s.threadFor[thread] != participant) {
+			continue
+		}
+		return thread
+	}
+	return ""
+}
+
+// RecordOutbound adds a message we sent. threadID and inReplyTo may be empty.
+func (s *ConversationStore) RecordOutbound(msg *Message, channel, text, threadID, inReplyTo string) string {
+	return s.Add(ConversationEntry{
+		MessageID:   msg.ID,
+		ThreadID:    threadID,
+		InReplyTo:   inReplyTo,
+		Direction:   Outbound,
+		Participant: msg.Recipient,
+		Channel:     channel,
+		Format:      msg.Format,
+		Text:        text,
+	})
+}
+
+// RecordInbound adds a received message, threaded by its mail threading
+// headers when present
+func (s *ConversationStore) RecordInbound(msg *InboundMessage) string {
+	messageID := msg.Headers.Get("Message-Id")
+	if strings.Trim(messageID, "<> ") == "" {
+		messageID = msg.ID
+	}
+	return s.Add(ConversationEntry{
+		MessageID:   messageID,
+		InReplyTo:   msg.Headers.Get("In-Reply-To"),
+		References:  parseReferences(msg.Headers.Get("References")),
+		Direction:   Inbound,
+		Participant: msg.Sender,
+		Channel:     msg.Channel,
+		Format:      msg.Format,
+		Text:        msg.Text,
+		Timestamp:   msg.ReceivedAt,
+	})
+}
+
+func parseReferences(header string) []string {
+	var refs []string
+	for _, f := range strings.Fields(header) {
+		if ref := strings.Trim(f, "<>,"); ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// Thread returns the conversation with the given ID
+func (s *ConversationStore) Thread(threadID string) (*Conversation, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.conversation(threadID)
+}
+
+func (s *ConversationStore) conversation(threadID string) (*Conversation, bool) {
+	entries, ok := s.threads[threadID]
+	if !ok {
+		return nil, false
+	}
+	c := &Conversation{
+		ThreadID:    threadID,
+		Participant: s.threadFor[threadID],
+		Entries:     append([]ConversationEntry(nil), entries...),
+	}
+	sort.SliceStable(c.Entries, func(i, j int) bool {
+		return c.Entries[i].Timestamp.Before(c.Entries[j].Timestamp)
+	})
+	c.LastActivity = c.Entries[len(c.Entries)-1].Timestamp
+	return c, true
+}
+
+// Conversations lists a participant's conversations, most recent first
+func (s *ConversationStore) Conversations(address string) []*Conversation {
+	participant := strings.ToLower(address)
+	if s.Participant != nil {
+		participant = s.Participant(address)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []*Conversation
+	for threadID := range s.byPerson[participant] {
+		if c, ok := s.conversation(threadID); ok {
+			list = append(list, c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastActivity.After(list[j].LastActivity)
+	})
+	return list
+}
+
+// Handler serves the conversations as JSON:
+//
+//	GET /conversations?participant=ADDRESS
+//	GET /conversations/{thread}
+func (s *ConversationStore) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /conversations", func(w http.ResponseWriter, r *http.Request) {
+		participant := r.URL.Query().Get("participant")
+		if participant == "" {
+			http.Error(w, "participant is required", http.StatusBadRequest)
+			return
+		}
+		list := s.Conversations(participant)
+		if list == nil {
+			list = []*Conversation{}
+		}
+		writeJSON(w, http.StatusOK, list)
+	})
+	mux.HandleFunc("GET /conversations/{thread}", func(w http.ResponseWriter, r *http.Request) {
+		c, ok := s.Thread(r.PathValue("thread"))
+		if !ok {
+			http.Error(w, "conversation not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, c)
+	})
+	return mux
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestNormalizeMessageID(t *testing.T) {
+	s := &ConversationStore{Domains: []string{"example.com"}}
+	tests := []struct {
+		in, want string
+	}{
+		{"abc", "abc"},
+		{"<abc>", "abc"},
+		{"<abc@EXAMPLE.com>", "abc"},
+		{" abc@example.com ", "abc"},
+		{"<abc@mail.example.com>", "abc@mail.example.com"},
+		{"<abc@other.example>", "abc@other.example"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := s.normalizeMessageID(tt.in); got != tt.want {
+			t.Errorf("normalizeMessageID(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestConversationThreadsMailReplies(t *testing.T) {
+	s := NewConversationStore()
+	s.Domains = []string{"example.com"}
+	sent := &Message{ID: "m1", Recipient: "Santa@example.com", Format: "EMAIL"}
+	thread := s.RecordOutbound(sent, "smtp", "hello", "", "")
+
+	tests := []struct {
+		name    string
+		headers textproto.MIMEHeader
+	}{
+		// the mail went out as Message-ID: <m1@example.com>
+		{"in reply to", textproto.MIMEHeader{"Message-Id": {"<r1@other.example>"}, "In-Reply-To": {"<m1@example.com>"}}},
+		{"references", textproto.MIMEHeader{"Message-Id": {"<r2@other.example>"}, "References": {"<x@a.example> <m1@example.com>"}}},
+	}
+	for _, tt := range tests {
+		got := s.RecordInbound(&InboundMessage{
+			Message:    &Message{ID: "local"},
+			Sender:     "santa@example.com",
+			Channel:    "smtp",
+			Headers:    tt.headers,
+			ReceivedAt: time.Now(),
+		})
+		if got != thread {
+			t.Errorf("%s: thread = %q, want %q", tt.name, got, thread)
+		}
+	}
+}
+
+func TestConversationIgnoresDuplicates(t *testing.T) {
+	s := NewConversationStore()
+	in := &InboundMessage{
+		Message: &Message{ID: "local"},
+		Sender:  "santa@example.com",
+		Headers: textproto.MIMEHeader{"Message-Id": {"<dup@example.com>"}},
+	}
+	first := s.RecordInbound(in)
+	if again := s.RecordInbound(in); again != first {
+		t.Errorf("thread = %q, want %q", again, first)
+	}
+	c, ok := s.Thread(first)
+	if !ok {
+		t.Fatal("thread not found")
+	}
+	if len(c.Entries) != 1 {
+		t.Errorf("thread has %d entries, want 1", len(c.Entries))
+	}
+	if list := s.Conversations("SANTA@example.com"); len(list) != 1 {
+		t.Errorf("participant has %d conversations, want 1", len(list))
+	}
+}
+
+func TestConversationRejectsForeignThreads(t *testing.T) {
+	s := NewConversationStore()
+	s.Domains = []string{"example.com"}
+	sent := &Message{ID: "m1", Recipient: "santa@example.com", Format: "EMAIL"}
+	thread := s.RecordOutbound(sent, "smtp", "hello", "", "")
+	// a mail from santa, then one referencing it
+	theirs := s.RecordInbound(&InboundMessage{
+		Message: &Message{ID: "local1"},
+		Sender:  "santa@example.com",
+		Headers: textproto.MIMEHeader{"Message-Id": {"<s1@north.example>"}, "In-Reply-To": {"<m1@example.com>"}},
+	})
+	if theirs != thread {
+		t.Fatalf("reply thread = %q, want %q", theirs, thread)
+	}
+
+	tests := []struct {
+		name    string
+		sender  string
+		headers textproto.MIMEHeader
+	}{
+		{"thread header", "santa@example.com", textproto.MIMEHeader{"X-Thread-Id": {thread}}},
+		{"other participant", "grinch@example.com", textproto.MIMEHeader{"In-Reply-To": {"<m1@example.com>"}}},
+		{"reference to a received message", "santa@example.com", textproto.MIMEHeader{"References": {"<s1@north.example>"}}},
+		{"same local part, foreign domain", "santa@example.com", textproto.MIMEHeader{"In-Reply-To": {"<m1@other.example>"}}},
+		{"claims our message ID", "santa@example.com", textproto.MIMEHeader{"Message-Id": {"<m1@example.com>"}}},
+	}
+	for _, tt := range tests {
+		got := s.RecordInbound(&InboundMessage{
+			Message: &Message{ID: NewMessageID()},
+			Sender:  tt.sender,
+			Headers: tt.headers,
+		})
+		if got == thread {
+			t.Errorf("%s: joined thread %q", tt.name, thread)
+		}
+	}
+	if c, _ := s.Thread(thread); len(c.Entries) != 2 {
+		t.Errorf("thread has %d entries, want 2", len(c.Entries))
+	}
+}
+
+func TestConversationAssignsMissingMessageIDs(t *testing.T) {
+	s := NewConversationStore()
+	first := s.Add(ConversationEntry{Direction: Inbound, Participant: "a@example.com"})
+	second := s.Add(ConversationEntry{Direction: Inbound, Participant: "b@example.com"})
+	if first == "" || second == "" || first == second {
+		t.Errorf("threads %q and %q, want two distinct threads", first, second)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Most email clients drop <style> blocks, so styles have to be moved into the
+// style attribute of every element. The inliner supports a practical subset of
+// CSS: selectors made of a tag, an #id and .classes (e.g. "p", ".button",
+// "td.cell", "#footer") and comma separated lists of them. Anything else
+// (combinators, pseudo classes, @media, ...) is left in a <style> block for
+// the clients that do read it, with a warning.
+
+// EmailClipLimit is where Gmail clips a message body ("[Message clipped]")
+const EmailClipLimit = 102 * 1024
+
+// CSSDeclaration is a single property: value pair
+type CSSDeclaration struct {
+	Property  string
+	Value     string
+	Important bool
+}
+
+type cssRule struct {
+	selector    cssSelector
+	specificity [3]int
+	order       int
+	decls       []CSSDeclaration
+}
+
+type cssSelector struct {
+	tag     string
+	id      string
+	classes []string
+}
+
+// properties that common email clients ignore or break on
+var unsupportedCSS = map[string]string{
+	"position":   "position is ignored by most email clients",
+	"box-shadow": "box-shadow is not supported by Outlook and Gmail",
+	"transform":  "transform is not supported by most email clients",
+	"animation":  "animation is not supported by most email clients",
+	"transition": "transition is not supported by most email clients",
+	"float":      "float is unreliable in Outlook",
+	"flex":       "flexbox is not supported by Outlook and many webmail clients",
+	"grid":       "grid layout is not supported by most email clients",
+}
+
+var (
+	styleBlockRe = regexp.MustCompile(`(?is)<style[^>]*>(.*?)</style>`)
+	startTagRe   = regexp.MustCompile(`<([a-zA-Z][a-zA-Z0-9]*)((?:\s+[^\s<>"'=/]+(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s<>"']+))?)*)\s*(/?)>`)
+	attrRe       = regexp.MustCompile(`([^\s<>"'=/]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s<>"']+)))?`)
+	cssCommentRe = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	simpleSelRe  = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9]*|\*)?((?:[#.][a-zA-Z_-][a-zA-Z0-9_-]*)*)$`)
+)
+
+// InlineCSS moves the rules of the document's <style> blocks into style
+// attributes and returns the new document and warnings about CSS that email
+// clients may not render
+func InlineCSS(doc string) (string, []string) {
+	var warnings []string
+	var rules []cssRule
+	var kept []string
+
+	order := 0
+	doc = styleBlockRe.ReplaceAllStringFunc(doc, func(block string) string {
+		css := styleBlockRe.FindStringSubmatch(block)[1]
+		parsed, rest, w := parseStylesheet(css, &order)
+		rules = append(rules, parsed...)
+		warnings = append(warnings, w...)
+		if strings.TrimSpace(rest) != "" {
+			kept = append(kept, rest)
+		}
+		return ""
+	})
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		if a.specificity != b.specificity {
+			return lessSpecificity(a.specificity, b.specificity)
+		}
+		return a.order < b.order
+	})
+
+	doc = startTagRe.ReplaceAllStringFunc(doc, func(tag string) string {
+		m := startTagRe.FindStringSubmatch(tag)
+		name := strings.ToLower(m[1])
+		attrs := parseAttrs(m[2])
+		var classes []string
+		for _, c := range strings.Fields(attrs.get("class")) {
+			classes = append(classes, c)
+		}
+
+		// hand written style attributes are checked whether a rule matches
+		// the element or not
+		inline := parseDeclarations(html.UnescapeString(attrs.get("style")))
+		for _, d := range inline {
+			warnings = append(warnings, checkDeclaration(d)...)
+		}
+
+		var decls []CSSDeclaration
+		for _, r := range rules {
+			if r.selector.matches(name, attrs.get("id"), classes) {
+				decls = append(decls, r.decls...)
+			}
+		}
+		if len(decls) == 0 {
+			return tag
+		}
+
+		style := cascade(decls, inline)
+		attrs.set("style", style)
+		return "<" + m[1] + attrs.String() + closeTag(m[3]) + ">"
+	})
+
+	if len(kept) > 0 {
+		block := "<style>\n" + strings.Join(kept, "\n") + "\n</style>"
+		if i := strings.Index(strings.ToLower(doc), "</head>"); i >= 0 {
+			doc = doc[:i] + block + doc[i:]
+		} else {
+			doc = block + doc
+		}
+	}
+
+	if len(doc) > EmailClipLimit {
+		warnings = append(warnings, fmt.Sprintf("HTML is %d bytes, Gmail clips messages above %d bytes", len(doc), EmailClipLimit))
+	}
+	return doc, dedupe(warnings)
+}
+
+func closeTag(slash string) string {
+	if slash != "" {
+		return " /"
+	}
+	return ""
+}
+
+// parseStylesheet returns the inlinable rules, the CSS that has to stay in a
+// <style> block and warnings
+func parseStylesheet(css string, order *int) ([]cssRule, string, []string) {
+	css = cssCommentRe.ReplaceAllString(css, "")
+	var rules []cssRule
+	var rest strings.Builder
+	var warnings []string
+
+	for len(strings.TrimSpace(css)) > 0 {
+		open := strings.IndexByte(css, '{')
+		if open < 0 {
+			break
+		}
+		prelude := strings.TrimSpace(css[:open])
+
+		// find the matching brace, at-rules nest
+		depth, end := 0, -1
+		for i := open; i < len(css); i++ {
+			if css[i] == '{' {
+				depth++
+			} else if css[i] == '}' {
+				depth--
+				if depth == 0 {
+					end = i
+					break
+				}
+			}
+		}
+		if end < 0 {
+			warnings = append(warnings, "unterminated CSS block")
+			break
+		}
+		body := css[open+1 : end]
+		css = css[end+1:]
+
+		if strings.HasPrefix(prelude, "@") {
+			if !strings.HasPrefix(prelude, "@media") {
+				warnings = append(warnings, fmt.Sprintf("%s is not supported by most email clients", strings.Fields(prelude)[0]))
+			}
+			rest.WriteString(prelude + " {" + body + "}\n")
+			continue
+		}
+
+		decls := parseDeclarations(body)
+		for _, d := range decls {
+			warnings = append(warnings, checkDeclaration(d)...)
+		}
+		for _, sel := range strings.Split(prelude, ",") {
+			sel = strings.TrimSpace(sel)
+			parsed, ok := parseSelector(sel)
+			if !ok {
+				warnings = append(warnings, fmt.Sprintf("selector %q cannot be inlined, kept in <style>", sel))
+				rest.WriteString(sel + " {" + body + "}\n")
+				continue
+			}
+			*order++
+			rules = append(rules, cssRule{
+				selector:    parsed,
+				specificity: parsed.specificity(),
+				order:       *order,
+				decls:       decls,
+			})
+		}
+	}
+	return rules, rest.String(), warnings
+}
+
+func parseSelector(s string) (cssSelector, bool) {
+	m := simpleSelRe.FindStringSubmatch(s)
+	if m == nil || s == "" {
+		return cssSelector{}, false
+	}
+	sel := cssSelector{tag: strings.ToLower(m[1])}
+	if sel.tag == "*" {
+		sel.tag = ""
+	}
+	parts := m[2]
+	for len(parts) > 0 {
+		kind := parts[0]
+		end := strings.IndexAny(parts[1:], "#.")
+		var name string
+		if end < 0 {
+			name, parts = parts[1:], ""
+		} else {
+			name, parts = parts[1:end+1], parts[end+1:]
+		}
+		if kind == '#' {
+			if sel.id != "" && sel.id != name {
+				return cssSelector{}, false
+			}
+			sel.id = name
+		} else {
+			sel.classes = append(sel.classes, name)
+		}
+	}
+	return sel, true
+}
+
+func (s cssSelector) specificity() [3]int {
+	var sp [3]int
+	if s.id != "" {
+		sp[0] = 1
+	}
+	sp[1] = len(s.classes)
+	if s.tag != "" {
+		sp[2] = 1
+	}
+	return sp
+}
+
+func lessSpecificity(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+func (s cssSelector) matches(tag, id string, classes []string) bool {
+	if s.tag != "" && s.tag != tag {
+		return false
+	}
+	if s.id != "" && s.id != id {
+		return false
+	}
+	for _, want := range s.classes {
+		found := false
+		for _, c := range classes {
+			if c == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func parseDeclarations(s string) []CSSDeclaration {
+	var decls []CSSDeclaration
+	for _, part := range strings.Split(s, ";") {
+		prop, value, ok := strings.Cut(part, ":")
+		if !ok {
+			continue
+		}
+		prop = strings.ToLower(strings.TrimSpace(prop))
+		value = strings.TrimSpace(value)
+		important := false
+		if v, ok := strings.CutSuffix(value, "!important"); ok {
+			value, important = strings.TrimSpace(v), true
+		}
+		if prop == "" || value == "" {
+			continue
+		}
+		decls = append(decls, CSSDeclaration{Property: prop, Value: value, Important: important})
+	}
+	return decls
+}
+
+func checkDeclaration(d CSSDeclaration) []string {
+	if msg, ok := unsupportedCSS[d.Property]; ok {
+		return []string{msg}
+	}
+	if d.Property == "display" {
+		if msg, ok := unsupportedCSS[d.Value]; ok {
+			return []string{msg}
+		}
+	}
+	if strings.Contains(d.Value, "var(") {
+		return []string{"CSS variables are not supported by most email clients"}
+	}
+	return nil
+}
+
+// cascade merges the stylesheet declarations (sorted by specificity) with the
+// element's own style attribute. Later declarations win, so the style
+// attribute wins unless a sheet rule is !important and it is not.
+func cascade(sheet, inline []CSSDeclaration) string {
+	values := make(map[string]CSSDeclaration)
+	var order []string
+	apply := func(d CSSDeclaration) {
+		prev, seen := values[d.Property]
+		if !seen {
+			order = append(order, d.Property)
+		} else if prev.Important && !d.Important {
+			return
+		}
+		values[d.Property] = d
+	}
+	for _, d := range sheet {
+		apply(d)
+	}
+	for _, d := range inline {
+		apply(d)
+	}
+
+	parts := make([]string, 0, len(order))
+	for _, p := range order {
+		d := values[p]
+		v := d.Value
+		if d.Important {
+			v += " !important"
+		}
+		parts = append(parts, p+": "+v)
+	}
+	return strings.Join(parts, "; ")
+}
+
+type htmlAttr struct {
+	name, value string
+	hasValue    bool
+}
+
+type htmlAttrs []htmlAttr
+
+func parseAttrs(s string) htmlAttrs {
+	var attrs htmlAttrs
+	for _, m := range attrRe.FindAllStringSubmatch(s, -1) {
+		a := htmlAttr{name: m[1]}
+		for _, v := range m[2:] {
+			if v != "" {
+				a.value = v
+				break
+			}
+		}
+		a.hasValue = strings.Contains(m[0], "=")
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+func (a htmlAttrs) get(name string) string {
+	for _, attr := range a {
+		if strings.EqualFold(attr.name, name) {
+			return attr.value
+		}
+	}
+	return ""
+}
+
+func (a *htmlAttrs) set(name, value string) {
+	for i, attr := range *a {
+		if strings.EqualFold(attr.name, name) {
+			(*a)[i].value, (*a)[i].hasValue = value, true
+			return
+		}
+	}
+	*a = append(*a, htmlAttr{name: name, value: value, hasValue: true})
+}
+
+func (a htmlAttrs) String() string {
+	var b strings.Builder
+	for _, attr := range a {
+		b.WriteString(" " + attr.name)
+		if attr.hasValue {
+			b.WriteString(`="` + html.EscapeString(html.UnescapeString(attr.value)) + `"`)
+		}
+	}
+	return b.String()
+}
+
+func dedupe(list []string) []string {
+	seen := make(map[string]bool, len(list))
+	var out []string
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
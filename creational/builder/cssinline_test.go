@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInlineCSS(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		// substrings of the result
+		want []string
+		// substrings of the warnings, in any of them
+		warn []string
+	}{
+		{
+			"class rule",
+			`<style>.b { color: red }</style><p class="b">x</p>`,
+			[]string{`<p class="b" style="color: red">`},
+			nil,
+		},
+		{
+			"inline style wins over the sheet",
+			`<style>p { color: red; margin: 0 }</style><p style="color: blue">x</p>`,
+			[]string{`color: blue`, `margin: 0`},
+			nil,
+		},
+		{
+			"important sheet rule wins over the inline style",
+			`<style>p { color: red !important }</style><p style="color: blue">x</p>`,
+			[]string{`color: red !important`},
+			nil,
+		},
+		{
+			"important inline style wins over an important sheet rule",
+			`<style>p { color: red !important }</style><p style="color: blue !important">x</p>`,
+			[]string{`color: blue !important`},
+			nil,
+		},
+		{
+			"unsupported property in the sheet",
+			`<style>p { float: left }</style><p>x</p>`,
+			nil,
+			[]string{"float"},
+		},
+		{
+			"unsupported property on an unmatched element",
+			`<style>p { color: red }</style><div style="position: absolute">x</div>`,
+			[]string{`<div style="position: absolute">`},
+			[]string{"position"},
+		},
+		{
+			"unsupported property without any sheet",
+			`<td style="box-shadow: 0 0 1px black">x</td>`,
+			nil,
+			[]string{"box-shadow"},
+		},
+		{
+			"unsupported selector stays in a style block",
+			`<head></head><style>a:hover { color: red }</style><a>x</a>`,
+			[]string{"<style>", "a:hover"},
+			[]string{"a:hover"},
+		},
+	}
+	for _, tt := range tests {
+		got, warnings := InlineCSS(tt.doc)
+		for _, w := range tt.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%s: %q does not contain %q", tt.name, got, w)
+			}
+		}
+		all := strings.Join(warnings, "\n")
+		for _, w := range tt.warn {
+			if !strings.Contains(all, w) {
+				t.Errorf("%s: warnings %q do not mention %q", tt.name, warnings, w)
+			}
+		}
+		if tt.warn == nil && len(warnings) > 0 {
+			t.Errorf("%s: unexpected warnings %q", tt.name, warnings)
+		}
+	}
+}
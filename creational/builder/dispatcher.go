@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Dispatcher hands built messages to a transport, retrying transient failures
+// and recording the outcome in the lifecycle store
+type Dispatcher struct {
+	Transport Transport
+	// DefaultRetrier when nil
+	Retrier *Retrier
+	// Optional
+	Lifecycle *LifecycleStore
+	// Recorded on the lifecycle records of dispatched messages
+	Channel string
+	// Optional, provider references returned by a RefTransport are recorded here
+	Refs *ProviderRefs
+	// What Enqueue does with messages that collapse with a pending one
+	Collapse CollapsePolicy
+
+	defaultRetrier sync.Once
+
+	mu         sync.Mutex
+	queue      []*Message
+	superseded []SupersededMessage
+}
+
+// Dispatch sends the message, assigning an ID first if it has none. Messages
+// the lifecycle store does not know yet are tracked from here.
+func (d *Dispatcher) Dispatch(ctx context.Context, msg *Message) error {
+	if msg.ID == "" {
+		msg.ID = NewMessageID()
+	}
+	if d.Lifecycle != nil {
+		d.Lifecycle.TrackIfNew(LifecycleRecord{
+			MessageID: msg.ID,
+			Format:    msg.Format,
+			Channel:   d.Channel,
+			Recipient: msg.Recipient,
+		})
+	}
+
+	d.defaultRetrier.Do(func() {
+		if d.Retrier == nil {
+			d.Retrier = DefaultRetrier()
+		}
+	})
+
+	err := d.Retrier.Do(ctx, func(ctx context.Context) error {
+		rt, ok := d.Transport.(RefTransport)
+		if !ok || d.Refs == nil {
+			return d.Transport.Send(ctx, msg)
+		}
+		ref, err := rt.SendRef(ctx, msg)
+		if err == nil && ref != "" {
+			d.Refs.Record(ref, msg.ID)
+		}
+		return err
+	})
+
+	if d.Lifecycle != nil {
+		state, reason := StateSent, ""
+		if err != nil {
+			state, reason = StateFailed, err.Error()
+		}
+		// a delivery callback may have overtaken us, that is not an error
+		if lerr := d.Lifecycle.Transition(msg.ID, state, time.Now(), reason); lerr != nil && !errors.Is(lerr, ErrInvalidTransition) {
+			return errors.Join(err, lerr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDispatcherRecordsLifecycle(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want MessageState
+	}{
+		{"sent", nil, StateSent},
+		{"failed", PermanentError(errors.New("rejected")), StateFailed},
+	}
+	for _, tt := range tests {
+		store := NewLifecycleStore()
+		d := &Dispatcher{
+			Transport: TransportFunc(func(ctx context.Context, msg *Message) error { return tt.err }),
+			Retrier:   &Retrier{Policy: ConstantPolicy{Delay: time.Millisecond, MaxAttempts: 1}},
+			Lifecycle: store,
+			Channel:   "test",
+		}
+		msg := &Message{Recipient: "a@example.com", Format: "JSON"}
+		if err := d.Dispatch(context.Background(), msg); !errors.Is(err, tt.err) {
+			t.Fatalf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+		if msg.ID == "" {
+			t.Fatalf("%s: no message ID assigned", tt.name)
+		}
+
+		rec, err := store.Get(msg.ID)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if rec.State != tt.want {
+			t.Errorf("%s: state = %s, want %s", tt.name, rec.State, tt.want)
+		}
+		if rec.Channel != "test" || rec.Format != "JSON" || rec.Recipient != msg.Recipient {
+			t.Errorf("%s: record = %+v", tt.name, rec)
+		}
+		if len(rec.History) != 2 {
+			t.Errorf("%s: history = %+v, want built and %s", tt.name, rec.History, tt.want)
+		}
+	}
+}
+
+func TestDispatcherKeepsTrackedRecord(t *testing.T) {
+	store := NewLifecycleStore()
+	store.Track(LifecycleRecord{MessageID: "m", Tenant: "acme"})
+	d := &Dispatcher{
+		Transport: TransportFunc(func(ctx context.Context, msg *Message) error { return nil }),
+		Lifecycle: store,
+	}
+	if err := d.Dispatch(context.Background(), &Message{ID: "m"}); err != nil {
+		t.Fatal(err)
+	}
+	rec, _ := store.Get("m")
+	if rec.Tenant != "acme" || rec.State != StateSent {
+		t.Errorf("record = %+v", rec)
+	}
+}
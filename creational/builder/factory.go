@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// NewBuilder returns a fresh concrete builder for the format
+func NewBuilder(format string) (MessageBuilder, error) {
+	switch format {
+	case "JSON":
+		return &JSONMessageBuilder{}, nil
+	case "XML":
+		return &XMLMessageBuilder{}, nil
+	case "HTML":
+		return &HTMLMessageBuilder{}, nil
+	case "EMAIL":
+		return &EmailMessageBuilder{}, nil
+	}
+	return nil, fmt.Errorf("no builder for format %q", format)
+}
+
+// Resetter is implemented by builders that can be reused for another message.
+// Reset clears everything set for the last message and keeps the
+// configuration.
+type Resetter interface {
+	Reset()
+}
+
+// BuilderFactory hands out concrete builders by format. Builders are pooled
+// per format, so a busy sender does not allocate a new builder per message.
+// Only builders implementing Resetter are reused, others are dropped after one
+// message so nothing carries over.
+type BuilderFactory struct {
+	pools map[string]*Pool[MessageBuilder]
+}
+
+// NewBuilderFactory creates a factory with the JSON, XML, HTML and email builders, at most
+// maxPerFormat of each in use at a time
+func NewBuilderFactory(maxPerFormat int) *BuilderFactory {
+	f := &BuilderFactory{pools: make(map[string]*Pool[MessageBuilder])}
+	f.Register("JSON", func() MessageBuilder { return &JSONMessageBuilder{} }, maxPerFormat)
+	f.Register("XML", func() MessageBuilder { return &XMLMessageBuilder{} }, maxPerFormat)
+	f.Register("HTML", func() MessageBuilder { return &HTMLMessageBuilder{} }, maxPerFormat)
+	f.Register("EMAIL", func() MessageBuilder { return &EmailMessageBuilder{} }, maxPerFormat)
+	return f
+}
+
+// Register adds (or replaces) a builder for a format
+func (f *BuilderFactory) Register(format string, newBuilder func() MessageBuilder, max int) {
+	f.pools[format] = NewPool(PoolConfig[MessageBuilder]{
+		New: func(context.Context) (MessageBuilder, error) {
+			return newBuilder(), nil
+		},
+		MaxSize: max,
+	})
+}
+
+// Formats returns the formats the factory can build
+func (f *BuilderFactory) Formats() []string {
+	formats := make([]string, 0, len(f.pools))
+	for format := range f.pools {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// Build borrows a builder for the format, builds the message and returns the
+// builder to the pool
+func (f *BuilderFactory) Build(ctx context.Context, format, recipient, text string) (*Message, error) {
+	pool, ok := f.pools[format]
+	if !ok {
+		return nil, fmt.Errorf("no builder for format %q", format)
+	}
+
+	builder, err := pool.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r, ok := builder.(Resetter); ok {
+			r.Reset()
+			pool.Put(builder)
+		} else {
+			pool.Discard(builder)
+		}
+	}()
+
+	builder.SetRecipient(recipient)
+	builder.SetText(text)
+	return builder.Message()
+}
+
+// Stats returns the pool metrics per format
+func (f *BuilderFactory) Stats() map[string]PoolStats {
+	stats := make(map[string]PoolStats, len(f.pools))
+	for format, pool := range f.pools {
+		stats[format] = pool.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNewBuilder(t *testing.T) {
+	for _, format := range []string{"JSON", "XML", "HTML", "EMAIL"} {
+		b, err := NewBuilder(format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		b.SetRecipient("santa@example.com")
+		b.SetText("hello")
+		msg, err := b.Message()
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if msg.Format != format || msg.Recipient != "santa@example.com" {
+			t.Errorf("%s: message %+v", format, msg)
+		}
+	}
+	if _, err := NewBuilder("PDF"); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestBuilderFactoryResetsBuilders(t *testing.T) {
+	f := NewBuilderFactory(1)
+	ctx := context.Background()
+
+	for _, format := range []string{"JSON", "XML", "HTML", "EMAIL"} {
+		if _, err := f.Build(ctx, format, "a@example.com", "hello"); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+	}
+
+	json, _ := f.pools["JSON"].Get(ctx)
+	if j := json.(*JSONMessageBuilder); j.messageRecipient != "" || j.messageText != "" || j.messageActions != nil {
+		t.Errorf("JSON builder not reset: %+v", j)
+	}
+	html, _ := f.pools["HTML"].Get(ctx)
+	if h := html.(*HTMLMessageBuilder); h.messageRecipient != "" || h.messageText != "" || h.warnings != nil {
+		t.Errorf("HTML builder not reset: %+v", h)
+	}
+	email, _ := f.pools["EMAIL"].Get(ctx)
+	if e := email.(*EmailMessageBuilder); e.HTML.messageRecipient != "" || e.Subject != "" || e.images != nil {
+		t.Errorf("email builder not reset: %+v", e)
+	}
+}
+
+// a builder without Reset must not be reused
+type noResetBuilder struct {
+	b *JSONMessageBuilder
+}
+
+func (n noResetBuilder) SetRecipient(r string)      { n.b.SetRecipient(r) }
+func (n noResetBuilder) SetText(s string)           { n.b.SetText(s) }
+func (n noResetBuilder) Message() (*Message, error) { return n.b.Message() }
+
+func TestBuilderFactoryDropsBuildersWithoutReset(t *testing.T) {
+	f := NewBuilderFactory(1)
+	created := 0
+	f.Register("PLAIN", func() MessageBuilder {
+		created++
+		return noResetBuilder{&JSONMessageBuilder{}}
+	}, 1)
+
+	for i := 0; i < 3; i++ {
+		if _, err := f.Build(context.Background(), "PLAIN", "a", "b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if created != 3 {
+		t.Errorf("created %d builders, want 3", created)
+	}
+	if s := f.Stats()["PLAIN"]; s.Idle != 0 || s.InUse != 0 {
+		t.Errorf("stats %+v", s)
+	}
+}
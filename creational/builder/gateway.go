@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The inbound gateway turns content we receive (mails, webhooks, socket
+// frames) into the same Message model the builders produce. Every listener
+// hands raw content to the gateway, which sniffs the format, parses it with the
+// hardened parsers, applies policy checks and routes it to a handler.
+
+// InboundMessage is a received Message together with where it came from
+type InboundMessage struct {
+	*Message
+	// Parsed text of the message
+	Text string
+	// Who sent it, as far as the channel tells
+	Sender string
+	// "smtp", "http" or "frame"
+	Channel    string
+	Headers    textproto.MIMEHeader
+	ReceivedAt time.Time
+}
+
+// InboundHandler processes received messages
+type InboundHandler interface {
+	HandleInbound(ctx context.Context, msg *InboundMessage) error
+}
+
+// InboundHandlerFunc adapts a function to InboundHandler
+type InboundHandlerFunc func(ctx context.Context, msg *InboundMessage) error
+
+func (f InboundHandlerFunc) HandleInbound(ctx context.Context, msg *InboundMessage) error {
+	return f(ctx, msg)
+}
+
+// InboundPolicy rejects messages by returning an error
+type InboundPolicy func(msg *InboundMessage) error
+
+// InboundRoute sends messages matching Match to Handler
+type InboundRoute struct {
+	Match   func(msg *InboundMessage) bool
+	Handler InboundHandler
+}
+
+var (
+	ErrUnknownFormat = errors.New("cannot determine message format")
+	ErrNoRoute       = errors.New("no handler for message")
+)
+
+// InboundGateway receives, parses, checks and routes inbound content
+type InboundGateway struct {
+	// Parser per format, Parsers(DefaultParseOptions) when nil
+	Parsers  map[string]MessageParser
+	Policies []InboundPolicy
+	Routes   []InboundRoute
+	// Handler for messages no route matches, optional
+	Default InboundHandler
+}
+
+// Receive handles one piece of inbound content
+func (g *InboundGateway) Receive(ctx context.Context, channel, sender string, headers textproto.MIMEHeader, body []byte) (*InboundMessage, error) {
+	if headers == nil {
+		headers = textproto.MIMEHeader{}
+	}
+
+	format := formatFromContentType(headers.Get("Content-Type"))
+	if format == "" {
+		format = SniffFormat(body)
+	}
+
+	parsers := g.Parsers
+	if parsers == nil {
+		parsers = Parsers(DefaultParseOptions)
+	}
+
+	var parsed *ParsedMessage
+	if parser, ok := parsers[format]; ok {
+		var err error
+		if parsed, err = parser.Parse(body); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", format, err)
+		}
+	} else if format == "TEXT" {
+		parsed = &ParsedMessage{Format: "TEXT", Recipient: headers.Get("To"), Text: string(body)}
+	} else if format == "HTML" {
+		parsed = &ParsedMessage{Format: "HTML", Recipient: headers.Get("To"), Text: htmlText(string(body))}
+	} else {
+		return nil, ErrUnknownFormat
+	}
+
+	msg := &InboundMessage{
+		Message: &Message{
+			ID:        NewMessageID(),
+			Recipient: parsed.Recipient,
+			Body:      body,
+			Format:    parsed.Format,
+		},
+		Text:       parsed.Text,
+		Sender:     sender,
+		Channel:    channel,
+		Headers:    headers,
+		ReceivedAt: time.Now(),
+	}
+
+	for _, policy := range g.Policies {
+		if err := policy(msg); err != nil {
+			return nil, fmt.Errorf("rejected: %w", err)
+		}
+	}
+
+	for _, route := range g.Routes {
+		if route.Match == nil || route.Match(msg) {
+			return msg, route.Handler.HandleInbound(ctx, msg)
+		}
+	}
+	if g.Default != nil {
+		return msg, g.Default.HandleInbound(ctx, msg)
+	}
+	return msg, ErrNoRoute
+}
+
+func formatFromContentType(ct string) string {
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return "JSON"
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		return "XML"
+	case mediaType == "text/plain":
+		return "TEXT"
+	case mediaType == "text/html":
+		return "HTML"
+	}
+	return ""
+}
+
+var htmlTags = regexp.MustCompile(`(?s)<(script|style)\b.*?</(script|style)>|<[^>]*>`)
+
+// htmlText is the readable text of an HTML body, good enough for routing and
+// policy checks
+func htmlText(doc string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(htmlTags.ReplaceAllString(doc, " "))), " ")
+}
+
+// AllowedSenders only accepts messages from the given senders
+func AllowedSenders(senders ...string) InboundPolicy {
+	allowed := make(map[string]bool, len(senders))
+	for _, s := range senders {
+		allowed[strings.ToLower(s)] = true
+	}
+	return func(msg *InboundMessage) error {
+		if !allowed[strings.ToLower(msg.Sender)] {
+			return fmt.Errorf("sender %q not allowed", msg.Sender)
+		}
+		return nil
+	}
+}
+
+// AllowedFormats only accepts messages of the given formats
+func AllowedFormats(formats ...string) InboundPolicy {
+	return func(msg *InboundMessage) error {
+		for _, f := range formats {
+			if msg.Format == f {
+				return nil
+			}
+		}
+		return fmt.Errorf("format %s not allowed", msg.Format)
+	}
+}
+
+var ErrUnauthenticated = errors.New("sender not authenticated")
+
+// HTTPInbound receives messages posted over HTTP
+type HTTPInbound struct {
+	Gateway     *InboundGateway
+	MaxBodySize int64
+	// Authenticates the request and returns the sender, TLSClientSender when
+	// nil. Never trust a header the client sets itself, AllowedSenders is only
+	// as good as this.
+	Sender func(r *http.Request) (string, error)
+}
+
+// TLSClientSender takes the sender from the verified TLS client certificate:
+// its first email address, else its common name. The server must verify
+// client certificates, e.g. with tls.RequireAndVerifyClientCert.
+func TLSClientSender(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", fmt.Errorf("%w: no verified client certificate", ErrUnauthenticated)
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0], nil
+	}
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName, nil
+	}
+	return "", fmt.Errorf("%w: client certificate names no sender", ErrUnauthenticated)
+}
+
+func (h *HTTPInbound) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	senderOf := h.Sender
+	if senderOf == nil {
+		senderOf = TLSClientSender
+	}
+	sender, err := senderOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	limit := h.MaxBodySize
+	if limit <= 0 {
+		limit = int64(DefaultParseOptions.MaxBodySize)
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		http.Error(w, "cannot read body", http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > limit {
+		http.Error(w, ErrBodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	msg, err := h.Gateway.Receive(r.Context(), "http", sender, textproto.MIMEHeader(r.Header), body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": msg.ID})
+}
+
+// SMTPInbound is a minimal SMTP server accepting mail for the gateway. It
+// speaks just enough of RFC 5321 for relays to deliver to it.
+type SMTPInbound struct {
+	Gateway  *InboundGateway
+	Hostname string
+	// Maximum size of a mail, DefaultParseOptions.MaxBodySize when zero
+	MaxSize int
+	// Idle time before a connection is dropped
+	Timeout time.Duration
+	// Recipients accepted per mail, 100 when zero
+	MaxRecipients int
+}
+
+// smtpMaxLine is the longest command line accepted, including CRLF, as in
+// RFC 5321 4.5.3.1.4
+const smtpMaxLine = 512
+
+var errLineTooLong = errors.New("line too long")
+
+// Serve accepts connections until the listener is closed
+func (s *SMTPInbound) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *SMTPInbound) serveConn(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReaderSize(conn, smtpMaxLine)
+	tr := textproto.NewReader(br)
+	tw := textproto.NewWriter(bufio.NewWriter(conn))
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	maxSize := s.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultParseOptions.MaxBodySize
+	}
+	hostname := s.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	maxRecipients := s.MaxRecipients
+	if maxRecipients <= 0 {
+		maxRecipients = 100
+	}
+
+	var from string
+	var to []string
+	reply := func(code int, text string) bool {
+		return tw.PrintfLine("%d %s", code, text) == nil
+	}
+
+	reply(220, hostname+" ESMTP ready")
+	for {
+		conn.SetDeadline(time.Now().Add(timeout))
+		line, err := readSMTPLine(br)
+		if errors.Is(err, errLineTooLong) {
+			reply(500, "line too long")
+			continue
+		}
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO", "EHLO":
+			from, to = "", nil
+			if strings.ToUpper(verb) == "EHLO" {
+				tw.PrintfLine("250-%s", hostname)
+				reply(250, fmt.Sprintf("SIZE %d", maxSize))
+			} else {
+				reply(250, hostname)
+			}
+		case "MAIL":
+			addr, ok := smtpPath(arg, "FROM:")
+			if !ok {
+				reply(501, "syntax: MAIL FROM:<address>")
+				continue
+			}
+			from, to = addr, nil
+			reply(250, "OK")
+		case "RCPT":
+			addr, ok := smtpPath(arg, "TO:")
+			if !ok || from == "" {
+				reply(503, "need MAIL before RCPT")
+				continue
+			}
+			if len(to) >= maxRecipients {
+				reply(452, "too many recipients")
+				continue
+			}
+			to = append(to, addr)
+			reply(250, "OK")
+		case "DATA":
+			if len(to) == 0 {
+				reply(503, "need RCPT before DATA")
+				continue
+			}
+			reply(354, "end data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(io.LimitReader(tr.DotReader(), int64(maxSize)+1))
+			if err != nil {
+				return
+			}
+			if len(data) > maxSize {
+				// drain the rest so the session stays in sync
+				io.Copy(io.Discard, tr.DotReader())
+				reply(552, "message too large")
+			} else if err := s.deliver(from, to, data); err != nil {
+				reply(554, err.Error())
+			} else {
+				reply(250, "OK")
+			}
+			from, to = "", nil
+		case "RSET":
+			from, to = "", nil
+			reply(250, "OK")
+		case "NOOP":
+			reply(250, "OK")
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			reply(502, "command not implemented")
+		}
+	}
+}
+
+// readSMTPLine reads one line without its CRLF. Longer lines than the reader's
+// buffer are skipped and reported as errLineTooLong.
+func readSMTPLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		for err == bufio.ErrBufferFull {
+			_, err = br.ReadSlice('\n')
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", errLineTooLong
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func smtpPath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+	if i := strings.IndexByte(path, ' '); i >= 0 {
+		// ignore ESMTP parameters such as SIZE=
+		path = path[:i]
+	}
+	if !strings.HasPrefix(path, "<") || !strings.HasSuffix(path, ">") {
+		return "", false
+	}
+	return path[1 : len(path)-1], true
+}
+
+func (s *SMTPInbound) deliver(from string, to []string, data []byte) error {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	headers := textproto.MIMEHeader(m.Header)
+	if headers.Get("Content-Type") == "" {
+		headers.Set("Content-Type", "text/plain")
+	}
+	contentType, body, err := mailBody(headers, m.Body, 0)
+	if err != nil {
+		return err
+	}
+	// the gateway sniffs the format from the part we picked
+	headers.Set("Content-Type", contentType)
+	headers.Del("Content-Transfer-Encoding")
+	if headers.Get("To") == "" {
+		headers.Set("To", strings.Join(to, ", "))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err = s.Gateway.Receive(ctx, "smtp", from, headers, body)
+	return err
+}
+
+var ErrUnsupportedMail = errors.New("unsupported mail content")
+
+// mailBody decodes the content transfer encoding of a mail body. For
+// multipart mails it picks the part the gateway can read best: JSON or XML
+// first, then plain text, then HTML.
+func mailBody(header textproto.MIMEHeader, r io.Reader, depth int) (string, []byte, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: content type: %v", ErrUnsupportedMail, err)
+	}
+
+	switch enc := strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))); enc {
+	case "", "7bit", "8bit", "binary":
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	default:
+		return "", nil, fmt.Errorf("%w: transfer encoding %q", ErrUnsupportedMail, enc)
+	}
+
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: %v", ErrUnsupportedMail, err)
+		}
+		return mime.FormatMediaType(mediaType, params), body, nil
+	}
+	if depth >= 5 {
+		return "", nil, fmt.Errorf("%w: multipart nested too deep", ErrUnsupportedMail)
+	}
+	if params["boundary"] == "" {
+		return "", nil, fmt.Errorf("%w: multipart without boundary", ErrUnsupportedMail)
+	}
+
+	rank := map[string]int{"JSON": 3, "XML": 3, "TEXT": 2, "HTML": 1}
+	var best string
+	var bestBody []byte
+	mr := multipart.NewReader(r, params["boundary"])
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: %v", ErrUnsupportedMail, err)
+		}
+		partHeader := part.Header
+		if partHeader.Get("Content-Type") == "" {
+			partHeader.Set("Content-Type", "text/plain")
+		}
+		if disposition, _, _ := mime.ParseMediaType(partHeader.Get("Content-Disposition")); disposition == "attachment" {
+			continue
+		}
+		ct, body, err := mailBody(partHeader, part, depth+1)
+		if err != nil {
+			// an odd part should not cost us the readable ones
+			continue
+		}
+		if rank[formatFromContentType(ct)] > rank[formatFromContentType(best)] {
+			best, bestBody = ct, body
+		}
+	}
+	if best == "" {
+		return "", nil, fmt.Errorf("%w: no readable part", ErrUnsupportedMail)
+	}
+	return best, bestBody, nil
+}
+
+// FrameInbound receives messages over the framing protocol: every frame is a
+// 4 byte big endian length followed by the payload. Each frame is answered
+// with a frame holding "OK <id>" or "ERR <reason>".
+type FrameInbound struct {
+	Gateway *InboundGateway
+	// Maximum payload size, DefaultParseOptions.MaxBodySize when zero
+	MaxFrameSize int
+	// Idle time before a connection is dropped, 5 minutes when zero
+	Timeout time.Duration
+}
+
+// Serve accepts connections until the listener is closed
+func (f *FrameInbound) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go f.serveConn(conn)
+	}
+}
+
+func (f *FrameInbound) serveConn(conn net.Conn) {
+	defer conn.Close()
+	maxSize := f.MaxFrameSize
+	if maxSize <= 0 {
+		maxSize = DefaultParseOptions.MaxBodySize
+	}
+	timeout := f.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		// a peer that stalls halfway through a frame must not hold the
+		// connection forever
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		payload, err := ReadFrame(r, maxSize)
+		if err != nil {
+			if errors.Is(err, ErrBodyTooLarge) {
+				WriteFrame(conn, []byte("ERR "+err.Error()))
+			}
+			return
+		}
+
+		msg, err := f.Gateway.Receive(context.Background(), "frame", conn.RemoteAddr().String(), nil, payload)
+		if err != nil {
+			err = WriteFrame(conn, []byte("ERR "+err.Error()))
+		} else {
+			err = WriteFrame(conn, []byte("OK "+msg.ID))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ReadFrame reads one length prefixed frame
+func ReadFrame(r io.Reader, maxSize int) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if int64(size) > int64(maxSize) {
+		return nil, fmt.Errorf("%w: frame of %d bytes", ErrBodyTooLarge, size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// WriteFrame writes one length prefixed frame
+func WriteFrame(w io.Writer, payload []byte) error {
+	buf := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	copy(buf[4:], payload)
+	_, err := w.Write(buf)
+	return err
+}
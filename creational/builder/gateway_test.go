@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMailBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   map[string]string
+		body     string
+		wantType string
+		wantBody string
+	}{
+		{
+			"plain",
+			map[string]string{"Content-Type": "text/plain"},
+			"hello", "text/plain", "hello",
+		},
+		{
+			"base64",
+			map[string]string{"Content-Type": "application/json", "Content-Transfer-Encoding": "base64"},
+			"eyJyZWNpcGllbnQiOiAic2FudGEi\r\nfQ==", "application/json", `{"recipient": "santa"}`,
+		},
+		{
+			"quoted printable",
+			map[string]string{"Content-Type": "text/plain; charset=utf-8", "Content-Transfer-Encoding": "quoted-printable"},
+			"caf=C3=A9 au=\r\n lait", "text/plain; charset=utf-8", "café au lait",
+		},
+		{
+			"alternative prefers plain text",
+			map[string]string{"Content-Type": `multipart/alternative; boundary="b1"`},
+			"--b1\r\nContent-Type: text/html\r\n\r\n<p>hi</p>\r\n" +
+				"--b1\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\naGk=\r\n--b1--\r\n",
+			"text/plain", "hi",
+		},
+		{
+			"nested multipart with json",
+			map[string]string{"Content-Type": `multipart/mixed; boundary="outer"`},
+			"--outer\r\nContent-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+				"--inner\r\nContent-Type: text/plain\r\n\r\nsee attachment\r\n--inner--\r\n" +
+				"--outer\r\nContent-Type: application/json\r\n\r\n{}\r\n" +
+				"--outer\r\nContent-Type: application/json\r\nContent-Disposition: attachment\r\n\r\n[]\r\n--outer--\r\n",
+			"application/json", "{}",
+		},
+		{
+			"unknown part encoding skipped",
+			map[string]string{"Content-Type": `multipart/mixed; boundary=b`},
+			"--b\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: x-uuencode\r\n\r\nbegin\r\n" +
+				"--b\r\nContent-Type: text/html\r\n\r\n<b>bold</b>\r\n--b--\r\n",
+			"text/html", "<b>bold</b>",
+		},
+	}
+	for _, tt := range tests {
+		header := textproto.MIMEHeader{}
+		for k, v := range tt.header {
+			header.Set(k, v)
+		}
+		ct, body, err := mailBody(header, strings.NewReader(tt.body), 0)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if ct != tt.wantType || string(body) != tt.wantBody {
+			t.Errorf("%s: got %q %q, want %q %q", tt.name, ct, body, tt.wantType, tt.wantBody)
+		}
+	}
+}
+
+func TestMailBodyRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+	}{
+		{"bad content type", map[string]string{"Content-Type": "text/"}},
+		{"unknown encoding", map[string]string{"Content-Type": "text/plain", "Content-Transfer-Encoding": "x-custom"}},
+		{"no boundary", map[string]string{"Content-Type": "multipart/mixed"}},
+	}
+	for _, tt := range tests {
+		header := textproto.MIMEHeader{}
+		for k, v := range tt.header {
+			header.Set(k, v)
+		}
+		if _, _, err := mailBody(header, strings.NewReader("x"), 0); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestGatewayReceiveHTML(t *testing.T) {
+	var got *InboundMessage
+	g := &InboundGateway{Default: InboundHandlerFunc(func(ctx context.Context, msg *InboundMessage) error {
+		got = msg
+		return nil
+	})}
+	headers := textproto.MIMEHeader{"Content-Type": {"text/html; charset=utf-8"}, "To": {"santa@example.com"}}
+	body := []byte("<html><style>p{}</style><p>I was <b>good</b> &amp; nice</p></html>")
+	if _, err := g.Receive(context.Background(), "smtp", "elf@example.com", headers, body); err != nil {
+		t.Fatal(err)
+	}
+	if got.Format != "HTML" || got.Text != "I was good & nice" || got.Recipient != "santa@example.com" {
+		t.Errorf("got format %q text %q recipient %q", got.Format, got.Text, got.Recipient)
+	}
+}
+
+func TestFrameInboundDropsStalledPeer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f := &FrameInbound{Gateway: &InboundGateway{}, Timeout: 50 * time.Millisecond}
+	go f.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// half a length prefix, then nothing
+	if _, err := conn.Write([]byte{0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read data, want the connection closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("server kept the stalled connection open")
+	}
+}
+
+func TestSMTPInboundSession(t *testing.T) {
+	var mu sync.Mutex
+	var got []*InboundMessage
+	g := &InboundGateway{Default: InboundHandlerFunc(func(ctx context.Context, msg *InboundMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, msg)
+		return nil
+	})}
+	s := &SMTPInbound{Gateway: g, Hostname: "mx.example.com", MaxRecipients: 2, Timeout: 5 * time.Second}
+
+	server, client := net.Pipe()
+	go s.serveConn(server)
+	c := textproto.NewConn(client)
+	defer c.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	expect := func(cmd string, code int) {
+		t.Helper()
+		if cmd != "" {
+			if err := c.PrintfLine("%s", cmd); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, msg, err := c.ReadResponse(code); err != nil {
+			t.Fatalf("%.40q: %v %s", cmd, err, msg)
+		}
+	}
+	expect("", 220)
+	expect("EHLO client.example.com", 250)
+	expect("MAIL FROM:<elf@example.com>", 250)
+	expect("RCPT TO:<santa@example.com>", 250)
+	expect("RCPT TO:<"+strings.Repeat("x", 600)+"@example.com>", 500)
+	expect("RCPT TO:<rudolph@example.com>", 250)
+	expect("RCPT TO:<dasher@example.com>", 452)
+	expect("DATA", 354)
+	w := c.DotWriter()
+	w.Write([]byte("Subject: wish\r\nContent-Type: text/plain\r\n\r\nA sled please\r\n"))
+	w.Close()
+	expect("", 250)
+	expect("QUIT", 221)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 {
+		t.Fatalf("delivered %d messages, want 1", len(got))
+	}
+	msg := got[0]
+	if msg.Sender != "elf@example.com" || msg.Channel != "smtp" || strings.TrimSpace(msg.Text) != "A sled please" {
+		t.Errorf("got sender %q channel %q text %q", msg.Sender, msg.Channel, msg.Text)
+	}
+	if to := msg.Headers.Get("To"); to != "santa@example.com, rudolph@example.com" {
+		t.Errorf("To = %q", to)
+	}
+}
+
+func TestHTTPInboundSender(t *testing.T) {
+	var got *InboundMessage
+	g := &InboundGateway{
+		Policies: []InboundPolicy{AllowedSenders("elf@example.com")},
+		Default: InboundHandlerFunc(func(ctx context.Context, msg *InboundMessage) error {
+			got = msg
+			return nil
+		}),
+	}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "Elf"}, EmailAddresses: []string{"elf@example.com"}}
+
+	tests := []struct {
+		name     string
+		sender   func(r *http.Request) (string, error)
+		tls      *tls.ConnectionState
+		wantCode int
+	}{
+		{"no client certificate", nil, nil, http.StatusUnauthorized},
+		{"unverified client certificate", nil, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, http.StatusUnauthorized},
+		{"verified client certificate", nil, &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, http.StatusAccepted},
+		{"custom sender", func(r *http.Request) (string, error) { return "grinch@example.com", nil }, nil, http.StatusUnprocessableEntity},
+		{"custom sender fails", func(r *http.Request) (string, error) { return "", errors.New("bad token") }, nil, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		got = nil
+		h := &HTTPInbound{Gateway: g, Sender: tt.sender}
+		r := httptest.NewRequest("POST", "/inbound", strings.NewReader("A sled please"))
+		r.Header.Set("Content-Type", "text/plain")
+		// must not be taken as the sender
+		r.Header.Set("X-Sender", "elf@example.com")
+		r.TLS = tt.tls
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body)
+		}
+		if tt.wantCode == http.StatusAccepted && (got == nil || got.Sender != "elf@example.com") {
+			t.Errorf("%s: delivered %+v", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/quotedprintable"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// DefaultEmailStylesheet is used by the HTMLMessageBuilder when none is set
+const DefaultEmailStylesheet = `
+body { margin: 0; padding: 0; font-family: Arial, Helvetica, sans-serif; }
+.message { max-width: 600px; padding: 16px; color: #222222; }
+p { font-size: 14px; line-height: 20px; }
+.recipient { font-weight: bold; }
+a.button { display: inline-block; padding: 8px 16px; margin-right: 8px; color: #ffffff; background-color: #1a73e8; text-decoration: none; border-radius: 4px; }
+`
+
+var htmlMessageTemplate = template.Must(template.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<style>{{.Stylesheet}}</style>
+</head>
+<body>
+<div class="message">
+<p class="recipient">{{.Recipient}}</p>
+{{range .Paragraphs}}<p>{{.}}</p>
+{{end}}{{if .Actions}}<p class="actions">{{range .Actions}}<a class="button" href="{{.URL}}">{{.Label}}</a>{{end}}</p>
+{{end}}</div>
+</body>
+</html>
+`))
+
+// HTML Message Builder is concrete builder. Styles are inlined, since email
+// clients strip <style> blocks.
+type HTMLMessageBuilder struct {
+	messageID        string
+	messageRecipient string
+	messageText      string
+	messageActions   []RenderedAction
+	// CSS for the message, DefaultEmailStylesheet when empty
+	Stylesheet string
+	// Page layout, a default layout when nil. It is executed with Stylesheet,
+	// Recipient, Paragraphs and Actions.
+	Layout *template.Template
+	// Fail instead of warn when the HTML is larger than EmailClipLimit
+	StrictSize bool
+	// Adds an open tracking pixel when set
+	Tracker *OpenTracker
+
+	warnings []string
+}
+
+func (b *HTMLMessageBuilder) SetRecipient(recipient string) {
+	b.messageRecipient = recipient
+}
+
+func (b *HTMLMessageBuilder) SetText(text string) {
+	b.messageText = text
+}
+
+func (b *HTMLMessageBuilder) SetActions(actions []RenderedAction) {
+	b.messageActions = actions
+}
+
+// Reset clears the message, the stylesheet, layout and tracker stay
+func (b *HTMLMessageBuilder) Reset() {
+	b.messageID = ""
+	b.messageRecipient = ""
+	b.messageText = ""
+	b.messageActions = nil
+	b.warnings = nil
+}
+
+// SetMessageID fixes the ID of the next message, a new one is generated when
+// it is needed and not set
+func (b *HTMLMessageBuilder) SetMessageID(id string) {
+	b.messageID = id
+}
+
+// Warnings returns the email client warnings of the last built message
+func (b *HTMLMessageBuilder) Warnings() []string {
+	return b.warnings
+}
+
+func (b *HTMLMessageBuilder) Message() (*Message, error) {
+	doc, id, err := b.render()
+	if err != nil {
+		return nil, err
+	}
+	return &Message{ID: id, Recipient: b.messageRecipient, Body: []byte(doc), Format: "HTML"}, nil
+}
+
+// render returns the document and the message ID it was rendered for
+func (b *HTMLMessageBuilder) render() (string, string, error) {
+	id := b.messageID
+	if id == "" && b.Tracker != nil {
+		id = NewMessageID()
+	}
+
+	stylesheet := b.Stylesheet
+	if stylesheet == "" {
+		stylesheet = DefaultEmailStylesheet
+	}
+
+	var paragraphs []string
+	for _, p := range strings.Split(b.messageText, "\n\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			paragraphs = append(paragraphs, p)
+		}
+	}
+
+	layout := b.Layout
+	if layout == nil {
+		layout = htmlMessageTemplate
+	}
+
+	var buf bytes.Buffer
+	err := layout.Execute(&buf, map[string]interface{}{
+		"Stylesheet": template.CSS(stylesheet),
+		"Recipient":  b.messageRecipient,
+		"Paragraphs": paragraphs,
+		"Actions":    b.messageActions,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	doc, warnings := InlineCSS(buf.String())
+	if b.Tracker != nil {
+		if doc, err = b.Tracker.InsertPixel(doc, id); err != nil {
+			return "", "", err
+		}
+	}
+	b.warnings = warnings
+	if b.StrictSize && len(doc) > EmailClipLimit {
+		return "", "", fmt.Errorf("HTML is %d bytes, above the %d bytes clipping limit", len(doc), EmailClipLimit)
+	}
+	return doc, id, nil
+}
+
+// Email Message Builder is concrete builder. It builds a MIME entity with a
+// plain text and an HTML alternative. The body carries its own MIME headers;
+// transports add From, To and Date.
+//
+// Attached images referenced from the HTML by name (<img src="logo.png">) are
+// embedded as multipart/related parts and referenced by cid: URLs. Images
+// larger than InlineLimit are linked instead, through the Linker.
+type EmailMessageBuilder struct {
+	HTML    HTMLMessageBuilder
+	Subject string
+	// Maximum size of an embedded image, DefaultInlineImageLimit when zero
+	InlineLimit int
+	// Publishes an image too large to embed and returns its URL. Large images
+	// are embedded anyway when nil.
+	Linker func(img EmbeddedImage) (string, error)
+
+	images map[string]EmbeddedImage
+}
+
+func (b *EmailMessageBuilder) SetRecipient(recipient string) {
+	b.HTML.SetRecipient(recipient)
+}
+
+func (b *EmailMessageBuilder) SetText(text string) {
+	b.HTML.SetText(text)
+}
+
+// Reset clears the message, subject and attached images
+func (b *EmailMessageBuilder) Reset() {
+	b.HTML.Reset()
+	b.Subject = ""
+	b.images = nil
+}
+
+func (b *EmailMessageBuilder) SetSubject(subject string) {
+	b.Subject = subject
+}
+
+func (b *EmailMessageBuilder) SetActions(actions []RenderedAction) {
+	b.HTML.SetActions(actions)
+}
+
+func (b *EmailMessageBuilder) SetMessageID(id string) {
+	b.HTML.SetMessageID(id)
+}
+
+// Warnings returns the email client warnings of the last built message
+func (b *EmailMessageBuilder) Warnings() []string {
+	return b.HTML.Warnings()
+}
+
+func (b *EmailMessageBuilder) Message() (*Message, error) {
+	doc, id, err := b.HTML.render()
+	if err != nil {
+		return nil, err
+	}
+	doc, inline, err := b.embedImages(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	text := b.HTML.messageText
+	for _, a := range b.HTML.messageActions {
+		text += "\r\n\r\n" + a.Label + ": " + a.URL
+	}
+
+	boundary := newBoundary()
+	var buf bytes.Buffer
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	if b.Subject != "" {
+		fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", b.Subject))
+	}
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+	writeQPPart(&buf, boundary, "text/plain; charset=utf-8", text)
+	if len(inline) == 0 {
+		writeQPPart(&buf, boundary, "text/html; charset=utf-8", doc)
+	} else {
+		related := newBoundary()
+		fmt.Fprintf(&buf, "--%s\r\n", boundary)
+		fmt.Fprintf(&buf, "Content-Type: multipart/related; type=\"text/html\"; boundary=%q\r\n\r\n", related)
+		writeQPPart(&buf, related, "text/html; charset=utf-8", doc)
+		for _, img := range inline {
+			writeImagePart(&buf, related, img)
+		}
+		fmt.Fprintf(&buf, "--%s--\r\n", related)
+	}
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+
+	return &Message{ID: id, Recipient: b.HTML.messageRecipient, Body: buf.Bytes(), Format: "EMAIL"}, nil
+}
+
+func writeQPPart(buf *bytes.Buffer, boundary, contentType, content string) {
+	fmt.Fprintf(buf, "--%s\r\n", boundary)
+	fmt.Fprintf(buf, "Content-Type: %s\r\n", contentType)
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(buf)
+	qp.Write([]byte(content))
+	qp.Close()
+	buf.WriteString("\r\n")
+}
+
+func newBoundary() string {
+	b := make([]byte, 15)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return "b_" + hex.EncodeToString(b)
+}
+
+// DefaultInlineImageLimit is the largest image embedded by default
+const DefaultInlineImageLimit = 100 * 1024
+
+var ErrImageContentType = errors.New("invalid image content type")
+
+// imageContentType checks the content type of an attached image and returns
+// it in canonical form, so it cannot smuggle headers into the part
+func imageContentType(ct string) (string, error) {
+	if strings.ContainsAny(ct, "\r\n") {
+		return "", fmt.Errorf("%w: %q", ErrImageContentType, ct)
+	}
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		return "", fmt.Errorf("%w: %q", ErrImageContentType, ct)
+	}
+	return mime.FormatMediaType(mediaType, params), nil
+}
+
+// EmbeddedImage is an image attached to an email
+type EmbeddedImage struct {
+	Name        string
+	ContentType string
+	Data        []byte
+	// Set once the image is embedded
+	ContentID string
+}
+
+// AttachImage makes an image available to the HTML under the given name.
+// Message fails with ErrImageContentType when a referenced image does not
+// have a valid image/* content type.
+func (b *EmailMessageBuilder) AttachImage(name, contentType string, data []byte) {
+	if b.images == nil {
+		b.images = make(map[string]EmbeddedImage)
+	}
+	b.images[name] = EmbeddedImage{Name: name, ContentType: contentType, Data: data}
+}
+
+// embedImages rewrites local <img> references to cid: or linked URLs and
+// returns the images to embed
+func (b *EmailMessageBuilder) embedImages(doc string) (string, []EmbeddedImage, error) {
+	if len(b.images) == 0 {
+		return doc, nil, nil
+	}
+	limit := b.InlineLimit
+	if limit <= 0 {
+		limit = DefaultInlineImageLimit
+	}
+
+	embedded := make(map[string]EmbeddedImage)
+	linked := make(map[string]string)
+	var err error
+	doc = startTagRe.ReplaceAllStringFunc(doc, func(tag string) string {
+		m := startTagRe.FindStringSubmatch(tag)
+		if err != nil || !strings.EqualFold(m[1], "img") {
+			return tag
+		}
+		attrs := parseAttrs(m[2])
+		src := attrs.get("src")
+		if u, perr := url.Parse(src); perr != nil || u.Scheme != "" || u.Host != "" {
+			return tag
+		}
+		img, ok := b.images[strings.TrimPrefix(src, "./")]
+		if !ok {
+			return tag
+		}
+		if img.ContentType, err = imageContentType(img.ContentType); err != nil {
+			return tag
+		}
+
+		if len(img.Data) > limit && b.Linker != nil {
+			link, ok := linked[img.Name]
+			if !ok {
+				if link, err = b.Linker(img); err != nil {
+					return tag
+				}
+				linked[img.Name] = link
+			}
+			attrs.set("src", link)
+		} else {
+			if e, ok := embedded[img.Name]; ok {
+				img = e
+			} else {
+				img.ContentID = newBoundary()[2:] + "@message"
+				embedded[img.Name] = img
+			}
+			attrs.set("src", "cid:"+img.ContentID)
+		}
+		return "<" + m[1] + attrs.String() + closeTag(m[3]) + ">"
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	inline := make([]EmbeddedImage, 0, len(embedded))
+	for _, img := range embedded {
+		inline = append(inline, img)
+	}
+	sort.Slice(inline, func(i, j int) bool { return inline[i].Name < inline[j].Name })
+	return doc, inline, nil
+}
+
+func writeImagePart(buf *bytes.Buffer, boundary string, img EmbeddedImage) {
+	fmt.Fprintf(buf, "--%s\r\n", boundary)
+	fmt.Fprintf(buf, "Content-Type: %s\r\n", img.ContentType)
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+	fmt.Fprintf(buf, "Content-ID: <%s>\r\n", img.ContentID)
+	fmt.Fprintf(buf, "Content-Disposition: %s\r\n\r\n", mime.FormatMediaType("inline", map[string]string{"filename": img.Name}))
+
+	encoded := base64.StdEncoding.EncodeToString(img.Data)
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+}
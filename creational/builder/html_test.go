@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"strings"
+	"testing"
+)
+
+func TestEmailImageContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		wantErr     bool
+		want        string
+	}{
+		{"image/png", false, "Content-Type: image/png\r\n"},
+		{"IMAGE/PNG; name=logo.png", false, "Content-Type: image/png; name=logo.png\r\n"},
+		{"image/png\r\nBcc: victim@example.com", true, ""},
+		{"image/png\nX-Evil: 1", true, ""},
+		{"text/html", true, ""},
+		{"image/", true, ""},
+		{"", true, ""},
+	}
+	for _, tt := range tests {
+		b := &EmailMessageBuilder{}
+		b.SetRecipient("santa@example.com")
+		b.SetText("hello")
+		b.HTML.Layout = template.Must(template.New("").Parse(`<p>{{.Recipient}}</p><img src="logo.png">`))
+		b.AttachImage("logo.png", tt.contentType, []byte("png"))
+		msg, err := b.Message()
+		if tt.wantErr {
+			if !errors.Is(err, ErrImageContentType) {
+				t.Errorf("%q: err = %v, want %v", tt.contentType, err, ErrImageContentType)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.contentType, err)
+			continue
+		}
+		if !strings.Contains(string(msg.Body), tt.want) {
+			t.Errorf("%q: body does not contain %q:\n%s", tt.contentType, tt.want, msg.Body)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The keyring holds every key used for signing and encrypting messages. Keys
+// move through a simple lifecycle: a new key becomes active, the previously
+// active key of the same use is demoted to verify-only so that anything it
+// produced can still be checked, and eventually it gets retired.
+
+// KeyUse tells what a key is meant for
+type KeyUse string
+
+const (
+	KeyUseSign    KeyUse = "sig"
+	KeyUseEncrypt KeyUse = "enc"
+)
+
+// KeyState is the lifecycle state of a key
+type KeyState string
+
+const (
+	// Used for new signatures / encryptions
+	KeyActive KeyState = "active"
+	// Only used to verify / decrypt existing data
+	KeyVerifyOnly KeyState = "verify-only"
+	// Only used to decrypt data nobody re-encrypted yet, never published
+	KeyRetired KeyState = "retired"
+)
+
+var (
+	ErrKeyNotFound    = errors.New("key not found")
+	ErrNoActiveKey    = errors.New("no active key")
+	ErrBadMasterKey   = errors.New("master key must be 32 bytes")
+	ErrKeyringCorrupt = errors.New("keyring file cannot be decrypted")
+)
+
+// Key is a single entry of the keyring. Signing keys are Ed25519 keys and
+// encryption keys are X25519 keys.
+type Key struct {
+	ID        string    `json:"id"`
+	Use       KeyUse    `json:"use"`
+	State     KeyState  `json:"state"`
+	CreatedAt time.Time `json:"created_at"`
+	// When the key was demoted to verify-only
+	RotatedAt time.Time `json:"rotated_at,omitempty"`
+	// Raw private key material
+	Private []byte `json:"private"`
+}
+
+// SigningKey returns the Ed25519 private key of a signing key
+func (k *Key) SigningKey() (ed25519.PrivateKey, error) {
+	if k.Use != KeyUseSign || len(k.Private) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("key %s is not a signing key", k.ID)
+	}
+	return ed25519.PrivateKey(k.Private), nil
+}
+
+// EncryptionKey returns the X25519 private key of an encryption key
+func (k *Key) EncryptionKey() (*ecdh.PrivateKey, error) {
+	if k.Use != KeyUseEncrypt {
+		return nil, fmt.Errorf("key %s is not an encryption key", k.ID)
+	}
+	return ecdh.X25519().NewPrivateKey(k.Private)
+}
+
+func (k *Key) publicKey() ([]byte, error) {
+	switch k.Use {
+	case KeyUseSign:
+		priv, err := k.SigningKey()
+		if err != nil {
+			return nil, err
+		}
+		return priv.Public().(ed25519.PublicKey), nil
+	case KeyUseEncrypt:
+		priv, err := k.EncryptionKey()
+		if err != nil {
+			return nil, err
+		}
+		return priv.PublicKey().Bytes(), nil
+	}
+	return nil, fmt.Errorf("key %s has unknown use %q", k.ID, k.Use)
+}
+
+// Keyring holds signing and encryption keys
+type Keyring struct {
+	mu   sync.RWMutex
+	keys map[string]*Key
+	// Source of randomness, crypto/rand when nil
+	Rand io.Reader
+	// Clock, time.Now when nil
+	Now func() time.Time
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]*Key)}
+}
+
+func (r *Keyring) rand() io.Reader {
+	if r.Rand != nil {
+		return r.Rand
+	}
+	return rand.Reader
+}
+
+func (r *Keyring) now() time.Time {
+	if r.Now != nil {
+		return r.Now()
+	}
+	return time.Now()
+}
+
+// Generate creates a new active key for the given use. The previously active
+// key of that use becomes verify-only.
+func (r *Keyring) Generate(use KeyUse) (*Key, error) {
+	var private []byte
+	switch use {
+	case KeyUseSign:
+		_, priv, err := ed25519.GenerateKey(r.rand())
+		if err != nil {
+			return nil, err
+		}
+		private = priv
+	case KeyUseEncrypt:
+		priv, err := ecdh.X25519().GenerateKey(r.rand())
+		if err != nil {
+			return nil, err
+		}
+		private = priv.Bytes()
+	default:
+		return nil, fmt.Errorf("unknown key use %q", use)
+	}
+
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(r.rand(), id); err != nil {
+		return nil, err
+	}
+
+	key := &Key{
+		ID:        hex.EncodeToString(id),
+		Use:       use,
+		State:     KeyActive,
+		CreatedAt: r.now(),
+		Private:   private,
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range r.keys {
+		if k.Use == use && k.State == KeyActive {
+			k.State = KeyVerifyOnly
+			k.RotatedAt = key.CreatedAt
+		}
+	}
+	r.keys[key.ID] = key
+	copied := *key
+	return &copied, nil
+}
+
+// Active returns a copy of the active key for the given use
+func (r *Keyring) Active(use KeyUse) (*Key, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, k := range r.keys {
+		if k.Use == use && k.State == KeyActive {
+			copied := *k
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w for %s", ErrNoActiveKey, use)
+}
+
+// Get returns a copy of the key with the given ID, unless it has been retired
+func (r *Keyring) Get(id string) (*Key, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	k, ok := r.keys[id]
+	if !ok || k.State == KeyRetired {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	copied := *k
+	return &copied, nil
+}
+
+// Lookup returns a copy of the key with the given ID, retired keys included.
+// It is meant for reading existing data only.
+func (r *Keyring) Lookup(id string) (*Key, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	k, ok := r.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	copied := *k
+	return &copied, nil
+}
+
+// Retire marks a key as retired
+func (r *Keyring) Retire(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k, ok := r.keys[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	k.State = KeyRetired
+	return nil
+}
+
+// Keys returns copies of all keys ordered by creation time
+func (r *Keyring) Keys() []*Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.sortedKeys()
+}
+
+// sortedKeys copies the keys, r.mu must be held
+func (r *Keyring) sortedKeys() []*Key {
+	keys := make([]*Key, 0, len(r.keys))
+	for _, k := range r.keys {
+		copied := *k
+		keys = append(keys, &copied)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys
+}
+
+// Rotate generates fresh keys for every use and retires verify-only keys that
+// were demoted more than retireAfter ago. A zero retireAfter keeps them
+// forever.
+func (r *Keyring) Rotate(retireAfter time.Duration) error {
+	for _, use := range []KeyUse{KeyUseSign, KeyUseEncrypt} {
+		if _, err := r.Generate(use); err != nil {
+			return err
+		}
+	}
+	if retireAfter <= 0 {
+		return nil
+	}
+
+	cutoff := r.now().Add(-retireAfter)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range r.keys {
+		if k.State != KeyVerifyOnly {
+			continue
+		}
+		// keyrings saved before RotatedAt existed only know the creation time
+		rotatedAt := k.RotatedAt
+		if rotatedAt.IsZero() {
+			rotatedAt = k.CreatedAt
+		}
+		if rotatedAt.Before(cutoff) {
+			k.State = KeyRetired
+		}
+	}
+	return nil
+}
+
+// ScheduleRotation rotates the keys every interval until the context is done.
+// Errors are handed to onError, which may be nil.
+func (r *Keyring) ScheduleRotation(ctx context.Context, interval, retireAfter time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Rotate(retireAfter); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// Save writes the keyring to a file encrypted with the 32 byte master key
+func (r *Keyring) Save(path string, masterKey []byte) error {
+	aead, err := newMasterAEAD(masterKey)
+	if err != nil {
+		return err
+	}
+
+	plain, err := json.Marshal(r.Keys())
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(r.rand(), nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, []byte("keyring"))
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, sealed, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadKeyring reads a keyring written by Save
+func LoadKeyring(path string, masterKey []byte) (*Keyring, error) {
+	aead, err := newMasterAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrKeyringCorrupt
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte("keyring"))
+	if err != nil {
+		return nil, ErrKeyringCorrupt
+	}
+
+	var keys []*Key
+	if err := json.Unmarshal(plain, &keys); err != nil {
+		return nil, err
+	}
+
+	r := NewKeyring()
+	for _, k := range keys {
+		r.keys[k.ID] = k
+	}
+	return r, nil
+}
+
+func newMasterAEAD(masterKey []byte) (cipher.AEAD, error) {
+	if len(masterKey) != 32 {
+		return nil, ErrBadMasterKey
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// JWK is the public part of a key as published in a JWKS document
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg,omitempty"`
+	X         string `json:"x"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys that others may still need: active and
+// verify-only keys. Retired keys are never published.
+func (r *Keyring) JWKS() (*JWKS, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	set := &JWKS{Keys: []JWK{}}
+	for _, k := range r.sortedKeys() {
+		if k.State == KeyRetired {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, err
+		}
+
+		jwk := JWK{
+			KeyType: "OKP",
+			KeyID:   k.ID,
+			Use:     string(k.Use),
+			X:       base64.RawURLEncoding.EncodeToString(pub),
+		}
+		if k.Use == KeyUseSign {
+			jwk.Curve = "Ed25519"
+			jwk.Algorithm = "EdDSA"
+		} else {
+			jwk.Curve = "X25519"
+			jwk.Algorithm = "ECDH-ES"
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
+
+// JWKSHandler publishes the keyring's public keys, typically mounted at
+// /.well-known/jwks.json
+func (r *Keyring) JWKSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		set, err := r.JWKS()
+		if err != nil {
+			http.Error(w, "cannot export keys", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(set)
+	})
+}
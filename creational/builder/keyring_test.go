@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestKeyringGenerateDemotesActive(t *testing.T) {
+	r := NewKeyring()
+	first, err := r.Generate(KeyUseSign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := r.Generate(KeyUseSign)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active, err := r.Active(KeyUseSign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active.ID != second.ID {
+		t.Errorf("active key = %s, want %s", active.ID, second.ID)
+	}
+	old, err := r.Get(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.State != KeyVerifyOnly {
+		t.Errorf("old key state = %s, want %s", old.State, KeyVerifyOnly)
+	}
+}
+
+func TestKeyringRotateRetiresByDemotionTime(t *testing.T) {
+	clock := newFakeClock()
+	r := NewKeyring()
+	r.Now = clock.Now
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		// states of the sign keys, oldest first
+		want []KeyState
+	}{
+		{"first rotation", 0, []KeyState{KeyActive}},
+		// interval longer than retireAfter, the demoted key must survive
+		{"second rotation", 48 * time.Hour, []KeyState{KeyVerifyOnly, KeyActive}},
+		{"third rotation", 48 * time.Hour, []KeyState{KeyRetired, KeyVerifyOnly, KeyActive}},
+	}
+	for _, tt := range tests {
+		clock.Advance(tt.advance)
+		if err := r.Rotate(24 * time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		var got []KeyState
+		for _, k := range r.Keys() {
+			if k.Use == KeyUseSign {
+				got = append(got, k.State)
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: states = %v, want %v", tt.name, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: states = %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestKeyringSaveLoad(t *testing.T) {
+	master := make([]byte, 32)
+	path := filepath.Join(t.TempDir(), "keyring")
+
+	r := NewKeyring()
+	if err := r.Rotate(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Save(path, master); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadKeyring(path, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(loaded.Keys()), len(r.Keys()); got != want {
+		t.Errorf("loaded %d keys, want %d", got, want)
+	}
+
+	wrong := make([]byte, 32)
+	wrong[0] = 1
+	if _, err := LoadKeyring(path, wrong); err != ErrKeyringCorrupt {
+		t.Errorf("wrong master key: err = %v, want %v", err, ErrKeyringCorrupt)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeyring(path, master); err != ErrKeyringCorrupt {
+		t.Errorf("tampered file: err = %v, want %v", err, ErrKeyringCorrupt)
+	}
+}
+
+func TestKeyringJWKSSkipsRetired(t *testing.T) {
+	r := NewKeyring()
+	old, err := r.Generate(KeyUseSign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Generate(KeyUseSign); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Retire(old.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := r.JWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 1 {
+		t.Fatalf("published %d keys, want 1", len(set.Keys))
+	}
+	if set.Keys[0].KeyID == old.ID {
+		t.Error("retired key published")
+	}
+}
+
+func TestKeyringConcurrentRotation(t *testing.T) {
+	r := NewKeyring()
+	master := make([]byte, 32)
+	path := filepath.Join(t.TempDir(), "keyring")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.ScheduleRotation(ctx, time.Millisecond, time.Millisecond, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := r.JWKS(); err != nil {
+					t.Error(err)
+				}
+				r.Active(KeyUseSign)
+				if err := r.Save(path+string(rune('a'+i)), master); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MessageState is where a message is in its lifecycle
+type MessageState string
+
+const (
+	StateBuilt     MessageState = "built"
+	StateSent      MessageState = "sent"
+	StateDelivered MessageState = "delivered"
+	StateFailed    MessageState = "failed"
+	StateOpened    MessageState = "opened"
+	// Replaced by a newer message before it was sent
+	StateSuperseded MessageState = "superseded"
+)
+
+// allowed transitions, anything else is ignored as out of order
+var lifecycleTransitions = map[MessageState][]MessageState{
+	StateBuilt:      {StateSent, StateDelivered, StateFailed, StateSuperseded},
+	StateSent:       {StateDelivered, StateFailed, StateOpened},
+	StateDelivered:  {StateOpened},
+	StateFailed:     {},
+	StateOpened:     {},
+	StateSuperseded: {},
+}
+
+var (
+	ErrUnknownMessage    = errors.New("unknown message")
+	ErrInvalidTransition = errors.New("invalid lifecycle transition")
+)
+
+// LifecycleEvent is one recorded state change
+type LifecycleEvent struct {
+	State  MessageState `json:"state"`
+	At     time.Time    `json:"at"`
+	Reason string       `json:"reason,omitempty"`
+}
+
+// LifecycleRecord tracks a single message from build to delivery
+type LifecycleRecord struct {
+	MessageID string           `json:"message_id"`
+	Format    string           `json:"format"`
+	Channel   string           `json:"channel,omitempty"`
+	Tenant    string           `json:"tenant,omitempty"`
+	Recipient string           `json:"recipient,omitempty"`
+	State     MessageState     `json:"state"`
+	BuiltAt   time.Time        `json:"built_at"`
+	History   []LifecycleEvent `json:"history"`
+}
+
+// At returns when the message entered the given state
+func (r *LifecycleRecord) At(state MessageState) (time.Time, bool) {
+	for _, e := range r.History {
+		if e.State == state {
+			return e.At, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// LifecycleStore keeps the lifecycle of every tracked message in memory
+type LifecycleStore struct {
+	mu      sync.RWMutex
+	records map[string]*LifecycleRecord
+}
+
+func NewLifecycleStore() *LifecycleStore {
+	return &LifecycleStore{records: make(map[string]*LifecycleRecord)}
+}
+
+// Track starts tracking a freshly built message
+func (s *LifecycleStore) Track(rec LifecycleRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.track(rec)
+}
+
+// TrackIfNew tracks the message unless it is tracked already, so callers that
+// know more about it (channel, tenant) can Track it first. It reports whether
+// a new record was created.
+func (s *LifecycleStore) TrackIfNew(rec LifecycleRecord) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[rec.MessageID]; ok {
+		return false
+	}
+	s.track(rec)
+	return true
+}
+
+// track adds the record, s.mu must be held
+func (s *LifecycleStore) track(rec LifecycleRecord) {
+	if rec.State == "" {
+		rec.State = StateBuilt
+	}
+	if rec.BuiltAt.IsZero() {
+		rec.BuiltAt = time.Now()
+	}
+	rec.History = append([]LifecycleEvent{{State: rec.State, At: rec.BuiltAt}}, rec.History...)
+	s.records[rec.MessageID] = &rec
+}
+
+// Transition moves a message to a new state
+func (s *LifecycleStore) Transition(messageID string, state MessageState, at time.Time, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.records[messageID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownMessage, messageID)
+	}
+	if rec.State == state {
+		return nil
+	}
+
+	allowed := false
+	for _, next := range lifecycleTransitions[rec.State] {
+		if next == state {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("%w: %s from %s to %s", ErrInvalidTransition, messageID, rec.State, state)
+	}
+
+	rec.State = state
+	rec.History = append(rec.History, LifecycleEvent{State: state, At: at, Reason: reason})
+	return nil
+}
+
+// Get returns a copy of the message's record
+func (s *LifecycleStore) Get(messageID string) (LifecycleRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rec, ok := s.records[messageID]
+	if !ok {
+		return LifecycleRecord{}, fmt.Errorf("%w: %s", ErrUnknownMessage, messageID)
+	}
+	return copyRecord(rec), nil
+}
+
+// Records returns copies of all records ordered by build time
+func (s *LifecycleStore) Records() []LifecycleRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]LifecycleRecord, 0, len(s.records))
+	for _, rec := range s.records {
+		out = append(out, copyRecord(rec))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].BuiltAt.Before(out[j].BuiltAt)
+	})
+	return out
+}
+
+// Save writes all records to a JSON file, the history read by "builder report"
+func (s *LifecycleStore) Save(path string) error {
+	data, err := json.Marshal(s.Records())
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadLifecycleStore reads a file written by Save
+func LoadLifecycleStore(path string) (*LifecycleStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var records []LifecycleRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	s := NewLifecycleStore()
+	for i := range records {
+		rec := records[i]
+		s.records[rec.MessageID] = &rec
+	}
+	return s, nil
+}
+
+// StartSaving saves the records every interval and once more when the context
+// is done. Errors are handed to onError, which may be nil.
+func (s *LifecycleStore) StartSaving(ctx context.Context, path string, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.Save(path); err != nil && onError != nil {
+				onError(err)
+			}
+			return
+		case <-ticker.C:
+			if err := s.Save(path); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+func copyRecord(rec *LifecycleRecord) LifecycleRecord {
+	c := *rec
+	c.History = append([]LifecycleEvent(nil), rec.History...)
+	return c
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLifecycleTransitions(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []MessageState
+		want  MessageState
+		// error of the last step
+		err error
+	}{
+		{"delivered", []MessageState{StateSent, StateDelivered}, StateDelivered, nil},
+		{"opened", []MessageState{StateSent, StateDelivered, StateOpened}, StateOpened, nil},
+		{"repeated state", []MessageState{StateSent, StateSent}, StateSent, nil},
+		{"out of order", []MessageState{StateDelivered, StateSent}, StateDelivered, ErrInvalidTransition},
+		{"failed is final", []MessageState{StateFailed, StateDelivered}, StateFailed, ErrInvalidTransition},
+	}
+	for _, tt := range tests {
+		s := NewLifecycleStore()
+		s.Track(LifecycleRecord{MessageID: "m"})
+		var err error
+		for _, state := range tt.steps {
+			err = s.Transition("m", state, time.Now(), "")
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+		rec, _ := s.Get("m")
+		if rec.State != tt.want {
+			t.Errorf("%s: state = %s, want %s", tt.name, rec.State, tt.want)
+		}
+	}
+}
+
+func TestLifecycleUnknownMessage(t *testing.T) {
+	s := NewLifecycleStore()
+	if err := s.Transition("nope", StateSent, time.Now(), ""); !errors.Is(err, ErrUnknownMessage) {
+		t.Errorf("err = %v, want %v", err, ErrUnknownMessage)
+	}
+}
+
+func TestLifecycleTrackIfNew(t *testing.T) {
+	s := NewLifecycleStore()
+	s.Track(LifecycleRecord{MessageID: "m", Tenant: "acme"})
+	if s.TrackIfNew(LifecycleRecord{MessageID: "m"}) {
+		t.Error("existing record replaced")
+	}
+	rec, _ := s.Get("m")
+	if rec.Tenant != "acme" {
+		t.Errorf("tenant = %q, want acme", rec.Tenant)
+	}
+	if !s.TrackIfNew(LifecycleRecord{MessageID: "n"}) {
+		t.Error("new record not tracked")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"os"
 )
 
 // Components:
@@ -23,10 +24,21 @@ import (
 
 //This is the product
 type Message struct {
+	// Unique message identifier, assigned once the message leaves the builder
+	ID string
+	// Message Recipient
+	Recipient string
 	// Message Body
 	Body []byte
 	// Message Format
 	Format string
+	// ID of the schema the body conforms to, if any
+	SchemaID string
+	// Extra headers for transports that carry them, e.g. mail
+	Headers map[string]string
+	// Queued messages with the same collapse key and recipient supersede
+	// each other, e.g. "shipped" replaces a still pending "packed"
+	CollapseKey string
 }
 
 // MessageBuilder is the inteface that every concrete implementation should obey
@@ -43,6 +55,7 @@ type MessageBuilder interface {
 type JSONMessageBuilder struct {
 	messageRecipient string
 	messageText      string
+	messageActions   []RenderedAction
 }
 
 func (b *JSONMessageBuilder) SetRecipient(recipient string) {
@@ -53,23 +66,35 @@ func (b *JSONMessageBuilder) SetText(text string) {
 	b.messageText = text
 }
 
+func (b *JSONMessageBuilder) SetActions(actions []RenderedAction) {
+	b.messageActions = actions
+}
+
+func (b *JSONMessageBuilder) Reset() {
+	*b = JSONMessageBuilder{}
+}
+
 func (b *JSONMessageBuilder) Message() (*Message, error) {
-	m := make(map[string]string)
+	m := make(map[string]interface{})
 	m["recipient"] = b.messageRecipient
 	m["message"] = b.messageText
+	if len(b.messageActions) > 0 {
+		m["actions"] = b.messageActions
+	}
 
 	data, err := json.Marshal(m)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Message{Body: data, Format: "JSON"}, nil
+	return &Message{Recipient: b.messageRecipient, Body: data, Format: "JSON"}, nil
 }
 
 // XML Message Builder is concrete builder
 type XMLMessageBuilder struct {
 	messageRecipient string
 	messageText      string
+	messageActions   []RenderedAction
 }
 
 func (b *XMLMessageBuilder) SetRecipient(recipient string) {
@@ -80,23 +105,45 @@ func (b *XMLMessageBuilder) SetText(text string) {
 	b.messageText = text
 }
 
+func (b *XMLMessageBuilder) Reset() {
+	*b = XMLMessageBuilder{}
+}
+
+func (b *XMLMessageBuilder) SetActions(actions []RenderedAction) {
+	b.messageActions = actions
+}
+
 func (b *XMLMessageBuilder) Message() (*Message, error) {
+	type XMLAction struct {
+		URL   string `xml:"url,attr"`
+		Label string `xml:",chardata"`
+	}
+	type XMLActions struct {
+		Action []XMLAction `xml:"action"`
+	}
 	type XMLMessage struct {
-		Recipient string `xml:"recipient"`
-		Text      string `xml:"body"`
+		Recipient string      `xml:"recipient"`
+		Text      string      `xml:"body"`
+		Actions   *XMLActions `xml:"actions,omitempty"`
 	}
 
 	m := XMLMessage{
 		Recipient: b.messageRecipient,
 		Text:      b.messageText,
 	}
+	if len(b.messageActions) > 0 {
+		m.Actions = &XMLActions{}
+		for _, a := range b.messageActions {
+			m.Actions.Action = append(m.Actions.Action, XMLAction{URL: a.URL, Label: a.Label})
+		}
+	}
 
 	data, err := xml.Marshal(m)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Message{Body: data, Format: "XML"}, nil
+	return &Message{Recipient: b.messageRecipient, Body: data, Format: "XML"}, nil
 }
 
 // Sender is the Director in Builder Design Pattern
@@ -104,12 +151,25 @@ type Sender struct{}
 
 // Build a concrete message via MessageBuilder
 func (s *Sender) BuildMessage(builder MessageBuilder) (*Message, error) {
-	builder.SetRecipient("Santa Claus")
-	builder.SetText("I have tried to be good all year and hope that you and your reindeers will be able to deliver me a nice present.")
+	return s.Build(builder, "Santa Claus", "I have tried to be good all year and hope that you and your reindeers will be able to deliver me a nice present.")
+}
+
+// Build a concrete message for the given recipient and text via MessageBuilder
+func (s *Sender) Build(builder MessageBuilder, recipient, text string) (*Message, error) {
+	builder.SetRecipient(recipient)
+	builder.SetText(text)
 	return builder.Message()
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	sender := &Sender{}
 
 	jsonMsg, err := sender.BuildMessage(&JSONMessageBuilder{})
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Parsers are the reverse of the builders: they turn a received body back into
+// recipient and text. Inbound payloads are untrusted, so every parser walks the
+// input token by token first and rejects anything too big or too deeply nested
+// before it is decoded.
+
+// ParseOptions limit what a parser accepts. Zero values use the defaults.
+type ParseOptions struct {
+	// Maximum body size in bytes
+	MaxBodySize int
+	// Maximum nesting depth of objects/arrays or elements
+	MaxDepth int
+	// Maximum number of object fields, array items or elements in total
+	MaxFields int
+	// Maximum length of a single string, element text or attribute value
+	MaxStringLength int
+}
+
+// DefaultParseOptions are used for zero values
+var DefaultParseOptions = ParseOptions{
+	MaxBodySize:     256 << 10,
+	MaxDepth:        16,
+	MaxFields:       1024,
+	MaxStringLength: 64 << 10,
+}
+
+func (o ParseOptions) withDefaults() ParseOptions {
+	if o.MaxBodySize <= 0 {
+		o.MaxBodySize = DefaultParseOptions.MaxBodySize
+	}
+	if o.MaxDepth <= 0 {
+		o.MaxDepth = DefaultParseOptions.MaxDepth
+	}
+	if o.MaxFields <= 0 {
+		o.MaxFields = DefaultParseOptions.MaxFields
+	}
+	if o.MaxStringLength <= 0 {
+		o.MaxStringLength = DefaultParseOptions.MaxStringLength
+	}
+	return o
+}
+
+var (
+	ErrBodyTooLarge  = errors.New("body too large")
+	ErrTooDeep       = errors.New("nesting too deep")
+	ErrTooManyFields = errors.New("too many fields")
+	ErrStringTooLong = errors.New("string too long")
+	ErrDTDNotAllowed = errors.New("DTD and entity declarations are not allowed")
+)
+
+// ParsedMessage is what a parser extracts from a body
+type ParsedMessage struct {
+	Format    string
+	Recipient string
+	Text      string
+}
+
+// MessageParser parses a body of one format
+type MessageParser interface {
+	Parse(data []byte) (*ParsedMessage, error)
+}
+
+// JSONMessageParser parses bodies built by the JSONMessageBuilder
+type JSONMessageParser struct {
+	Options ParseOptions
+}
+
+func (p *JSONMessageParser) Parse(data []byte) (*ParsedMessage, error) {
+	opts := p.Options.withDefaults()
+	if len(data) > opts.MaxBodySize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrBodyTooLarge, len(data))
+	}
+	if err := checkJSONLimits(data, opts); err != nil {
+		return nil, err
+	}
+
+	var m struct {
+		Recipient string `json:"recipient"`
+		Message   string `json:"message"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &ParsedMessage{Format: "JSON", Recipient: m.Recipient, Text: m.Message}, nil
+}
+
+func checkJSONLimits(data []byte, opts ParseOptions) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	depth, fields := 0, 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{', '[':
+				depth++
+				if depth > opts.MaxDepth {
+					return fmt.Errorf("%w: more than %d levels", ErrTooDeep, opts.MaxDepth)
+				}
+			case '}', ']':
+				depth--
+			}
+		case string:
+			if len(t) > opts.MaxStringLength {
+				return fmt.Errorf("%w: %d bytes", ErrStringTooLong, len(t))
+			}
+			fields++
+		default:
+			fields++
+		}
+		if fields > opts.MaxFields {
+			return fmt.Errorf("%w: more than %d", ErrTooManyFields, opts.MaxFields)
+		}
+	}
+}
+
+// XMLMessageParser parses bodies built by the XMLMessageBuilder
+type XMLMessageParser struct {
+	Options ParseOptions
+}
+
+func (p *XMLMessageParser) Parse(data []byte) (*ParsedMessage, error) {
+	opts := p.Options.withDefaults()
+	if len(data) > opts.MaxBodySize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrBodyTooLarge, len(data))
+	}
+	if err := checkXMLLimits(data, opts); err != nil {
+		return nil, err
+	}
+
+	var m struct {
+		Recipient string `xml:"recipient"`
+		Text      string `xml:"body"`
+	}
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = true
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	return &ParsedMessage{Format: "XML", Recipient: m.Recipient, Text: m.Text}, nil
+}
+
+func checkXMLLimits(data []byte, opts ParseOptions) error {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = true
+	// text length of every open element, CDATA sections, entities and child
+	// elements split an element's text into several tokens
+	var text []int
+	depth, elements := 0, 0
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			if depth != 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case xml.Directive:
+			// <!DOCTYPE ...> and <!ENTITY ...> arrive as directives
+			return ErrDTDNotAllowed
+		case xml.StartElement:
+			depth++
+			elements++
+			text = append(text, 0)
+			if depth > opts.MaxDepth {
+				return fmt.Errorf("%w: more than %d levels", ErrTooDeep, opts.MaxDepth)
+			}
+			if elements+len(t.Attr) > opts.MaxFields {
+				return fmt.Errorf("%w: more than %d", ErrTooManyFields, opts.MaxFields)
+			}
+			elements += len(t.Attr)
+			for _, a := range t.Attr {
+				if len(a.Value) > opts.MaxStringLength {
+					return fmt.Errorf("%w: attribute %s", ErrStringTooLong, a.Name.Local)
+				}
+			}
+		case xml.EndElement:
+			depth--
+			if len(text) > 0 {
+				text = text[:len(text)-1]
+			}
+		case xml.CharData:
+			n := len(t)
+			if len(text) > 0 {
+				text[len(text)-1] += n
+				n = text[len(text)-1]
+			}
+			if n > opts.MaxStringLength {
+				return fmt.Errorf("%w: %d bytes", ErrStringTooLong, n)
+			}
+		case xml.ProcInst:
+			if t.Target != "xml" {
+				return fmt.Errorf("processing instruction %q not allowed", t.Target)
+			}
+		}
+	}
+}
+
+// Parsers returns the parser for each built format, all sharing the options
+func Parsers(opts ParseOptions) map[string]MessageParser {
+	return map[string]MessageParser{
+		"JSON": &JSONMessageParser{Options: opts},
+		"XML":  &XMLMessageParser{Options: opts},
+	}
+}
+
+// SniffFormat guesses the format of a body from its first bytes
+func SniffFormat(data []byte) string {
+	trimmed := strings.TrimLeft(string(data[:min(len(data), 512)]), " \t\r\n\ufeff")
+	switch {
+	case strings.HasPrefix(trimmed, "{"), strings.HasPrefix(trimmed, "["):
+		return "JSON"
+	case strings.HasPrefix(trimmed, "<"):
+		return "XML"
+	}
+	return ""
+}
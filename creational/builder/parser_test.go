@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var smallParseOptions = ParseOptions{MaxBodySize: 512, MaxDepth: 3, MaxFields: 8, MaxStringLength: 32}
+
+func TestJSONMessageParser(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  error
+	}{
+		{"built", `{"recipient": "santa", "message": "hello"}`, nil},
+		{"too large", `{"message": "` + strings.Repeat("a", 600) + `"}`, ErrBodyTooLarge},
+		{"too deep", `{"a": {"b": {"c": {"d": 1}}}}`, ErrTooDeep},
+		{"too many fields", `[1, 2, 3, 4, 5, 6, 7, 8, 9]`, ErrTooManyFields},
+		{"long string", `{"message": "` + strings.Repeat("a", 33) + `"}`, ErrStringTooLong},
+		{"long key", `{"` + strings.Repeat("k", 33) + `": 1}`, ErrStringTooLong},
+	}
+	p := &JSONMessageParser{Options: smallParseOptions}
+	for _, tt := range tests {
+		_, err := p.Parse([]byte(tt.body))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+	if _, err := p.Parse([]byte(`{"recipient": `)); err == nil {
+		t.Error("truncated JSON accepted")
+	}
+}
+
+func TestXMLMessageParser(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  error
+	}{
+		{"built", `<message><recipient>santa</recipient><body>hello</body></message>`, nil},
+		{"too deep", `<a><b><c><d/></c></b></a>`, ErrTooDeep},
+		{"too many elements", `<a>` + strings.Repeat(`<b/>`, 8) + `</a>`, ErrTooManyFields},
+		{"too many attributes", `<a x="1" y="2" z="3" u="4" v="5" w="6" q="7" r="8"/>`, ErrTooManyFields},
+		{"long text", `<message><body>` + strings.Repeat("a", 33) + `</body></message>`, ErrStringTooLong},
+		{"long attribute", `<message id="` + strings.Repeat("a", 33) + `"/>`, ErrStringTooLong},
+		{"split text", `<message><body>` + strings.Repeat("aaaa<![CDATA[aaaa]]>", 5) + `</body></message>`, ErrStringTooLong},
+		{"text around children", `<message><body>` + strings.Repeat("aaaaaaaaaa<b/>", 4) + `</body></message>`, ErrStringTooLong},
+		{"doctype", `<!DOCTYPE message [<!ENTITY x "y">]><message/>`, ErrDTDNotAllowed},
+	}
+	p := &XMLMessageParser{Options: smallParseOptions}
+	for _, tt := range tests {
+		_, err := p.Parse([]byte(tt.body))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+	for _, body := range []string{`<message><body>`, `<?php echo 1 ?><message/>`} {
+		if _, err := p.Parse([]byte(body)); err == nil {
+			t.Errorf("%q accepted", body)
+		}
+	}
+}
+
+func TestParsersReadBuiltMessages(t *testing.T) {
+	parsers := Parsers(ParseOptions{})
+	for _, format := range []string{"JSON", "XML"} {
+		b, _ := NewBuilder(format)
+		msg, err := (&Sender{}).Build(b, "santa", "I have been <good> & \"nice\"")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := SniffFormat(msg.Body); got != format {
+			t.Errorf("SniffFormat = %q, want %q", got, format)
+		}
+		parsed, err := parsers[format].Parse(msg.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if parsed.Recipient != "santa" || parsed.Text != "I have been <good> & \"nice\"" {
+			t.Errorf("%s: parsed %+v", format, parsed)
+		}
+	}
+}
+
+func TestSniffFormat(t *testing.T) {
+	tests := map[string]string{
+		"  {\"a\": 1}":   "JSON",
+		"\ufeff[1]":      "JSON",
+		"\n<?xml ?><a/>": "XML",
+		"hello":          "",
+		"":               "",
+	}
+	for body, want := range tests {
+		if got := SniffFormat([]byte(body)); got != want {
+			t.Errorf("SniffFormat(%q) = %q, want %q", body, got, want)
+		}
+	}
+}
+
+// jsonDepth is an independent depth count, strings are skipped
+func jsonDepth(data []byte) int {
+	depth, max := 0, 0
+	inString, escaped := false, false
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{' || c == '[':
+			depth++
+			if depth > max {
+				max = depth
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return max
+}
+
+func FuzzParseJSON(f *testing.F) {
+	f.Add([]byte(`{"recipient": "santa", "message": "hello"}`))
+	f.Add([]byte(`{"a": {"b": [1, 2, {"c": "d"}]}}`))
+	f.Add([]byte(`[[[[[]]]]]`))
+	f.Add([]byte(`{"message": "é😀"}`))
+
+	p := &JSONMessageParser{Options: smallParseOptions}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := p.Parse(data)
+		if err != nil {
+			return
+		}
+		if len(data) > smallParseOptions.MaxBodySize {
+			t.Fatalf("accepted %d bytes", len(data))
+		}
+		if d := jsonDepth(data); d > smallParseOptions.MaxDepth {
+			t.Fatalf("accepted depth %d", d)
+		}
+		if len(msg.Recipient) > smallParseOptions.MaxStringLength || len(msg.Text) > smallParseOptions.MaxStringLength {
+			t.Fatalf("accepted long strings: %+v", msg)
+		}
+		if !json.Valid(data) {
+			t.Fatalf("accepted invalid JSON %q", data)
+		}
+	})
+}
+
+func FuzzParseXML(f *testing.F) {
+	f.Add([]byte(`<message><recipient>santa</recipient><body>hello</body></message>`))
+	f.Add([]byte(`<?xml version="1.0"?><a x="1"><b><![CDATA[x]]></b></a>`))
+	f.Add([]byte(`<!DOCTYPE a [<!ENTITY e "x">]><a>&e;</a>`))
+	f.Add([]byte(`<a><!-- c --><b>&amp;&#65;</b></a>`))
+
+	p := &XMLMessageParser{Options: smallParseOptions}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := p.Parse(data)
+		if err != nil {
+			return
+		}
+		if len(data) > smallParseOptions.MaxBodySize {
+			t.Fatalf("accepted %d bytes", len(data))
+		}
+		if bytes.Contains(data, []byte("<!DOCTYPE")) || bytes.Contains(data, []byte("<!ENTITY")) {
+			// only allowed inside comments or CDATA
+			if !bytes.Contains(data, []byte("<!--")) && !bytes.Contains(data, []byte("<![CDATA[")) {
+				t.Fatalf("accepted DTD %q", data)
+			}
+		}
+		if len(msg.Recipient) > smallParseOptions.MaxStringLength || len(msg.Text) > smallParseOptions.MaxStringLength {
+			t.Fatalf("accepted long strings: %+v", msg)
+		}
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Pool is a generic object pool. At most MaxSize objects exist at a time;
+// borrowers wait (until their context is done) when all of them are in use.
+// Idle objects are closed by a background reaper once they sat unused for
+// IdleTimeout, and every object is health checked before being handed out.
+type Pool[T any] struct {
+	config PoolConfig[T]
+	slots  chan struct{}
+	done   chan struct{}
+
+	mu sync.Mutex
+	// ordered by the time objects were put back, oldest first
+	idle   []pooled[T]
+	closed bool
+	stats  PoolStats
+}
+
+// PoolConfig configures a Pool
+type PoolConfig[T any] struct {
+	// Creates a new object, required
+	New func(ctx context.Context) (T, error)
+	// Releases an object that leaves the pool, optional
+	Close func(T) error
+	// Reports whether an idle object can still be used, optional
+	Check func(T) error
+	// Maximum number of objects, idle and borrowed together
+	MaxSize int
+	// Idle objects older than this are closed instead of reused, zero keeps them
+	IdleTimeout time.Duration
+}
+
+// PoolStats are the pool's metrics
+type PoolStats struct {
+	Created        int64
+	Destroyed      int64
+	Borrowed       int64
+	Returned       int64
+	HealthFailures int64
+	// Number of Get calls that had to wait for a free slot, and how long in total
+	Waits    int64
+	WaitTime time.Duration
+	// Current gauges
+	InUse int
+	Idle  int
+}
+
+type pooled[T any] struct {
+	value T
+	since time.Time
+}
+
+var ErrPoolClosed = errors.New("pool is closed")
+
+func NewPool[T any](config PoolConfig[T]) *Pool[T] {
+	if config.MaxSize <= 0 {
+		config.MaxSize = 1
+	}
+	p := &Pool[T]{
+		config: config,
+		slots:  make(chan struct{}, config.MaxSize),
+		done:   make(chan struct{}),
+	}
+	if config.IdleTimeout > 0 {
+		go p.reap()
+	}
+	return p
+}
+
+// reap closes expired idle objects until the pool is closed. Get only looks
+// at the most recently used objects, the old ones would stay open forever.
+func (p *Pool[T]) reap() {
+	ticker := time.NewTicker(p.config.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.reapIdle()
+		}
+	}
+}
+
+func (p *Pool[T]) reapIdle() {
+	cutoff := time.Now().Add(-p.config.IdleTimeout)
+	p.mu.Lock()
+	n := 0
+	for n < len(p.idle) && p.idle[n].since.Before(cutoff) {
+		n++
+	}
+	expired := append([]pooled[T](nil), p.idle[:n]...)
+	p.idle = append(p.idle[:0], p.idle[n:]...)
+	p.mu.Unlock()
+
+	for _, item := range expired {
+		p.destroy(item.value)
+	}
+}
+
+// Get borrows an object, waiting for one to become available if needed. The
+// object must be given back with Put, or Discard if it is broken.
+func (p *Pool[T]) Get(ctx context.Context) (T, error) {
+	var zero T
+
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		start := time.Now()
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		}
+		p.mu.Lock()
+		p.stats.Waits++
+		p.stats.WaitTime += time.Since(start)
+		p.mu.Unlock()
+	}
+
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			<-p.slots
+			return zero, ErrPoolClosed
+		}
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		// most recently used first, so surplus objects age out
+		item := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if p.config.IdleTimeout > 0 && time.Since(item.since) > p.config.IdleTimeout {
+			p.destroy(item.value)
+			continue
+		}
+		if p.config.Check != nil {
+			if err := p.config.Check(item.value); err != nil {
+				p.mu.Lock()
+				p.stats.HealthFailures++
+				p.mu.Unlock()
+				p.destroy(item.value)
+				continue
+			}
+		}
+
+		p.mu.Lock()
+		p.stats.Borrowed++
+		p.stats.InUse++
+		p.mu.Unlock()
+		return item.value, nil
+	}
+
+	v, err := p.config.New(ctx)
+	if err != nil {
+		<-p.slots
+		return zero, err
+	}
+	p.mu.Lock()
+	p.stats.Created++
+	p.stats.Borrowed++
+	p.stats.InUse++
+	p.mu.Unlock()
+	return v, nil
+}
+
+// Put gives a borrowed object back to the pool
+func (p *Pool[T]) Put(v T) {
+	p.mu.Lock()
+	p.stats.Returned++
+	p.stats.InUse--
+	if p.closed {
+		p.mu.Unlock()
+		p.destroy(v)
+		<-p.slots
+		return
+	}
+	p.idle = append(p.idle, pooled[T]{value: v, since: time.Now()})
+	p.mu.Unlock()
+	<-p.slots
+}
+
+// Discard closes a borrowed object instead of returning it
+func (p *Pool[T]) Discard(v T) {
+	p.mu.Lock()
+	p.stats.InUse--
+	p.mu.Unlock()
+	p.destroy(v)
+	<-p.slots
+}
+
+func (p *Pool[T]) destroy(v T) {
+	if p.config.Close != nil {
+		p.config.Close(v)
+	}
+	p.mu.Lock()
+	p.stats.Destroyed++
+	p.mu.Unlock()
+}
+
+// Stats returns a snapshot of the pool's metrics
+func (p *Pool[T]) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats
+	s.Idle = len(p.idle)
+	return s
+}
+
+// Close closes all idle objects. Borrowed objects are closed when they are put
+// back, and Get fails from now on.
+func (p *Pool[T]) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	close(p.done)
+	p.mu.Unlock()
+
+	for _, item := range idle {
+		p.destroy(item.value)
+	}
+}
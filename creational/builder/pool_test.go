@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testConn struct {
+	id     int
+	closed atomic.Bool
+	broken bool
+}
+
+func newTestPool(size int, idle time.Duration) (*Pool[*testConn], *atomic.Int64) {
+	var created atomic.Int64
+	return NewPool(PoolConfig[*testConn]{
+		New: func(context.Context) (*testConn, error) {
+			return &testConn{id: int(created.Add(1))}, nil
+		},
+		Close: func(c *testConn) error {
+			c.closed.Store(true)
+			return nil
+		},
+		Check: func(c *testConn) error {
+			if c.broken {
+				return errors.New("broken")
+			}
+			return nil
+		},
+		MaxSize:     size,
+		IdleTimeout: idle,
+	}), &created
+}
+
+func TestPoolReuse(t *testing.T) {
+	p, created := newTestPool(2, 0)
+	defer p.Close()
+	ctx := context.Background()
+
+	a, _ := p.Get(ctx)
+	p.Put(a)
+	b, _ := p.Get(ctx)
+	if a != b {
+		t.Error("idle object not reused")
+	}
+	b.broken = true
+	p.Put(b)
+	c, _ := p.Get(ctx)
+	if c == b || !b.closed.Load() {
+		t.Error("broken object handed out or not closed")
+	}
+	p.Put(c)
+
+	s := p.Stats()
+	if created.Load() != 2 || s.HealthFailures != 1 || s.InUse != 0 || s.Idle != 1 {
+		t.Errorf("created %d, stats %+v", created.Load(), s)
+	}
+}
+
+func TestPoolWaitsForFreeSlot(t *testing.T) {
+	p, _ := newTestPool(1, 0)
+	defer p.Close()
+
+	a, _ := p.Get(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		p.Put(a)
+	}()
+	b, err := p.Get(context.Background())
+	if err != nil || b != a {
+		t.Errorf("Get = %v, %v", b, err)
+	}
+	p.Put(b)
+	if p.Stats().Waits != 1 {
+		t.Errorf("waits = %d, want 1", p.Stats().Waits)
+	}
+}
+
+func TestPoolReapsOldestIdle(t *testing.T) {
+	p, _ := newTestPool(3, 20*time.Millisecond)
+	defer p.Close()
+	ctx := context.Background()
+
+	var conns []*testConn
+	for i := 0; i < 3; i++ {
+		c, _ := p.Get(ctx)
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		p.Put(c)
+	}
+
+	// keep the newest one busy, the others must be closed in the background
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		c, _ := p.Get(ctx)
+		p.Put(c)
+		if conns[0].closed.Load() && conns[1].closed.Load() {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !conns[0].closed.Load() || !conns[1].closed.Load() {
+		t.Error("stale idle objects were not reaped")
+	}
+	if conns[2].closed.Load() {
+		t.Error("object in use was reaped")
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	p, _ := newTestPool(2, time.Minute)
+	ctx := context.Background()
+	a, _ := p.Get(ctx)
+	b, _ := p.Get(ctx)
+	p.Put(a)
+
+	p.Close()
+	p.Close()
+	if !a.closed.Load() {
+		t.Error("idle object not closed")
+	}
+	p.Put(b)
+	if !b.closed.Load() {
+		t.Error("object put back after Close not closed")
+	}
+	if _, err := p.Get(ctx); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("err = %v, want %v", err, ErrPoolClosed)
+	}
+}
+
+func TestPoolConcurrentUse(t *testing.T) {
+	p, created := newTestPool(4, time.Millisecond)
+	defer p.Close()
+
+	var inUse, peak atomic.Int64
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				c, err := p.Get(context.Background())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if n := inUse.Add(1); n > peak.Load() {
+					peak.Store(n)
+				}
+				inUse.Add(-1)
+				p.Put(c)
+			}
+		}()
+	}
+	wg.Wait()
+	if peak.Load() > 4 {
+		t.Errorf("%d objects in use at once, max 4", peak.Load())
+	}
+	if s := p.Stats(); s.InUse != 0 || s.Borrowed != 800 || s.Created-s.Destroyed > 4 {
+		t.Errorf("created %d, stats %+v", created.Load(), s)
+	}
+}
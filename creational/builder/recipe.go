@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Recipes are versioned. A new version is rolled out gradually: it starts as a
+// canary for a percentage of recipients while the rest keep the stable
+// version. Assignment is sticky (a hash of recipe and recipient), so a
+// recipient does not flip between versions. Failures are counted per version,
+// and a canary failing too often is rolled back automatically.
+
+// RecipeVersion is one published version of a recipe
+type RecipeVersion struct {
+	Name      string    `json:"name"`
+	Version   int       `json:"version"`
+	Format    string    `json:"format"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+
+	tmpl *template.Template
+}
+
+// Template returns the parsed text template
+func (v *RecipeVersion) Template() *template.Template {
+	return v.tmpl
+}
+
+// VersionStats counts the outcomes per version
+type VersionStats struct {
+	Sent   int `json:"sent"`
+	Failed int `json:"failed"`
+}
+
+// FailureRate is the share of failed messages, between 0 and 1
+func (s VersionStats) FailureRate() float64 {
+	if s.Sent+s.Failed == 0 {
+		return 0
+	}
+	return float64(s.Failed) / float64(s.Sent+s.Failed)
+}
+
+// Rollout is the rollout state of a recipe
+type Rollout struct {
+	Name   string `json:"name"`
+	Stable int    `json:"stable"`
+	// Versions that were stable before, the latest last. Rollback without a
+	// canary returns to the last one.
+	History []int `json:"history,omitempty"`
+	// Zero when no rollout is in progress
+	Canary  int                  `json:"canary,omitempty"`
+	Percent int                  `json:"percent,omitempty"`
+	Stats   map[int]VersionStats `json:"stats"`
+	// Why the last canary was rolled back, if it was
+	RolledBack string `json:"rolled_back,omitempty"`
+}
+
+var (
+	ErrRecipeNotFound  = errors.New("recipe not found")
+	ErrVersionNotFound = errors.New("recipe version not found")
+	ErrNoRollout       = errors.New("no rollout in progress")
+	ErrNoPrevious      = errors.New("no previous stable version")
+)
+
+// RecipeStore keeps recipe versions and their rollouts
+type RecipeStore struct {
+	// A canary is rolled back automatically once it has at least MinSamples
+	// results and a failure rate above MaxFailureRate. Disabled when zero.
+	MaxFailureRate float64
+	MinSamples     int
+
+	mu       sync.Mutex
+	versions map[string][]*RecipeVersion
+	rollouts map[string]*Rollout
+}
+
+func NewRecipeStore() *RecipeStore {
+	return &RecipeStore{
+		versions: make(map[string][]*RecipeVersion),
+		rollouts: make(map[string]*Rollout),
+	}
+}
+
+// Publish adds a new version. The first version of a recipe becomes stable
+// right away, later ones need a rollout.
+func (s *RecipeStore) Publish(name, format, text string) (*RecipeVersion, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := &RecipeVersion{
+		Name:      name,
+		Version:   len(s.versions[name]) + 1,
+		Format:    format,
+		Text:      text,
+		CreatedAt: time.Now(),
+		tmpl:      tmpl,
+	}
+	s.versions[name] = append(s.versions[name], v)
+	if v.Version == 1 {
+		s.rollouts[name] = &Rollout{Name: name, Stable: 1, Stats: make(map[int]VersionStats)}
+	}
+	return v, nil
+}
+
+// StartRollout sends the given percentage of recipients to a version
+func (s *RecipeStore) StartRollout(name string, version, percent int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.rollout(name)
+	if err != nil {
+		return err
+	}
+	if version < 1 || version > len(s.versions[name]) {
+		return fmt.Errorf("%w: %s v%d", ErrVersionNotFound, name, version)
+	}
+	if version == r.Stable {
+		return fmt.Errorf("%s v%d is already stable", name, version)
+	}
+	r.Canary = version
+	r.Percent = clampPercent(percent)
+	r.RolledBack = ""
+	// judge the version on this rollout only, not on one rolled back before
+	delete(r.Stats, version)
+	return nil
+}
+
+// SetPercent changes the share of recipients getting the canary
+func (s *RecipeStore) SetPercent(name string, percent int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.rollout(name)
+	if err != nil {
+		return err
+	}
+	if r.Canary == 0 {
+		return fmt.Errorf("%w: %s", ErrNoRollout, name)
+	}
+	r.Percent = clampPercent(percent)
+	return nil
+}
+
+// Promote makes the canary the stable version
+func (s *RecipeStore) Promote(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.rollout(name)
+	if err != nil {
+		return err
+	}
+	if r.Canary == 0 {
+		return fmt.Errorf("%w: %s", ErrNoRollout, name)
+	}
+	r.History = append(r.History, r.Stable)
+	r.Stable, r.Canary, r.Percent = r.Canary, 0, 0
+	return nil
+}
+
+// Rollback stops a running canary. Without a canary the stable version goes
+// back to the one that was stable before it.
+func (s *RecipeStore) Rollback(name, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.rollout(name)
+	if err != nil {
+		return err
+	}
+	if r.Canary == 0 && len(r.History) == 0 {
+		return fmt.Errorf("%w: %s", ErrNoPrevious, name)
+	}
+	s.rollback(r, reason)
+	return nil
+}
+
+func (s *RecipeStore) rollback(r *Rollout, reason string) {
+	if reason == "" {
+		reason = "manual rollback"
+	}
+	if r.Canary != 0 {
+		r.RolledBack = fmt.Sprintf("v%d: %s", r.Canary, reason)
+		r.Canary, r.Percent = 0, 0
+		return
+	}
+	if n := len(r.History); n > 0 {
+		r.RolledBack = fmt.Sprintf("v%d: %s", r.Stable, reason)
+		r.Stable, r.History = r.History[n-1], r.History[:n-1]
+	}
+}
+
+// Select returns the version a recipient gets
+func (s *RecipeStore) Select(name, recipient string) (*RecipeVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.rollout(name)
+	if err != nil {
+		return nil, err
+	}
+	version := r.Stable
+	if r.Canary != 0 && bucket(name, recipient) < r.Percent {
+		version = r.Canary
+	}
+	return s.versions[name][version-1], nil
+}
+
+func bucket(name, recipient string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(recipient))
+	return int(h.Sum32() % 100)
+}
+
+// RecordResult counts the outcome of a message built from a version and rolls
+// a failing canary back
+func (s *RecipeStore) RecordResult(name string, version int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rollouts[name]
+	if !ok {
+		return
+	}
+	stats := r.Stats[version]
+	if err != nil {
+		stats.Failed++
+	} else {
+		stats.Sent++
+	}
+	r.Stats[version] = stats
+
+	if version == r.Canary && s.MaxFailureRate > 0 &&
+		stats.Sent+stats.Failed >= s.MinSamples && stats.FailureRate() > s.MaxFailureRate {
+		s.rollback(r, fmt.Sprintf("failure rate %.1f%% above %.1f%%", stats.FailureRate()*100, s.MaxFailureRate*100))
+	}
+}
+
+// Rollout returns the rollout state of a recipe
+func (s *RecipeStore) Rollout(name string) (Rollout, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.rollout(name)
+	if err != nil {
+		return Rollout{}, err
+	}
+	c := *r
+	c.History = append([]int(nil), r.History...)
+	c.Stats = make(map[int]VersionStats, len(r.Stats))
+	for v, st := range r.Stats {
+		c.Stats[v] = st
+	}
+	return c, nil
+}
+
+// Versions returns all versions of a recipe
+func (s *RecipeStore) Versions(name string) []*RecipeVersion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*RecipeVersion(nil), s.versions[name]...)
+}
+
+func (s *RecipeStore) rollout(name string) (*Rollout, error) {
+	r, ok := s.rollouts[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRecipeNotFound, name)
+	}
+	return r, nil
+}
+
+func clampPercent(p int) int {
+	if p < 0 {
+		return 0
+	}
+	if p > 100 {
+		return 100
+	}
+	return p
+}
+
+// Handler exposes the rollouts over HTTP:
+//
+//	GET  /recipes/{name}
+//	POST /recipes/{name}/rollback
+//	POST /recipes/{name}/promote
+func (s *RecipeStore) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /recipes/{name}", func(w http.ResponseWriter, r *http.Request) {
+		rollout, err := s.Rollout(r.PathValue("name"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, rollout)
+	})
+	mux.HandleFunc("POST /recipes/{name}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		var err error
+		switch r.PathValue("action") {
+		case "rollback":
+			err = s.Rollback(name, r.URL.Query().Get("reason"))
+		case "promote":
+			err = s.Promote(name)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case errors.Is(err, ErrRecipeNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		rollout, _ := s.Rollout(name)
+		writeJSON(w, http.StatusOK, rollout)
+	})
+	return mux
+}
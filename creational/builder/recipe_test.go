@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func publishVersions(t *testing.T, s *RecipeStore, name string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := s.Publish(name, "JSON", "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRecipeRollbackReturnsToPreviousStable(t *testing.T) {
+	s := NewRecipeStore()
+	publishVersions(t, s, "welcome", 3)
+
+	// v1 -> v3 skipping v2, then back
+	if err := s.StartRollout("welcome", 3, 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Promote("welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		wantErr    error
+		wantStable int
+	}{
+		{"back to v1", nil, 1},
+		{"nothing left", ErrNoPrevious, 1},
+	}
+	for _, tt := range tests {
+		err := s.Rollback("welcome", "")
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		r, _ := s.Rollout("welcome")
+		if r.Stable != tt.wantStable {
+			t.Errorf("%s: stable = v%d, want v%d", tt.name, r.Stable, tt.wantStable)
+		}
+	}
+}
+
+func TestRecipeRolloutRestartResetsStats(t *testing.T) {
+	s := NewRecipeStore()
+	s.MaxFailureRate = 0.5
+	s.MinSamples = 2
+	publishVersions(t, s, "welcome", 2)
+
+	if err := s.StartRollout("welcome", 2, 100); err != nil {
+		t.Fatal(err)
+	}
+	s.RecordResult("welcome", 2, errors.New("bounce"))
+	s.RecordResult("welcome", 2, errors.New("bounce"))
+	r, _ := s.Rollout("welcome")
+	if r.Canary != 0 || r.RolledBack == "" {
+		t.Fatalf("failing canary not rolled back: %+v", r)
+	}
+
+	// the fixed rollout must not be judged on the old failures
+	if err := s.StartRollout("welcome", 2, 100); err != nil {
+		t.Fatal(err)
+	}
+	s.RecordResult("welcome", 2, nil)
+	s.RecordResult("welcome", 2, errors.New("bounce"))
+	r, _ = s.Rollout("welcome")
+	if r.Canary != 2 {
+		t.Errorf("restarted canary rolled back: %+v", r)
+	}
+	if st := r.Stats[2]; st.Sent != 1 || st.Failed != 1 {
+		t.Errorf("stats = %+v, want 1 sent and 1 failed", st)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// ReplyBuilder builds the answer to a received message. It wraps the concrete
+// builder of the original message's format, addresses the reply and sets the
+// threading headers.
+type ReplyBuilder struct {
+	Builder  MessageBuilder
+	Original *InboundMessage
+	// Extra headers for the reply
+	Headers map[string]string
+
+	recipient string
+}
+
+var ErrNoReplyAddress = errors.New("no address to reply to")
+
+// NewReplyBuilder returns a ReplyBuilder in the same format as the original.
+// Mail is answered with mail: plain text and mails received over SMTP get an
+// EmailMessageBuilder with a "Re:" subject.
+func NewReplyBuilder(original *InboundMessage) (*ReplyBuilder, error) {
+	format := original.Format
+	if format == "TEXT" || original.Channel == "smtp" {
+		format = "EMAIL"
+	}
+	builder, err := NewBuilder(format)
+	if err != nil {
+		return nil, err
+	}
+	if email, ok := builder.(*EmailMessageBuilder); ok {
+		email.SetSubject(replySubject(original.Headers.Get("Subject")))
+	}
+	return &ReplyBuilder{Builder: builder, Original: original}, nil
+}
+
+func replySubject(subject string) string {
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	subject = strings.TrimSpace(subject)
+	if subject == "" {
+		return "Re: your message"
+	}
+	if len(subject) >= 3 && strings.EqualFold(subject[:3], "re:") {
+		return subject
+	}
+	return "Re: " + subject
+}
+
+// SetRecipient sets where the reply goes for channels whose senders are not
+// addresses, e.g. the identity of an HTTP client. Mail received over SMTP is
+// always answered to its sender.
+func (b *ReplyBuilder) SetRecipient(recipient string) {
+	b.recipient = recipient
+}
+
+func (b *ReplyBuilder) SetText(text string) {
+	b.Builder.SetText(text)
+}
+
+func (b *ReplyBuilder) Message() (*Message, error) {
+	recipient := b.recipient
+	if b.Original.Channel == "smtp" {
+		recipient = b.Original.Sender
+	}
+	if recipient == "" {
+		return nil, fmt.Errorf("%w: %s message from %q", ErrNoReplyAddress, b.Original.Channel, b.Original.Sender)
+	}
+	b.Builder.SetRecipient(recipient)
+	msg, err := b.Builder.Message()
+	if err != nil {
+		return nil, err
+	}
+	if msg.ID == "" {
+		msg.ID = NewMessageID()
+	}
+
+	headers := make(map[string]string, len(b.Headers)+2)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	for k, v := range b.Headers {
+		headers[k] = v
+	}
+
+	originalID := strings.Trim(b.Original.Headers.Get("Message-Id"), "<> ")
+	if originalID == "" {
+		originalID = b.Original.ID
+	}
+	headers["In-Reply-To"] = "<" + originalID + ">"
+	refs := strings.TrimSpace(b.Original.Headers.Get("References") + " <" + originalID + ">")
+	headers["References"] = refs
+	msg.Headers = headers
+	return msg, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net/textproto"
+	"testing"
+)
+
+func TestReplyBuilderAnswersMailWithMail(t *testing.T) {
+	tests := []struct {
+		subject, want string
+	}{
+		{"Presents", "Re: Presents"},
+		{"RE: Presents", "RE: Presents"},
+		{"=?utf-8?q?Caf=C3=A9?=", "Re: Café"},
+		{"", "Re: your message"},
+	}
+	for _, tt := range tests {
+		in := newInboundMail("kid@example.com", textproto.MIMEHeader{
+			"Subject":    {tt.subject},
+			"Message-Id": {"<in1@example.com>"},
+		})
+		b, err := NewReplyBuilder(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.SetText("on its way")
+		msg, err := b.Message()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Format != "EMAIL" || msg.Recipient != "kid@example.com" {
+			t.Errorf("%q: format %q recipient %q", tt.subject, msg.Format, msg.Recipient)
+		}
+		if subject := b.Builder.(*EmailMessageBuilder).Subject; subject != tt.want {
+			t.Errorf("subject = %q, want %q", subject, tt.want)
+		}
+		if msg.Headers["In-Reply-To"] != "<in1@example.com>" {
+			t.Errorf("In-Reply-To = %q", msg.Headers["In-Reply-To"])
+		}
+	}
+}
+
+func TestReplyBuilderThreadsAndAddresses(t *testing.T) {
+	tests := []struct {
+		name      string
+		channel   string
+		format    string
+		recipient string
+		headers   textproto.MIMEHeader
+		// empty when the reply cannot be addressed
+		wantTo     string
+		wantFormat string
+		wantRefs   string
+	}{
+		{
+			"mail in a thread", "smtp", "TEXT", "",
+			textproto.MIMEHeader{"Message-Id": {"<in1@kid.example>"}, "References": {"<out1@example.com>"}},
+			"kid@example.com", "EMAIL", "<out1@example.com> <in1@kid.example>",
+		},
+		{
+			"mail ignores SetRecipient", "smtp", "JSON", "other@example.com",
+			textproto.MIMEHeader{},
+			"kid@example.com", "EMAIL", "<in1>",
+		},
+		{
+			"http with a recipient", "http", "JSON", "https://kid.example/hook",
+			textproto.MIMEHeader{},
+			"https://kid.example/hook", "JSON", "<in1>",
+		},
+		{
+			"http without a recipient", "http", "JSON", "",
+			textproto.MIMEHeader{},
+			"", "", "",
+		},
+	}
+	for _, tt := range tests {
+		in := newInboundMail("kid@example.com", tt.headers)
+		in.Channel = tt.channel
+		in.Format = tt.format
+		b, err := NewReplyBuilder(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.recipient != "" {
+			b.SetRecipient(tt.recipient)
+		}
+		b.SetText("on its way")
+		msg, err := b.Message()
+		if tt.wantTo == "" {
+			if !errors.Is(err, ErrNoReplyAddress) {
+				t.Errorf("%s: err = %v, want %v", tt.name, err, ErrNoReplyAddress)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if msg.Recipient != tt.wantTo || msg.Format != tt.wantFormat {
+			t.Errorf("%s: recipient %q format %q, want %q %q", tt.name, msg.Recipient, msg.Format, tt.wantTo, tt.wantFormat)
+		}
+		if msg.Headers["References"] != tt.wantRefs {
+			t.Errorf("%s: References = %q, want %q", tt.name, msg.Headers["References"], tt.wantRefs)
+		}
+	}
+}
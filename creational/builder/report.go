@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"html/template"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Reports summarise the message history: how many messages ended up in which
+// state, split by format, channel, tenant and day, how long it took from build
+// to delivery and how many bounced.
+
+// Report is the summary of the message history for a period
+type Report struct {
+	From  time.Time `json:"from"`
+	To    time.Time `json:"to"`
+	Total int       `json:"total"`
+
+	ByStatus  map[string]int `json:"by_status"`
+	ByFormat  map[string]int `json:"by_format"`
+	ByChannel map[string]int `json:"by_channel"`
+	ByTenant  map[string]int `json:"by_tenant"`
+	ByDay     map[string]int `json:"by_day"`
+
+	// Build to delivery latency percentiles
+	Latency LatencyPercentiles `json:"latency"`
+	// Share of messages that failed, between 0 and 1
+	BounceRate float64 `json:"bounce_rate"`
+}
+
+// LatencyPercentiles of the build to delivery time
+type LatencyPercentiles struct {
+	Count int           `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// BuildReport summarises the records built within [from, to). Zero times leave
+// the period open.
+func BuildReport(records []LifecycleRecord, from, to time.Time) *Report {
+	r := &Report{
+		From:      from,
+		To:        to,
+		ByStatus:  make(map[string]int),
+		ByFormat:  make(map[string]int),
+		ByChannel: make(map[string]int),
+		ByTenant:  make(map[string]int),
+		ByDay:     make(map[string]int),
+	}
+
+	var latencies []time.Duration
+	failed := 0
+	for _, rec := range records {
+		if !from.IsZero() && rec.BuiltAt.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !rec.BuiltAt.Before(to) {
+			continue
+		}
+
+		r.Total++
+		r.ByStatus[string(rec.State)]++
+		r.ByFormat[orNone(rec.Format)]++
+		r.ByChannel[orNone(rec.Channel)]++
+		r.ByTenant[orNone(rec.Tenant)]++
+		r.ByDay[rec.BuiltAt.UTC().Format("2006-01-02")]++
+
+		if delivered, ok := rec.At(StateDelivered); ok {
+			latencies = append(latencies, delivered.Sub(rec.BuiltAt))
+		}
+		if rec.State == StateFailed {
+			failed++
+		}
+	}
+
+	if r.Total > 0 {
+		r.BounceRate = float64(failed) / float64(r.Total)
+	}
+	r.Latency = percentiles(latencies)
+	return r
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
+
+func percentiles(d []time.Duration) LatencyPercentiles {
+	p := LatencyPercentiles{Count: len(d)}
+	if len(d) == 0 {
+		return p
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	at := func(q float64) time.Duration {
+		// nearest rank
+		i := int(math.Ceil(q*float64(len(d)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return d[i]
+	}
+	p.P50 = at(0.50)
+	p.P90 = at(0.90)
+	p.P99 = at(0.99)
+	p.Max = d[len(d)-1]
+	return p
+}
+
+// WriteJSON writes the report as JSON
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteCSV writes the report as "dimension,key,value" rows
+func (r *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"dimension", "key", "value"})
+	cw.Write([]string{"total", "", strconv.Itoa(r.Total)})
+	for _, dim := range r.dimensions() {
+		for _, key := range sortedKeys(dim.counts) {
+			cw.Write([]string{dim.name, key, strconv.Itoa(dim.counts[key])})
+		}
+	}
+	cw.Write([]string{"latency", "p50", r.Latency.P50.String()})
+	cw.Write([]string{"latency", "p90", r.Latency.P90.String()})
+	cw.Write([]string{"latency", "p99", r.Latency.P99.String()})
+	cw.Write([]string{"latency", "max", r.Latency.Max.String()})
+	cw.Write([]string{"bounce_rate", "", strconv.FormatFloat(r.BounceRate, 'f', 4, 64)})
+	cw.Flush()
+	return cw.Error()
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Delivery report</title></head>
+<body>
+<h1>Delivery report</h1>
+<p>{{.Total}} messages, bounce rate {{printf "%.2f" .BouncePercent}}%</p>
+<p>Build to delivery: p50 {{.Latency.P50}}, p90 {{.Latency.P90}}, p99 {{.Latency.P99}}, max {{.Latency.Max}}</p>
+{{range .Dimensions}}
+<h2>By {{.Name}}</h2>
+<table>
+{{range .Rows}}<tr><td>{{.Key}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+// WriteHTML writes the report as a simple HTML page
+func (r *Report) WriteHTML(w io.Writer) error {
+	type row struct {
+		Key   string
+		Value int
+	}
+	type dimension struct {
+		Name string
+		Rows []row
+	}
+
+	data := struct {
+		*Report
+		BouncePercent float64
+		Dimensions    []dimension
+	}{Report: r, BouncePercent: r.BounceRate * 100}
+
+	for _, dim := range r.dimensions() {
+		d := dimension{Name: dim.name}
+		for _, key := range sortedKeys(dim.counts) {
+			d.Rows = append(d.Rows, row{key, dim.counts[key]})
+		}
+		data.Dimensions = append(data.Dimensions, d)
+	}
+	return reportTemplate.Execute(w, data)
+}
+
+type reportDimension struct {
+	name   string
+	counts map[string]int
+}
+
+func (r *Report) dimensions() []reportDimension {
+	return []reportDimension{
+		{"status", r.ByStatus},
+		{"format", r.ByFormat},
+		{"channel", r.ByChannel},
+		{"tenant", r.ByTenant},
+		{"day", r.ByDay},
+	}
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
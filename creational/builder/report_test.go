@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPercentiles(t *testing.T) {
+	ms := func(n int) []time.Duration {
+		d := make([]time.Duration, n)
+		for i := range d {
+			// reversed, percentiles sorts
+			d[i] = time.Duration(n-i) * time.Millisecond
+		}
+		return d
+	}
+	tests := []struct {
+		n             int
+		p50, p90, p99 time.Duration
+	}{
+		{1, time.Millisecond, time.Millisecond, time.Millisecond},
+		{2, time.Millisecond, 2 * time.Millisecond, 2 * time.Millisecond},
+		{10, 5 * time.Millisecond, 9 * time.Millisecond, 10 * time.Millisecond},
+		{100, 50 * time.Millisecond, 90 * time.Millisecond, 99 * time.Millisecond},
+		{1000, 500 * time.Millisecond, 900 * time.Millisecond, 990 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		p := percentiles(ms(tt.n))
+		if p.P50 != tt.p50 || p.P90 != tt.p90 || p.P99 != tt.p99 {
+			t.Errorf("n=%d: got p50=%v p90=%v p99=%v, want %v %v %v", tt.n, p.P50, p.P90, p.P99, tt.p50, tt.p90, tt.p99)
+		}
+		if p.Max != time.Duration(tt.n)*time.Millisecond || p.Count != tt.n {
+			t.Errorf("n=%d: max=%v count=%d", tt.n, p.Max, p.Count)
+		}
+	}
+	if p := percentiles(nil); p.Count != 0 || p.Max != 0 {
+		t.Errorf("empty: %+v", p)
+	}
+}
+
+func reportRecords() []LifecycleRecord {
+	day := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	rec := func(id, format, tenant string, builtAt time.Time, states ...MessageState) LifecycleRecord {
+		r := LifecycleRecord{MessageID: id, Format: format, Tenant: tenant, Channel: "smtp", State: StateBuilt, BuiltAt: builtAt}
+		r.History = []LifecycleEvent{{State: StateBuilt, At: builtAt}}
+		for i, s := range states {
+			r.State = s
+			r.History = append(r.History, LifecycleEvent{State: s, At: builtAt.Add(time.Duration(i+1) * time.Second)})
+		}
+		return r
+	}
+	return []LifecycleRecord{
+		rec("1", "JSON", "acme", day, StateSent, StateDelivered),
+		rec("2", "JSON", "acme", day, StateSent, StateFailed),
+		rec("3", "XML", "", day.AddDate(0, 0, 1), StateSent),
+		// outside the period
+		rec("4", "XML", "acme", day.AddDate(0, 0, 5), StateSent),
+	}
+}
+
+func TestBuildReport(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	r := BuildReport(reportRecords(), from, from.AddDate(0, 0, 2))
+
+	if r.Total != 3 {
+		t.Errorf("total = %d, want 3", r.Total)
+	}
+	checks := []struct {
+		name string
+		got  map[string]int
+		want map[string]int
+	}{
+		{"status", r.ByStatus, map[string]int{"delivered": 1, "failed": 1, "sent": 1}},
+		{"format", r.ByFormat, map[string]int{"JSON": 2, "XML": 1}},
+		{"tenant", r.ByTenant, map[string]int{"acme": 2, "(none)": 1}},
+		{"day", r.ByDay, map[string]int{"2024-03-01": 2, "2024-03-02": 1}},
+	}
+	for _, c := range checks {
+		if len(c.got) != len(c.want) {
+			t.Errorf("%s: %v, want %v", c.name, c.got, c.want)
+			continue
+		}
+		for k, v := range c.want {
+			if c.got[k] != v {
+				t.Errorf("%s: %v, want %v", c.name, c.got, c.want)
+				break
+			}
+		}
+	}
+	if r.BounceRate != 1.0/3 {
+		t.Errorf("bounce rate = %v", r.BounceRate)
+	}
+	if r.Latency.Count != 1 || r.Latency.P50 != 2*time.Second {
+		t.Errorf("latency = %+v", r.Latency)
+	}
+}
+
+func TestReportCommandReadsSavedHistory(t *testing.T) {
+	store := NewLifecycleStore()
+	for _, rec := range reportRecords() {
+		store.records[rec.MessageID] = &rec
+	}
+	path := filepath.Join(t.TempDir(), "history.json")
+	if err := store.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err := runCommand([]string{"report", "-history", path, "-from", "2024-03-01", "-to", "2024-03-03"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r Report
+	if err := json.Unmarshal(out.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Total != 3 {
+		t.Errorf("total = %d, want 3", r.Total)
+	}
+
+	for _, format := range []string{"csv", "html"} {
+		out.Reset()
+		err := runCommand([]string{"report", "-history", path, "-format", format, "-from", "2024-03-01", "-to", "2024-03-03"}, &out)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if !strings.Contains(out.String(), "delivered") {
+			t.Errorf("%s: unexpected output %q", format, out.String())
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// Retries are shared by every transport and the dispatcher. A RetryPolicy says
+// how long to wait before the next attempt, a classifier decides whether an
+// error is worth retrying at all, and an optional budget stops retry storms
+// when a downstream service is struggling.
+
+// RetryPolicy creates the backoff for a single operation
+type RetryPolicy interface {
+	Start() Backoff
+}
+
+// Backoff is asked after every failed attempt. It returns the delay before the
+// next attempt, or false to give up.
+type Backoff interface {
+	Next() (time.Duration, bool)
+}
+
+type backoffFunc func() (time.Duration, bool)
+
+func (f backoffFunc) Next() (time.Duration, bool) { return f() }
+
+// ConstantPolicy waits the same delay between attempts
+type ConstantPolicy struct {
+	Delay time.Duration
+	// Total number of attempts, including the first one
+	MaxAttempts int
+}
+
+func (p ConstantPolicy) Start() Backoff {
+	retries := 0
+	return backoffFunc(func() (time.Duration, bool) {
+		retries++
+		if retries >= p.MaxAttempts {
+			return 0, false
+		}
+		return p.Delay, true
+	})
+}
+
+// ExponentialPolicy doubles (or multiplies by Multiplier) the delay after every
+// attempt up to Max
+type ExponentialPolicy struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	// Total number of attempts, including the first one
+	MaxAttempts int
+}
+
+func (p ExponentialPolicy) Start() Backoff {
+	multiplier := p.Multiplier
+	if multiplier <= 1 {
+		multiplier = 2
+	}
+	retries := 0
+	delay := p.Initial
+	return backoffFunc(func() (time.Duration, bool) {
+		retries++
+		if retries >= p.MaxAttempts {
+			return 0, false
+		}
+		d := delay
+		delay = time.Duration(float64(delay) * multiplier)
+		if p.Max > 0 && delay > p.Max {
+			delay = p.Max
+		}
+		return d, true
+	})
+}
+
+// DecorrelatedJitterPolicy picks every delay randomly between Base and three
+// times the previous delay, capped at Cap. This spreads out clients that
+// failed at the same moment.
+type DecorrelatedJitterPolicy struct {
+	Base time.Duration
+	Cap  time.Duration
+	// Total number of attempts, including the first one
+	MaxAttempts int
+}
+
+func (p DecorrelatedJitterPolicy) Start() Backoff {
+	retries := 0
+	prev := p.Base
+	return backoffFunc(func() (time.Duration, bool) {
+		retries++
+		if retries >= p.MaxAttempts {
+			return 0, false
+		}
+		upper := 3 * prev
+		if upper <= p.Base {
+			upper = p.Base + 1
+		}
+		d := p.Base + rand.N(upper-p.Base)
+		if p.Cap > 0 && d > p.Cap {
+			d = p.Cap
+		}
+		prev = d
+		return d, true
+	})
+}
+
+// MaxElapsedPolicy gives up once the next attempt would start after Limit
+type MaxElapsedPolicy struct {
+	Policy RetryPolicy
+	Limit  time.Duration
+}
+
+func (p MaxElapsedPolicy) Start() Backoff {
+	start := time.Now()
+	inner := p.Policy.Start()
+	return backoffFunc(func() (time.Duration, bool) {
+		d, ok := inner.Next()
+		if !ok || time.Since(start)+d > p.Limit {
+			return 0, false
+		}
+		return d, true
+	})
+}
+
+// RetryBudget limits retries to a share of all calls. Every call deposits
+// Ratio tokens, every retry takes one. The budget starts with MinTokens so a
+// service that only just started can still retry.
+type RetryBudget struct {
+	Ratio     float64
+	MinTokens float64
+	// Upper bound of saved up tokens
+	MaxTokens float64
+
+	mu     sync.Mutex
+	tokens float64
+	init   bool
+}
+
+func (b *RetryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.init {
+		b.tokens = b.MinTokens
+		b.init = true
+	}
+	b.tokens += b.Ratio
+	max := b.MaxTokens
+	if max <= 0 {
+		max = b.MinTokens + 100*b.Ratio
+	}
+	if b.tokens > max {
+		b.tokens = max
+	}
+}
+
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ErrorClass tells whether retrying an error can help
+type ErrorClass int
+
+const (
+	Transient ErrorClass = iota
+	Permanent
+)
+
+type classifiedError struct {
+	err   error
+	class ErrorClass
+}
+
+func (e *classifiedError) Error() string { return e.err.Error() }
+func (e *classifiedError) Unwrap() error { return e.err }
+
+// PermanentError marks err as not worth retrying
+func PermanentError(err error) error {
+	return &classifiedError{err: err, class: Permanent}
+}
+
+// TransientError marks err as worth retrying
+func TransientError(err error) error {
+	return &classifiedError{err: err, class: Transient}
+}
+
+// ClassifyError is the default classifier: explicitly marked errors keep their
+// class, SMTP 4xx replies, network errors and dropped connections are
+// transient. SMTP 5xx replies, cancellations and anything unknown, e.g. a
+// message that does not validate, are permanent.
+func ClassifyError(err error) ErrorClass {
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return classified.class
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return Permanent
+	}
+	var proto *textproto.Error
+	if errors.As(err, &proto) {
+		if proto.Code >= 500 {
+			return Permanent
+		}
+		return Transient
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return Transient
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return Transient
+	}
+	return Permanent
+}
+
+// Retrier runs operations under a retry policy
+type Retrier struct {
+	// A single attempt when nil
+	Policy RetryPolicy
+	// ClassifyError when nil
+	Classify func(error) ErrorClass
+	// Optional, shared by everything using this Retrier
+	Budget *RetryBudget
+}
+
+// DefaultRetrier retries transient failures with exponential backoff for up to
+// a minute
+func DefaultRetrier() *Retrier {
+	return &Retrier{
+		Policy: MaxElapsedPolicy{
+			Policy: ExponentialPolicy{Initial: 200 * time.Millisecond, Max: 10 * time.Second, MaxAttempts: 8},
+			Limit:  time.Minute,
+		},
+		Budget: &RetryBudget{Ratio: 0.2, MinTokens: 10},
+	}
+}
+
+// Do calls fn until it succeeds, fails permanently, the policy or budget gives
+// up or the context is done. The last error is returned.
+func (r *Retrier) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	classify := r.Classify
+	if classify == nil {
+		classify = ClassifyError
+	}
+	if r.Budget != nil {
+		r.Budget.deposit()
+	}
+
+	policy := r.Policy
+	if policy == nil {
+		policy = ConstantPolicy{MaxAttempts: 1}
+	}
+	backoff := policy.Start()
+	for {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if classify(err) == Permanent || ctx.Err() != nil {
+			return err
+		}
+
+		delay, ok := backoff.Next()
+		if !ok {
+			return err
+		}
+		if r.Budget != nil && !r.Budget.withdraw() {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// RetryTransport retries a wrapped transport
+type RetryTransport struct {
+	Transport Transport
+	Retrier   *Retrier
+}
+
+func (t *RetryTransport) Send(ctx context.Context, msg *Message) error {
+	return t.Retrier.Do(ctx, func(ctx context.Context) error {
+		return t.Transport.Send(ctx, msg)
+	})
+}
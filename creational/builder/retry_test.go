@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func delays(p RetryPolicy) []time.Duration {
+	var out []time.Duration
+	b := p.Start()
+	for {
+		d, ok := b.Next()
+		if !ok {
+			return out
+		}
+		out = append(out, d)
+	}
+}
+
+func TestRetryPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		want   []time.Duration
+	}{
+		{"constant", ConstantPolicy{Delay: time.Second, MaxAttempts: 3}, []time.Duration{time.Second, time.Second}},
+		{"single attempt", ConstantPolicy{Delay: time.Second, MaxAttempts: 1}, nil},
+		{"exponential", ExponentialPolicy{Initial: time.Second, Max: 5 * time.Second, MaxAttempts: 5},
+			[]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}},
+		{"multiplier", ExponentialPolicy{Initial: time.Second, Multiplier: 3, MaxAttempts: 4},
+			[]time.Duration{time.Second, 3 * time.Second, 9 * time.Second}},
+		// the next attempt would start after the limit
+		{"max elapsed", MaxElapsedPolicy{Policy: ConstantPolicy{Delay: time.Second, MaxAttempts: 10}, Limit: 500 * time.Millisecond}, nil},
+	}
+	for _, tt := range tests {
+		got := delays(tt.policy)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: delays = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecorrelatedJitterStaysInBounds(t *testing.T) {
+	p := DecorrelatedJitterPolicy{Base: 10 * time.Millisecond, Cap: time.Second, MaxAttempts: 50}
+	got := delays(p)
+	if len(got) != 49 {
+		t.Fatalf("%d delays, want 49", len(got))
+	}
+	for _, d := range got {
+		if d < p.Base || d > p.Cap {
+			t.Errorf("delay %v outside [%v, %v]", d, p.Base, p.Cap)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"marked transient", TransientError(errors.New("x")), Transient},
+		{"marked permanent", PermanentError(&textproto.Error{Code: 421}), Permanent},
+		{"smtp 4xx", &textproto.Error{Code: 450, Msg: "mailbox busy"}, Transient},
+		{"smtp 5xx", fmt.Errorf("rcpt: %w", &textproto.Error{Code: 550, Msg: "no such user"}), Permanent},
+		{"timeout", timeoutError{}, Transient},
+		{"connection refused", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, Transient},
+		{"connection dropped", io.ErrUnexpectedEOF, Transient},
+		{"cancelled", context.Canceled, Permanent},
+		{"validation", ErrNoRecipient, Permanent},
+		{"unknown", errors.New("something else"), Permanent},
+	}
+	for _, tt := range tests {
+		if got := ClassifyError(tt.err); got != tt.want {
+			t.Errorf("%s: class = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetrierDo(t *testing.T) {
+	fast := ConstantPolicy{Delay: time.Millisecond, MaxAttempts: 4}
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		ok       bool
+	}{
+		{"first try", nil, 1, true},
+		{"recovers", []error{TransientError(errors.New("busy")), TransientError(errors.New("busy"))}, 3, true},
+		{"permanent", []error{PermanentError(errors.New("rejected"))}, 1, false},
+		{"gives up", []error{io.EOF, io.EOF, io.EOF, io.EOF, io.EOF}, 4, false},
+	}
+	for _, tt := range tests {
+		r := &Retrier{Policy: fast}
+		attempts := 0
+		err := r.Do(context.Background(), func(ctx context.Context) error {
+			attempts++
+			if attempts <= len(tt.errs) {
+				return tt.errs[attempts-1]
+			}
+			return nil
+		})
+		if attempts != tt.attempts || (err == nil) != tt.ok {
+			t.Errorf("%s: %d attempts, err %v; want %d attempts, ok %v", tt.name, attempts, err, tt.attempts, tt.ok)
+		}
+	}
+}
+
+func TestZeroRetrierTriesOnce(t *testing.T) {
+	var r Retrier
+	attempts := 0
+	err := r.Do(context.Background(), func(ctx context.Context) error {
+		attempts++
+		return TransientError(errors.New("busy"))
+	})
+	if attempts != 1 || err == nil {
+		t.Errorf("%d attempts, err %v; want 1 attempt and an error", attempts, err)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	r := &Retrier{
+		Policy: ConstantPolicy{Delay: time.Microsecond, MaxAttempts: 100},
+		Budget: &RetryBudget{Ratio: 0, MinTokens: 3},
+	}
+	attempts := 0
+	r.Do(context.Background(), func(ctx context.Context) error {
+		attempts++
+		return io.EOF
+	})
+	if attempts != 4 {
+		t.Errorf("%d attempts, want the first one and 3 retries", attempts)
+	}
+}
+
+func TestRetrierStopsOnCancel(t *testing.T) {
+	r := &Retrier{Policy: ConstantPolicy{Delay: time.Hour, MaxAttempts: 3}}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := r.Do(ctx, func(ctx context.Context) error { return io.EOF })
+	if err != io.EOF || time.Since(start) > time.Second {
+		t.Errorf("err = %v after %v", err, time.Since(start))
+	}
+}
+
+func TestSMTPTransportRejectsMissingRecipient(t *testing.T) {
+	tr := &SMTPTransport{}
+	err := tr.Send(context.Background(), &Message{ID: "m"})
+	if !errors.Is(err, ErrNoRecipient) || ClassifyError(err) != Permanent {
+		t.Errorf("err = %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Schemas describe the shape of a message body for a given format. Every time a
+// format evolves a new version gets registered and is checked against the latest
+// known version, so that producers and consumers do not drift apart silently.
+
+// FieldType is the type of a single field inside a schema
+type FieldType string
+
+const (
+	StringField FieldType = "string"
+	NumberField FieldType = "number"
+	BoolField   FieldType = "bool"
+)
+
+// Field describes one field of a message body
+type Field struct {
+	Type     FieldType
+	Required bool
+}
+
+// Schema is one registered version of a message format
+type Schema struct {
+	// Unique identifier, stamped into built messages
+	ID string
+	// Message Format this schema applies to
+	Format string
+	// Version within the format, starting at 1
+	Version int
+	// Fields keyed by their name in the body
+	Fields map[string]Field
+}
+
+// CompatibilityMode decides which changes are allowed between two versions
+type CompatibilityMode int
+
+const (
+	// No checks are performed
+	CompatibilityNone CompatibilityMode = iota
+	// Consumers using the new schema can read data written with the old one
+	CompatibilityBackward
+	// Consumers using the old schema can read data written with the new one
+	CompatibilityForward
+	// Both backward and forward
+	CompatibilityFull
+)
+
+func (m CompatibilityMode) String() string {
+	switch m {
+	case CompatibilityNone:
+		return "none"
+	case CompatibilityBackward:
+		return "backward"
+	case CompatibilityForward:
+		return "forward"
+	case CompatibilityFull:
+		return "full"
+	}
+	return fmt.Sprintf("CompatibilityMode(%d)", int(m))
+}
+
+var (
+	ErrSchemaNotFound     = errors.New("schema not found")
+	ErrSchemaIncompatible = errors.New("schema is incompatible")
+)
+
+// SchemaRegistry stores versioned schemas for each message format
+type SchemaRegistry struct {
+	mu       sync.RWMutex
+	modes    map[string]CompatibilityMode
+	versions map[string][]*Schema
+	byID     map[string]*Schema
+	// Mode used for formats without an explicit one
+	DefaultMode CompatibilityMode
+}
+
+func NewSchemaRegistry(defaultMode CompatibilityMode) *SchemaRegistry {
+	return &SchemaRegistry{
+		modes:       make(map[string]CompatibilityMode),
+		versions:    make(map[string][]*Schema),
+		byID:        make(map[string]*Schema),
+		DefaultMode: defaultMode,
+	}
+}
+
+// SetMode overrides the compatibility mode of a single format
+func (r *SchemaRegistry) SetMode(format string, mode CompatibilityMode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.modes[format] = mode
+}
+
+// Register adds a new version of the format's schema, provided it is compatible
+// with the latest registered version.
+func (r *SchemaRegistry) Register(format string, fields map[string]Field) (*Schema, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mode, ok := r.modes[format]
+	if !ok {
+		mode = r.DefaultMode
+	}
+
+	versions := r.versions[format]
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		if err := checkCompatibility(mode, latest.Fields, fields); err != nil {
+			return nil, fmt.Errorf("%w: %s v%d -> v%d (%s): %v",
+				ErrSchemaIncompatible, format, latest.Version, latest.Version+1, mode, err)
+		}
+	}
+
+	copied := make(map[string]Field, len(fields))
+	for name, f := range fields {
+		copied[name] = f
+	}
+	s := &Schema{
+		Format:  format,
+		Version: len(versions) + 1,
+		Fields:  copied,
+	}
+	s.ID = fmt.Sprintf("%s-v%d", format, s.Version)
+
+	r.versions[format] = append(versions, s)
+	r.byID[s.ID] = s
+	return s, nil
+}
+
+// Latest returns the newest schema registered for the format
+func (r *SchemaRegistry) Latest(format string) (*Schema, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	versions := r.versions[format]
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%w: format %s", ErrSchemaNotFound, format)
+	}
+	return versions[len(versions)-1], nil
+}
+
+// Lookup returns the schema with the given ID
+func (r *SchemaRegistry) Lookup(id string) (*Schema, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.byID[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSchemaNotFound, id)
+	}
+	return s, nil
+}
+
+func checkCompatibility(mode CompatibilityMode, old, new map[string]Field) error {
+	switch mode {
+	case CompatibilityBackward:
+		return canRead(new, old)
+	case CompatibilityForward:
+		return canRead(old, new)
+	case CompatibilityFull:
+		if err := canRead(new, old); err != nil {
+			return err
+		}
+		return canRead(old, new)
+	}
+	return nil
+}
+
+// canRead reports whether a reader using the reader schema can consume data
+// written with the writer schema: every field the reader requires must be
+// written, and shared fields must keep their type.
+func canRead(reader, writer map[string]Field) error {
+	names := make([]string, 0, len(reader))
+	for name := range reader {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		rf := reader[name]
+		wf, ok := writer[name]
+		if !ok {
+			if rf.Required {
+				return fmt.Errorf("required field %q is not written", name)
+			}
+			continue
+		}
+		if rf.Type != wf.Type {
+			return fmt.Errorf("field %q changed type from %s to %s", name, wf.Type, rf.Type)
+		}
+		if rf.Required && !wf.Required {
+			return fmt.Errorf("field %q is required but may be missing", name)
+		}
+	}
+	return nil
+}
+
+// SchemaHeader carries the schema ID for transports that carry headers
+const SchemaHeader = "X-Schema-Id"
+
+// SchemaBuilder decorates a MessageBuilder and stamps the latest schema ID of
+// the built format into the message envelope: the SchemaHeader, plus a
+// "schema" field for JSON bodies and a "schema" attribute on the root element
+// of XML bodies, so that consumers see it whatever the transport
+type SchemaBuilder struct {
+	MessageBuilder
+	Registry *SchemaRegistry
+}
+
+func (b *SchemaBuilder) Message() (*Message, error) {
+	msg, err := b.MessageBuilder.Message()
+	if err != nil {
+		return nil, err
+	}
+
+	schema, err := b.Registry.Latest(msg.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	switch msg.Format {
+	case "JSON":
+		msg.Body, err = stampJSONSchema(msg.Body, schema.ID)
+	case "XML":
+		msg.Body, err = stampXMLSchema(msg.Body, schema.ID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("stamping schema %s: %w", schema.ID, err)
+	}
+
+	headers := make(map[string]string, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[SchemaHeader] = schema.ID
+	msg.Headers = headers
+	msg.SchemaID = schema.ID
+	return msg, nil
+}
+
+func stampJSONSchema(body []byte, id string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["schema"]; ok {
+		return nil, errors.New(`body already has a "schema" field`)
+	}
+	raw, err := json.Marshal(id)
+	if err != nil {
+		return nil, err
+	}
+	fields["schema"] = raw
+	return json.Marshal(fields)
+}
+
+func stampXMLSchema(body []byte, id string) ([]byte, error) {
+	var buf bytes.Buffer
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	enc := xml.NewEncoder(&buf)
+	root := true
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := tok.(xml.StartElement); ok && root {
+			root = false
+			for _, a := range start.Attr {
+				if a.Name.Local == "schema" {
+					return nil, errors.New(`root element already has a "schema" attribute`)
+				}
+			}
+			start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "schema"}, Value: id})
+			tok = start
+		}
+		if err := enc.EncodeToken(tok); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"testing"
+)
+
+func TestSchemaRegistryCompatibility(t *testing.T) {
+	v1 := map[string]Field{
+		"recipient": {Type: StringField, Required: true},
+		"message":   {Type: StringField, Required: true},
+	}
+	tests := []struct {
+		name string
+		v2   map[string]Field
+		// modes in which v2 is accepted
+		accepted []CompatibilityMode
+	}{
+		{
+			"optional field added",
+			map[string]Field{
+				"recipient": {Type: StringField, Required: true},
+				"message":   {Type: StringField, Required: true},
+				"priority":  {Type: NumberField},
+			},
+			[]CompatibilityMode{CompatibilityNone, CompatibilityBackward, CompatibilityForward, CompatibilityFull},
+		},
+		{
+			"required field added",
+			map[string]Field{
+				"recipient": {Type: StringField, Required: true},
+				"message":   {Type: StringField, Required: true},
+				"priority":  {Type: NumberField, Required: true},
+			},
+			[]CompatibilityMode{CompatibilityNone, CompatibilityForward},
+		},
+		{
+			"required field removed",
+			map[string]Field{
+				"recipient": {Type: StringField, Required: true},
+			},
+			[]CompatibilityMode{CompatibilityNone, CompatibilityBackward},
+		},
+		{
+			"field changed type",
+			map[string]Field{
+				"recipient": {Type: StringField, Required: true},
+				"message":   {Type: BoolField, Required: true},
+			},
+			[]CompatibilityMode{CompatibilityNone},
+		},
+	}
+	modes := []CompatibilityMode{CompatibilityNone, CompatibilityBackward, CompatibilityForward, CompatibilityFull}
+	for _, tt := range tests {
+		for _, mode := range modes {
+			want := false
+			for _, m := range tt.accepted {
+				want = want || m == mode
+			}
+
+			// once through the default mode, once through a per-format override
+			for _, r := range []*SchemaRegistry{NewSchemaRegistry(mode), NewSchemaRegistry(CompatibilityNone)} {
+				if r.DefaultMode != mode {
+					r.SetMode("JSON", mode)
+				}
+				if _, err := r.Register("JSON", v1); err != nil {
+					t.Fatal(err)
+				}
+				s, err := r.Register("JSON", tt.v2)
+				if want && err != nil {
+					t.Errorf("%s, %s: %v", tt.name, mode, err)
+				}
+				if !want && !errors.Is(err, ErrSchemaIncompatible) {
+					t.Errorf("%s, %s: err = %v, want %v", tt.name, mode, err, ErrSchemaIncompatible)
+				}
+				if want && s != nil && s.Version != 2 {
+					t.Errorf("%s, %s: version %d, want 2", tt.name, mode, s.Version)
+				}
+			}
+		}
+	}
+}
+
+func TestSchemaRegistryLookup(t *testing.T) {
+	r := NewSchemaRegistry(CompatibilityBackward)
+	if _, err := r.Latest("JSON"); !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("Latest before Register: err = %v, want %v", err, ErrSchemaNotFound)
+	}
+
+	v1, err := r.Register("JSON", map[string]Field{"message": {Type: StringField}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := r.Register("JSON", map[string]Field{"message": {Type: StringField}, "priority": {Type: NumberField}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Register("XML", map[string]Field{"body": {Type: StringField}}); err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := r.Latest("JSON")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != v2 || latest.ID != "JSON-v2" {
+		t.Errorf("Latest = %+v, want %+v", latest, v2)
+	}
+	for _, s := range []*Schema{v1, v2} {
+		got, err := r.Lookup(s.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != s {
+			t.Errorf("Lookup(%s) = %+v, want %+v", s.ID, got, s)
+		}
+	}
+	if _, err := r.Lookup("JSON-v3"); !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("Lookup(JSON-v3): err = %v, want %v", err, ErrSchemaNotFound)
+	}
+}
+
+func TestSchemaBuilderStampsEnvelope(t *testing.T) {
+	r := NewSchemaRegistry(CompatibilityNone)
+	for _, format := range []string{"JSON", "XML"} {
+		if _, err := r.Register(format, map[string]Field{"recipient": {Type: StringField}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jsonMsg, err := (&Sender{}).Build(&SchemaBuilder{MessageBuilder: &JSONMessageBuilder{}, Registry: r}, "kid@example.com", "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(jsonMsg.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["schema"] != "JSON-v1" || body["message"] != "hi" {
+		t.Errorf("JSON body = %s", jsonMsg.Body)
+	}
+	if jsonMsg.Headers[SchemaHeader] != "JSON-v1" || jsonMsg.SchemaID != "JSON-v1" {
+		t.Errorf("JSON envelope: headers %v, schema ID %q", jsonMsg.Headers, jsonMsg.SchemaID)
+	}
+
+	xmlMsg, err := (&Sender{}).Build(&SchemaBuilder{MessageBuilder: &XMLMessageBuilder{}, Registry: r}, "kid@example.com", "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root struct {
+		Schema string `xml:"schema,attr"`
+		Text   string `xml:"body"`
+	}
+	if err := xml.Unmarshal(xmlMsg.Body, &root); err != nil {
+		t.Fatal(err)
+	}
+	if root.Schema != "XML-v1" || root.Text != "hi" {
+		t.Errorf("XML body = %s", xmlMsg.Body)
+	}
+	if xmlMsg.Headers[SchemaHeader] != "XML-v1" {
+		t.Errorf("XML headers = %v", xmlMsg.Headers)
+	}
+
+	// no schema registered for the format
+	_, err = (&Sender{}).Build(&SchemaBuilder{MessageBuilder: &EmailMessageBuilder{}, Registry: r}, "kid@example.com", "hi")
+	if !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("unregistered format: err = %v, want %v", err, ErrSchemaNotFound)
+	}
+}
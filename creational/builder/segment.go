@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Segments select contacts with a small query language, e.g.
+//
+//	language = "de" AND tenant = "x" AND NOT messaged_within(7d)
+//
+// Grammar:
+//
+//	expr       = and { "OR" and }
+//	and        = unary { "AND" unary }
+//	unary      = "NOT" unary | "(" expr ")" | comparison | function
+//	comparison = field ( "=" | "!=" | "~" ) value | field "IN" "(" value { "," value } ")"
+//	function   = "messaged_within" "(" duration ")"
+//
+// Fields are "id", "address", "tenant" or any contact attribute. "~" is a case
+// insensitive substring match. Durations are Go durations or a number of days
+// like "7d".
+
+// MessageHistory tells when a contact was last messaged
+type MessageHistory interface {
+	LastMessaged(address string) (time.Time, bool)
+}
+
+// LifecycleHistory answers from the lifecycle store
+type LifecycleHistory struct {
+	Store *LifecycleStore
+}
+
+func (h LifecycleHistory) LastMessaged(address string) (time.Time, bool) {
+	return h.Snapshot().LastMessaged(address)
+}
+
+// Snapshot indexes the records by recipient, so looking up many contacts
+// walks the store once
+func (h LifecycleHistory) Snapshot() MessageHistory {
+	index := make(lastMessagedIndex)
+	for _, rec := range h.Store.Records() {
+		key := strings.ToLower(rec.Recipient)
+		if rec.BuiltAt.After(index[key]) {
+			index[key] = rec.BuiltAt
+		}
+	}
+	return index
+}
+
+// HistorySnapshotter is implemented by histories that are expensive to ask
+// one address at a time. ContactStore.Resolve takes one snapshot per call.
+type HistorySnapshotter interface {
+	Snapshot() MessageHistory
+}
+
+// lastMessagedIndex maps a lower case address to when it was last messaged
+type lastMessagedIndex map[string]time.Time
+
+func (idx lastMessagedIndex) LastMessaged(address string) (time.Time, bool) {
+	last, ok := idx[strings.ToLower(address)]
+	return last, ok
+}
+
+// Segment is a parsed query
+type Segment struct {
+	Query string
+	root  segmentNode
+}
+
+// SegmentEnv is what a segment is evaluated against besides the contact
+type SegmentEnv struct {
+	History MessageHistory
+	Now     time.Time
+}
+
+// Match reports whether the contact belongs to the segment
+func (s *Segment) Match(c *Contact, env SegmentEnv) bool {
+	return s.root.eval(c, env)
+}
+
+type segmentNode interface {
+	eval(c *Contact, env SegmentEnv) bool
+}
+
+type andNode struct{ left, right segmentNode }
+type orNode struct{ left, right segmentNode }
+type notNode struct{ inner segmentNode }
+
+type compareNode struct {
+	field  string
+	op     string
+	values []string
+}
+
+type messagedWithinNode struct{ d time.Duration }
+
+func (n andNode) eval(c *Contact, env SegmentEnv) bool {
+	return n.left.eval(c, env) && n.right.eval(c, env)
+}
+
+func (n orNode) eval(c *Contact, env SegmentEnv) bool {
+	return n.left.eval(c, env) || n.right.eval(c, env)
+}
+
+func (n notNode) eval(c *Contact, env SegmentEnv) bool {
+	return !n.inner.eval(c, env)
+}
+
+func (n compareNode) eval(c *Contact, env SegmentEnv) bool {
+	var v string
+	switch n.field {
+	case "id":
+		v = c.ID
+	case "address":
+		v = c.Address
+	case "tenant":
+		v = c.Tenant
+	default:
+		v = attribute(c.Attributes, n.field)
+	}
+
+	switch n.op {
+	case "=":
+		return strings.EqualFold(v, n.values[0])
+	case "!=":
+		return !strings.EqualFold(v, n.values[0])
+	case "~":
+		return strings.Contains(strings.ToLower(v), strings.ToLower(n.values[0]))
+	case "in":
+		for _, want := range n.values {
+			if strings.EqualFold(v, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// attribute looks up an attribute ignoring the case of its name, the query
+// fields are lower case
+func attribute(attrs map[string]string, name string) string {
+	if v, ok := attrs[name]; ok {
+		return v
+	}
+	for k, v := range attrs {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+func (n messagedWithinNode) eval(c *Contact, env SegmentEnv) bool {
+	if env.History == nil {
+		return false
+	}
+	last, ok := env.History.LastMessaged(c.Address)
+	return ok && env.Now.Sub(last) <= n.d
+}
+
+// ParseSegment parses a segment query
+func ParseSegment(query string) (*Segment, error) {
+	tokens, err := lexSegment(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &segmentParser{tokens: tokens}
+	root, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("segment: unexpected %q", p.tokens[p.pos].text)
+	}
+	return &Segment{Query: query, root: root}, nil
+}
+
+type segmentToken struct {
+	kind string // "word", "string", "op", "(", ")", ","
+	text string
+}
+
+func lexSegment(s string) ([]segmentToken, error) {
+	var tokens []segmentToken
+	for i := 0; i < len(s); {
+		r := rune(s[i])
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == ',':
+			tokens = append(tokens, segmentToken{string(r), string(r)})
+			i++
+		case r == '=' || r == '~':
+			tokens = append(tokens, segmentToken{"op", string(r)})
+			i++
+		case r == '!' && i+1 < len(s) && s[i+1] == '=':
+			tokens = append(tokens, segmentToken{"op", "!="})
+			i += 2
+		case r == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, errors.New("segment: unterminated string")
+			}
+			str, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("segment: %w", err)
+			}
+			tokens = append(tokens, segmentToken{"string", str})
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\r\n()=,~!\"", rune(s[j])) {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("segment: unexpected %q", s[i])
+			}
+			tokens = append(tokens, segmentToken{"word", s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type segmentParser struct {
+	tokens []segmentToken
+	pos    int
+}
+
+func (p *segmentParser) peek() *segmentToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *segmentParser) keyword(kw string) bool {
+	t := p.peek()
+	if t != nil && t.kind == "word" && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *segmentParser) expect(kind string) (segmentToken, error) {
+	t := p.peek()
+	if t == nil {
+		return segmentToken{}, fmt.Errorf("segment: expected %s, got end of query", kind)
+	}
+	if t.kind != kind {
+		return segmentToken{}, fmt.Errorf("segment: expected %s, got %q", kind, t.text)
+	}
+	p.pos++
+	return *t, nil
+}
+
+func (p *segmentParser) expr() (segmentNode, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *segmentParser) and() (segmentNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *segmentParser) unary() (segmentNode, error) {
+	if p.keyword("NOT") {
+		inner, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{inner}, nil
+	}
+
+	t := p.peek()
+	if t == nil {
+		return nil, errors.New("segment: unexpected end of query")
+	}
+	if t.kind == "(" {
+		p.pos++
+		inner, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+
+	field, err := p.expect("word")
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(field.text)
+
+	if name == "messaged_within" {
+		if _, err := p.expect("("); err != nil {
+			return nil, err
+		}
+		arg, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		d, err := parseSegmentDuration(arg)
+		if err != nil {
+			return nil, err
+		}
+		return messagedWithinNode{d}, nil
+	}
+
+	name = strings.TrimPrefix(name, "attributes.")
+	if p.keyword("IN") {
+		if _, err := p.expect("("); err != nil {
+			return nil, err
+		}
+		var values []string
+		for {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			if t := p.peek(); t != nil && t.kind == "," {
+				p.pos++
+				continue
+			}
+			break
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return compareNode{field: name, op: "in", values: values}, nil
+	}
+
+	op, err := p.expect("op")
+	if err != nil {
+		return nil, err
+	}
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	return compareNode{field: name, op: op.text, values: []string{v}}, nil
+}
+
+func (p *segmentParser) value() (string, error) {
+	t := p.peek()
+	if t == nil || (t.kind != "word" && t.kind != "string") {
+		if t == nil {
+			return "", errors.New("segment: expected value, got end of query")
+		}
+		return "", fmt.Errorf("segment: expected value, got %q", t.text)
+	}
+	p.pos++
+	return t.text, nil
+}
+
+func parseSegmentDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("segment: bad duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("segment: bad duration %q", s)
+	}
+	return d, nil
+}
+
+// ContactStore holds contacts and saved segments. It is an AudienceResolver:
+// a query is either "segment:NAME" for a saved segment or a segment query.
+type ContactStore struct {
+	History MessageHistory
+	// Clock, time.Now when nil
+	Now func() time.Time
+
+	mu       sync.RWMutex
+	contacts map[string]Contact
+	segments map[string]*Segment
+}
+
+func NewContactStore(history MessageHistory) *ContactStore {
+	return &ContactStore{
+		History:  history,
+		contacts: make(map[string]Contact),
+		segments: make(map[string]*Segment),
+	}
+}
+
+// Put adds or replaces a contact
+func (s *ContactStore) Put(c Contact) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.contacts[c.ID] = c
+}
+
+// SaveSegment parses and stores a segment under a name
+func (s *ContactStore) SaveSegment(name, query string) (*Segment, error) {
+	seg, err := ParseSegment(query)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.segments[name] = seg
+	return seg, nil
+}
+
+// Segments returns the saved segments by name
+func (s *ContactStore) Segments() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]string, len(s.segments))
+	for name, seg := range s.segments {
+		out[name] = seg.Query
+	}
+	return out
+}
+
+func (s *ContactStore) segment(query string) (*Segment, error) {
+	if name, ok := strings.CutPrefix(query, "segment:"); ok {
+		s.mu.RLock()
+		seg, found := s.segments[name]
+		s.mu.RUnlock()
+		if !found {
+			return nil, fmt.Errorf("segment %q not found", name)
+		}
+		return seg, nil
+	}
+	return ParseSegment(query)
+}
+
+// Resolve returns the matching contacts ordered by ID
+func (s *ContactStore) Resolve(ctx context.Context, query string) ([]Contact, error) {
+	seg, err := s.segment(query)
+	if err != nil {
+		return nil, err
+	}
+
+	env := SegmentEnv{History: s.History, Now: time.Now()}
+	if s.Now != nil {
+		env.Now = s.Now()
+	}
+	if snapshotter, ok := s.History.(HistorySnapshotter); ok {
+		env.History = snapshotter.Snapshot()
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []Contact
+	for _, c := range s.contacts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if seg.Match(&c, env) {
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// Count previews how many contacts a query selects
+func (s *ContactStore) Count(ctx context.Context, query string) (int, error) {
+	contacts, err := s.Resolve(ctx, query)
+	return len(contacts), err
+}
+
+// Handler exposes the saved segments and audience counts over HTTP:
+//
+//	GET /segments
+//	GET /segments/count?query=QUERY   QUERY may be "segment:NAME"
+func (s *ContactStore) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /segments", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Segments())
+	})
+	mux.HandleFunc("GET /segments/count", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		if query == "" {
+			http.Error(w, "query is required", http.StatusBadRequest)
+			return
+		}
+		n, err := s.Count(r.Context(), query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"query": query, "count": n})
+	})
+	return mux
+}
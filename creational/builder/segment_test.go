@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestContactStore(history MessageHistory) *ContactStore {
+	s := NewContactStore(history)
+	s.Now = func() time.Time { return time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC) }
+	s.Put(Contact{ID: "1", Address: "a@example.com", Tenant: "x", Attributes: map[string]string{"Language": "de"}})
+	s.Put(Contact{ID: "2", Address: "B@example.com", Tenant: "x", Attributes: map[string]string{"language": "en"}})
+	s.Put(Contact{ID: "3", Address: "c@example.com", Tenant: "y", Attributes: map[string]string{"LANGUAGE": "DE"}})
+	return s
+}
+
+func TestContactStoreResolve(t *testing.T) {
+	store := NewLifecycleStore()
+	for _, rec := range []LifecycleRecord{
+		{MessageID: "m1", Recipient: "b@example.com", BuiltAt: time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC)},
+		{MessageID: "m2", Recipient: "c@example.com", BuiltAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		rec := rec
+		store.records[rec.MessageID] = &rec
+	}
+	s := newTestContactStore(LifecycleHistory{Store: store})
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{`language = "de"`, []string{"1", "3"}},
+		{`Language = de`, []string{"1", "3"}},
+		{`attributes.LANGUAGE IN (en, fr)`, []string{"2"}},
+		{`tenant = x AND NOT messaged_within(7d)`, []string{"1"}},
+		{`messaged_within(7d) OR tenant = y`, []string{"2", "3"}},
+		{`address ~ "B@"`, []string{"2"}},
+	}
+	for _, tt := range tests {
+		got, err := s.Resolve(context.Background(), tt.query)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		var ids []string
+		for _, c := range got {
+			ids = append(ids, c.ID)
+		}
+		if len(ids) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.query, ids, tt.want)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.query, ids, tt.want)
+				break
+			}
+		}
+	}
+}
+
+type countingHistory struct {
+	lookups   int
+	snapshots int
+}
+
+func (h *countingHistory) LastMessaged(address string) (time.Time, bool) {
+	h.lookups++
+	return time.Time{}, false
+}
+
+func (h *countingHistory) Snapshot() MessageHistory {
+	h.snapshots++
+	return lastMessagedIndex{}
+}
+
+func TestContactStoreResolveSnapshotsHistory(t *testing.T) {
+	h := &countingHistory{}
+	s := newTestContactStore(h)
+	if _, err := s.Resolve(context.Background(), "NOT messaged_within(1d)"); err != nil {
+		t.Fatal(err)
+	}
+	if h.snapshots != 1 || h.lookups != 0 {
+		t.Errorf("%d snapshots and %d lookups, want one snapshot", h.snapshots, h.lookups)
+	}
+}
+
+func TestSegmentCountCommand(t *testing.T) {
+	s := newTestContactStore(nil)
+	if _, err := s.SaveSegment("german", `language = de`); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"segment:german", 2},
+		{"tenant = y", 1},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := runCommand([]string{"segment", "count", "-addr", srv.URL, "-query", tt.query}, &out); err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		var got struct {
+			Count int `json:"count"`
+		}
+		if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Count != tt.want {
+			t.Errorf("%s: count = %d, want %d", tt.query, got.Count, tt.want)
+		}
+	}
+
+	if err := runCommand([]string{"segment", "count", "-addr", srv.URL, "-query", "segment:missing"}, &bytes.Buffer{}); err == nil {
+		t.Error("unknown segment: no error")
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"mime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S/MIME signing wraps an email built by the EmailMessageBuilder into a
+// multipart/signed message (RFC 8551) with a detached CMS SignedData signature
+// (RFC 5652). The CMS structure is encoded by hand with encoding/asn1; only
+// what S/MIME signing needs is implemented: SHA-256, RSA or ECDSA keys and one
+// signer.
+
+var (
+	oidData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+var (
+	ErrNotSigned         = errors.New("message is not S/MIME signed")
+	ErrSignatureMismatch = errors.New("S/MIME signature does not match the content")
+)
+
+// Content is the [0] EXPLICIT wrapper, its Bytes hold the inner structure
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsEncapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                cmsIssuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type cmsIssuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// SMIMESigner signs with a certificate and its private key
+type SMIMESigner struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+	// Sent along so recipients can build the chain
+	Intermediates []*x509.Certificate
+	// Clock for the signing time, time.Now when nil
+	Now func() time.Time
+}
+
+// Sign returns the DER encoded detached CMS signature of content
+func (s *SMIMESigner) Sign(content []byte) ([]byte, error) {
+	digest := sha256.Sum256(content)
+	now := time.Now()
+	if s.Now != nil {
+		now = s.Now()
+	}
+
+	attrs, err := marshalSignedAttrs(digest[:], now)
+	if err != nil {
+		return nil, err
+	}
+	// the signature covers the attributes encoded as a SET, not as [0]
+	attrsDigest := sha256.Sum256(append([]byte{0x31}, attrs.FullBytes[1:]...))
+
+	var sigAlg pkix.AlgorithmIdentifier
+	switch s.Key.Public().(type) {
+	case *rsa.PublicKey:
+		sigAlg = pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		sigAlg = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", s.Key.Public())
+	}
+	signature, err := s.Key.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []byte
+	certs = append(certs, s.Certificate.Raw...)
+	for _, c := range s.Intermediates {
+		certs = append(certs, c.Raw...)
+	}
+
+	sha256Alg := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	signed := cmsSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Alg},
+		EncapContentInfo: cmsEncapContentInfo{EContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos: []cmsSignerInfo{{
+			Version: 1,
+			SID: cmsIssuerAndSerial{
+				Issuer: asn1.RawValue{FullBytes: s.Certificate.RawIssuer},
+				Serial: s.Certificate.SerialNumber,
+			},
+			DigestAlgorithm:    sha256Alg,
+			SignedAttrs:        attrs,
+			SignatureAlgorithm: sigAlg,
+			Signature:          signature,
+		}},
+	}
+	inner, err := asn1.Marshal(signed)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(cmsContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner},
+	})
+}
+
+func marshalSignedAttrs(digest []byte, signingTime time.Time) (asn1.RawValue, error) {
+	value := func(v interface{}) (asn1.RawValue, error) {
+		b, err := asn1.Marshal(v)
+		return asn1.RawValue{FullBytes: b}, err
+	}
+
+	contentType, err := value(oidData)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	messageDigest, err := value(digest)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	signedAt, err := value(signingTime.UTC())
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+
+	var encoded [][]byte
+	for _, a := range []cmsAttribute{
+		{Type: oidContentType, Values: []asn1.RawValue{contentType}},
+		{Type: oidMessageDigest, Values: []asn1.RawValue{messageDigest}},
+		{Type: oidSigningTime, Values: []asn1.RawValue{signedAt}},
+	} {
+		b, err := asn1.Marshal(a)
+		if err != nil {
+			return asn1.RawValue{}, err
+		}
+		encoded = append(encoded, b)
+	}
+	// DER sorts the members of a SET OF by their encoding
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+
+	raw := asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: bytes.Join(encoded, nil)}
+	full, err := asn1.Marshal(raw)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	raw.FullBytes = full
+	return raw, nil
+}
+
+// SignEmail turns an email body built by the EmailMessageBuilder into a
+// multipart/signed body
+func (s *SMIMESigner) SignEmail(body []byte) ([]byte, error) {
+	outer, entity, err := splitEntity(body)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := s.Sign(entity)
+	if err != nil {
+		return nil, err
+	}
+
+	boundary := newBoundary()
+	var buf bytes.Buffer
+	for _, h := range outer {
+		buf.WriteString(h + "\r\n")
+	}
+	fmt.Fprintf(&buf, "Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=sha-256; boundary=%q\r\n\r\n", boundary)
+	fmt.Fprintf(&buf, "This is a cryptographically signed message in MIME format.\r\n\r\n")
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.Write(entity)
+	fmt.Fprintf(&buf, "\r\n--%s\r\n", boundary)
+	buf.WriteString("Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+	buf.WriteString("Content-Disposition: attachment; filename=\"smime.p7s\"\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString(signature)
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+	return buf.Bytes(), nil
+}
+
+// splitEntity separates the message level headers (Subject, MIME-Version, ...)
+// from the MIME entity to be signed (Content-* headers and the body). The
+// entity is returned with CRLF line endings, as required for signing.
+func splitEntity(body []byte) ([]string, []byte, error) {
+	canonical := bytes.ReplaceAll(bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+	head, rest, ok := bytes.Cut(canonical, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, nil, errors.New("email body has no header section")
+	}
+
+	// unfold continuation lines into their header
+	var headers []string
+	for _, line := range strings.Split(string(head), "\r\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(headers) > 0 {
+			headers[len(headers)-1] += "\r\n" + line
+			continue
+		}
+		headers = append(headers, line)
+	}
+
+	var outer []string
+	var entity bytes.Buffer
+	for _, h := range headers {
+		if strings.HasPrefix(strings.ToLower(h), "content-") {
+			entity.WriteString(h + "\r\n")
+		} else {
+			outer = append(outer, h)
+		}
+	}
+	entity.WriteString("\r\n")
+	entity.Write(rest)
+	return outer, bytes.TrimSuffix(entity.Bytes(), []byte("\r\n")), nil
+}
+
+// SMIMEBuilder decorates an email builder and signs what it builds
+type SMIMEBuilder struct {
+	MessageBuilder
+	Signer *SMIMESigner
+}
+
+func (b *SMIMEBuilder) Message() (*Message, error) {
+	msg, err := b.MessageBuilder.Message()
+	if err != nil {
+		return nil, err
+	}
+	if msg.Format != "EMAIL" {
+		return nil, fmt.Errorf("S/MIME signing needs an EMAIL message, got %s", msg.Format)
+	}
+	if msg.Body, err = b.Signer.SignEmail(msg.Body); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// VerifySMIME checks a multipart/signed email body against the trusted roots
+// and returns the signer's certificate
+func VerifySMIME(body []byte, roots *x509.CertPool) (*x509.Certificate, error) {
+	canonical := bytes.ReplaceAll(bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+	head, rest, ok := bytes.Cut(canonical, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, ErrNotSigned
+	}
+
+	var boundary string
+	for _, line := range strings.Split(strings.ReplaceAll(string(head), "\r\n\t", " "), "\r\n") {
+		name, value, _ := strings.Cut(line, ":")
+		if !strings.EqualFold(name, "Content-Type") {
+			continue
+		}
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(value))
+		if err != nil || mediaType != "multipart/signed" {
+			return nil, ErrNotSigned
+		}
+		boundary = params["boundary"]
+	}
+	if boundary == "" {
+		return nil, ErrNotSigned
+	}
+
+	delim := []byte("--" + boundary + "\r\n")
+	start := bytes.Index(rest, delim)
+	if start < 0 {
+		return nil, ErrNotSigned
+	}
+	rest = rest[start+len(delim):]
+	end := bytes.Index(rest, []byte("\r\n--"+boundary+"\r\n"))
+	if end < 0 {
+		return nil, ErrNotSigned
+	}
+	content := rest[:end]
+	sigPart := rest[end+len("\r\n--"+boundary+"\r\n"):]
+
+	_, sigBody, ok := bytes.Cut(sigPart, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, ErrNotSigned
+	}
+	if i := bytes.Index(sigBody, []byte("--"+boundary+"--")); i >= 0 {
+		sigBody = sigBody[:i]
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(sigBody)), ""))
+	if err != nil {
+		return nil, fmt.Errorf("signature part: %w", err)
+	}
+	return verifyCMS(der, content, roots)
+}
+
+func verifyCMS(der, content []byte, roots *x509.CertPool) (*x509.Certificate, error) {
+	var info cmsContentInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("CMS: %w", err)
+	}
+	if !info.ContentType.Equal(oidSignedData) || info.Content.Class != asn1.ClassContextSpecific || info.Content.Tag != 0 {
+		return nil, ErrNotSigned
+	}
+	var signed cmsSignedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &signed); err != nil {
+		return nil, fmt.Errorf("CMS SignedData: %w", err)
+	}
+	if len(signed.SignerInfos) != 1 {
+		return nil, fmt.Errorf("CMS: expected one signer, got %d", len(signed.SignerInfos))
+	}
+	si := signed.SignerInfos[0]
+	if !si.DigestAlgorithm.Algorithm.Equal(oidSHA256) {
+		return nil, fmt.Errorf("CMS: unsupported digest %v", si.DigestAlgorithm.Algorithm)
+	}
+
+	certs, err := x509.ParseCertificates(signed.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("CMS certificates: %w", err)
+	}
+	var signer *x509.Certificate
+	intermediates := x509.NewCertPool()
+	for _, c := range certs {
+		if bytes.Equal(c.RawIssuer, si.SID.Issuer.FullBytes) && c.SerialNumber.Cmp(si.SID.Serial) == 0 {
+			signer = c
+		} else {
+			intermediates.AddCert(c)
+		}
+	}
+	if signer == nil {
+		return nil, errors.New("CMS: signer certificate not included")
+	}
+	if _, err := signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}); err != nil {
+		return nil, err
+	}
+
+	// the content digest must match the signed messageDigest attribute
+	var attrs []cmsAttribute
+	if _, err := asn1.UnmarshalWithParams(si.SignedAttrs.FullBytes, &attrs, "set,tag:0"); err != nil {
+		return nil, fmt.Errorf("CMS signed attributes: %w", err)
+	}
+	var digest []byte
+	for _, a := range attrs {
+		if a.Type.Equal(oidMessageDigest) && len(a.Values) == 1 {
+			if _, err := asn1.Unmarshal(a.Values[0].FullBytes, &digest); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sum := sha256.Sum256(content)
+	if !bytes.Equal(digest, sum[:]) {
+		return nil, ErrSignatureMismatch
+	}
+
+	signedBytes := append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	var alg x509.SignatureAlgorithm
+	switch {
+	case si.SignatureAlgorithm.Algorithm.Equal(oidRSAEncryption):
+		alg = x509.SHA256WithRSA
+	case si.SignatureAlgorithm.Algorithm.Equal(oidECDSAWithSHA256):
+		alg = x509.ECDSAWithSHA256
+	default:
+		return nil, fmt.Errorf("CMS: unsupported signature algorithm %v", si.SignatureAlgorithm.Algorithm)
+	}
+	if err := signer.CheckSignature(alg, signedBytes, si.Signature); err != nil {
+		return nil, ErrSignatureMismatch
+	}
+	return signer, nil
+}
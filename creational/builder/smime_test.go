@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+func (ca *testCA) issue(t *testing.T, key crypto.Signer, email string) *x509.Certificate {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: email},
+		EmailAddresses: []string{email},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestSMIMESignVerifyRoundTrip(t *testing.T) {
+	ca := newTestCA(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		cert := ca.issue(t, key, "santa@example.com")
+		b := &SMIMEBuilder{
+			MessageBuilder: &EmailMessageBuilder{Subject: "Presents"},
+			Signer:         &SMIMESigner{Certificate: cert, Key: key},
+		}
+		b.SetRecipient("kid@example.com")
+		b.SetText("Your presents are on their way")
+		msg, err := b.Message()
+		if err != nil {
+			t.Fatalf("%T: %v", key, err)
+		}
+
+		signer, err := VerifySMIME(msg.Body, ca.pool)
+		if err != nil {
+			t.Fatalf("%T: verify: %v", key, err)
+		}
+		if !signer.Equal(cert) {
+			t.Errorf("%T: verified signer %s, want %s", key, signer.Subject, cert.Subject)
+		}
+
+		// LF line endings, as after a round trip through a Unix mailbox
+		if _, err := VerifySMIME(bytes.ReplaceAll(msg.Body, []byte("\r\n"), []byte("\n")), ca.pool); err != nil {
+			t.Errorf("%T: verify with LF line endings: %v", key, err)
+		}
+
+		tampered := bytes.Replace(msg.Body, []byte("presents"), []byte("presentz"), 1)
+		if bytes.Equal(tampered, msg.Body) {
+			t.Fatal("text not found in the body")
+		}
+		if _, err := VerifySMIME(tampered, ca.pool); !errors.Is(err, ErrSignatureMismatch) {
+			t.Errorf("%T: tampered: err = %v, want %v", key, err, ErrSignatureMismatch)
+		}
+
+		if _, err := VerifySMIME(msg.Body, newTestCA(t).pool); err == nil {
+			t.Errorf("%T: verified against an unrelated root", key)
+		}
+	}
+}
+
+func TestVerifySMIMERejectsUnsigned(t *testing.T) {
+	b := &EmailMessageBuilder{}
+	b.SetRecipient("kid@example.com")
+	b.SetText("hello")
+	msg, err := b.Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifySMIME(msg.Body, x509.NewCertPool()); !errors.Is(err, ErrNotSigned) {
+		t.Errorf("err = %v, want %v", err, ErrNotSigned)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SMTPTransport delivers messages by mail. Connections to the server are
+// pooled and checked with NOOP before they are reused.
+type SMTPTransport struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+	// Used for STARTTLS when the server offers it, nil uses the host name
+	TLSConfig *tls.Config
+	// Retries failed sends, leave nil when a Dispatcher retries already
+	Retrier *Retrier
+
+	pool *Pool[*smtp.Client]
+}
+
+// NewSMTPTransport creates a transport keeping up to maxConns connections,
+// idle ones are closed after idleTimeout
+func NewSMTPTransport(addr, from string, auth smtp.Auth, maxConns int, idleTimeout time.Duration) *SMTPTransport {
+	t := &SMTPTransport{Addr: addr, From: from, Auth: auth}
+	t.pool = NewPool(PoolConfig[*smtp.Client]{
+		New:         t.dial,
+		Close:       func(c *smtp.Client) error { return c.Close() },
+		Check:       func(c *smtp.Client) error { return c.Noop() },
+		MaxSize:     maxConns,
+		IdleTimeout: idleTimeout,
+	})
+	return t
+}
+
+func (t *SMTPTransport) dial(ctx context.Context) (*smtp.Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", t.Addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(t.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		config := t.TLSConfig
+		if config == nil {
+			config = &tls.Config{ServerName: host}
+		}
+		if err := c.StartTLS(config); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if t.Auth != nil {
+		if err := c.Auth(t.Auth); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+var ErrNoRecipient = errors.New("message has no recipient")
+
+// Send delivers the message to its recipient
+func (t *SMTPTransport) Send(ctx context.Context, msg *Message) error {
+	if msg.Recipient == "" {
+		return PermanentError(fmt.Errorf("%w: %s", ErrNoRecipient, msg.ID))
+	}
+	if t.Retrier == nil {
+		return t.sendPooled(ctx, msg)
+	}
+	return t.Retrier.Do(ctx, func(ctx context.Context) error {
+		return t.sendPooled(ctx, msg)
+	})
+}
+
+func (t *SMTPTransport) sendPooled(ctx context.Context, msg *Message) error {
+	c, err := t.pool.Get(ctx)
+	if err != nil {
+		return err
+	}
+	if err := t.send(c, msg); err != nil {
+		// the connection is in an unknown state
+		t.pool.Discard(c)
+		return err
+	}
+	t.pool.Put(c)
+	return nil
+}
+
+func (t *SMTPTransport) send(c *smtp.Client, msg *Message) error {
+	if err := c.Mail(t.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.Recipient); err != nil {
+		c.Reset()
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(mailData(t.From, msg)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// mailData wraps the message body into a mail
+func mailData(from string, msg *Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.Recipient)
+	if msg.ID != "" {
+		fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", msg.ID, mailDomain(from))
+	}
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	for _, name := range sortedHeaderNames(msg.Headers) {
+		fmt.Fprintf(&b, "%s: %s\r\n", textproto.CanonicalMIMEHeaderKey(name), msg.Headers[name])
+	}
+	if msg.Format == "EMAIL" {
+		// the body is a MIME entity with its own headers
+		b.Write(msg.Body)
+		b.WriteString("\r\n")
+		return []byte(b.String())
+	}
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: %s; charset=utf-8\r\n", contentType(msg.Format))
+	b.WriteString("\r\n")
+	b.Write(msg.Body)
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
+
+func sortedHeaderNames(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func mailDomain(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return strings.Trim(addr[i+1:], "<> ")
+	}
+	return "localhost"
+}
+
+func contentType(format string) string {
+	switch format {
+	case "JSON":
+		return "application/json"
+	case "XML":
+		return "application/xml"
+	case "HTML":
+		return "text/html"
+	}
+	return "text/plain"
+}
+
+// Stats returns the connection pool metrics
+func (t *SMTPTransport) Stats() PoolStats {
+	return t.pool.Stats()
+}
+
+// Close closes all pooled connections
+func (t *SMTPTransport) Close() {
+	t.pool.Close()
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Messages kept on disk (outbox, archive, drafts) are encrypted at rest. Each
+// file gets its own random data key; the data key is wrapped for the keyring's
+// active encryption key (X25519 + HKDF + AES-GCM) and stored in the file
+// header. Rotating the keyring is followed by a background re-encryption pass
+// that rewraps every file for the new key.
+//
+// File layout:
+//
+//	magic "MSE1" | key ID length (1 byte) | key ID | ephemeral public key (32 bytes)
+//	| wrapped data key (nonce + sealed key) | data nonce | sealed data
+//
+// The whole header and the file name are authenticated together with the data,
+// so tampering with any byte, or swapping files around, is rejected on read.
+
+var storageMagic = []byte("MSE1")
+
+const dataKeySize = 32
+
+var (
+	ErrStoreTampered = errors.New("stored file failed authentication")
+	ErrStoreNotFound = errors.New("stored file not found")
+)
+
+// EncryptedStore is a directory of encrypted files
+type EncryptedStore struct {
+	Dir     string
+	Keyring *Keyring
+
+	// writes to the same name are serialized, so re-encryption never
+	// overwrites a newer Put
+	locks [64]sync.Mutex
+}
+
+func NewEncryptedStore(dir string, keyring *Keyring) (*EncryptedStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &EncryptedStore{Dir: dir, Keyring: keyring}, nil
+}
+
+func (s *EncryptedStore) path(name string) (string, error) {
+	// .tmp files are where writes are staged
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." || strings.HasSuffix(name, ".tmp") {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return filepath.Join(s.Dir, name), nil
+}
+
+func (s *EncryptedStore) lock(name string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	mu := &s.locks[h.Sum32()%uint32(len(s.locks))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// Put encrypts data and writes it under name
+func (s *EncryptedStore) Put(name string, data []byte) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	defer s.lock(name)()
+	return s.put(path, name, data)
+}
+
+func (s *EncryptedStore) put(path, name string, data []byte) error {
+	key, err := s.Keyring.Active(KeyUseEncrypt)
+	if err != nil {
+		return err
+	}
+	sealed, err := seal(key, name, data)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, sealed, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Get reads and decrypts the file stored under name
+func (s *EncryptedStore) Get(name string) ([]byte, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrStoreNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, data, err := s.open(name, sealed)
+	return data, err
+}
+
+// Delete removes the file stored under name
+func (s *EncryptedStore) Delete(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	defer s.lock(name)()
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List returns the names of all stored files
+func (s *EncryptedStore) List() ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ReEncrypt rewraps every file that is not encrypted for the active key. It
+// returns the number of rewritten files. Files that cannot be rewritten are
+// skipped, their errors are returned together at the end.
+func (s *EncryptedStore) ReEncrypt(ctx context.Context) (int, error) {
+	active, err := s.Keyring.Active(KeyUseEncrypt)
+	if err != nil {
+		return 0, err
+	}
+
+	names, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	var errs []error
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		ok, err := s.reEncrypt(name, active.ID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+		if ok {
+			rewritten++
+		}
+	}
+	return rewritten, errors.Join(errs...)
+}
+
+func (s *EncryptedStore) reEncrypt(name, activeID string) (bool, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return false, err
+	}
+	defer s.lock(name)()
+
+	sealed, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// deleted since it was listed
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	keyID, data, err := s.open(name, sealed)
+	if err != nil {
+		return false, err
+	}
+	if keyID == activeID {
+		return false, nil
+	}
+	if err := s.put(path, name, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// StartReEncryption runs ReEncrypt every interval until the context is done.
+// Errors are handed to onError, which may be nil.
+func (s *EncryptedStore) StartReEncryption(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.ReEncrypt(ctx); err != nil && onError != nil && ctx.Err() == nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+func seal(key *Key, name string, data []byte) ([]byte, error) {
+	recipient, err := key.EncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := deriveKEK(ephemeral, recipient.PublicKey(), key.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+
+	var header bytes.Buffer
+	header.Write(storageMagic)
+	header.WriteByte(byte(len(key.ID)))
+	header.WriteString(key.ID)
+	header.Write(ephemeral.PublicKey().Bytes())
+
+	wrapped, err := sealAESGCM(kek, dataKey, header.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	header.Write(wrapped)
+
+	body, err := sealAESGCM(dataKey, data, storageAAD(header.Bytes(), name))
+	if err != nil {
+		return nil, err
+	}
+	return append(header.Bytes(), body...), nil
+}
+
+func (s *EncryptedStore) open(name string, sealed []byte) (string, []byte, error) {
+	r := bytes.NewReader(sealed)
+
+	magic := make([]byte, len(storageMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, storageMagic) {
+		return "", nil, ErrStoreTampered
+	}
+	idLen, err := r.ReadByte()
+	if err != nil {
+		return "", nil, ErrStoreTampered
+	}
+	id := make([]byte, idLen)
+	if _, err := io.ReadFull(r, id); err != nil {
+		return "", nil, ErrStoreTampered
+	}
+	ephemeralBytes := make([]byte, 32)
+	if _, err := io.ReadFull(r, ephemeralBytes); err != nil {
+		return "", nil, ErrStoreTampered
+	}
+	keyHeaderLen := len(sealed) - r.Len()
+
+	// nonce + sealed data key + tag
+	wrapped := make([]byte, 12+dataKeySize+16)
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return "", nil, ErrStoreTampered
+	}
+	headerLen := len(sealed) - r.Len()
+
+	// retired keys still open files the re-encryption did not reach yet
+	key, err := s.Keyring.Lookup(string(id))
+	if err != nil {
+		return "", nil, err
+	}
+	recipient, err := key.EncryptionKey()
+	if err != nil {
+		return "", nil, err
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralBytes)
+	if err != nil {
+		return "", nil, ErrStoreTampered
+	}
+	kek, err := deriveKEK(recipient, ephemeral, key.ID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	dataKey, err := openAESGCM(kek, wrapped, sealed[:keyHeaderLen])
+	if err != nil {
+		return "", nil, ErrStoreTampered
+	}
+	data, err := openAESGCM(dataKey, sealed[headerLen:], storageAAD(sealed[:headerLen], name))
+	if err != nil {
+		return "", nil, ErrStoreTampered
+	}
+	return key.ID, data, nil
+}
+
+func deriveKEK(priv *ecdh.PrivateKey, pub *ecdh.PublicKey, keyID string) ([]byte, error) {
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Key(sha256.New, shared, nil, "message-store kek "+keyID, 32)
+}
+
+func storageAAD(header []byte, name string) []byte {
+	aad := make([]byte, 0, len(header)+len(name))
+	aad = append(aad, header...)
+	return append(aad, name...)
+}
+
+func sealAESGCM(key, plain, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, aad), nil
+}
+
+func openAESGCM(key, sealed, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrStoreTampered
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
+
+// MessageStores groups the on-disk message stores. All of them share the same
+// keyring and live in sub directories of a common root.
+type MessageStores struct {
+	Outbox  *MessageStore
+	Archive *MessageStore
+	Drafts  *MessageStore
+}
+
+func OpenMessageStores(root string, keyring *Keyring) (*MessageStores, error) {
+	open := func(name string) (*MessageStore, error) {
+		store, err := NewEncryptedStore(filepath.Join(root, name), keyring)
+		if err != nil {
+			return nil, err
+		}
+		return &MessageStore{store}, nil
+	}
+
+	var stores MessageStores
+	var err error
+	if stores.Outbox, err = open("outbox"); err != nil {
+		return nil, err
+	}
+	if stores.Archive, err = open("archive"); err != nil {
+		return nil, err
+	}
+	if stores.Drafts, err = open("drafts"); err != nil {
+		return nil, err
+	}
+	return &stores, nil
+}
+
+// ReEncrypt rewraps all stores for the active key
+func (s *MessageStores) ReEncrypt(ctx context.Context) error {
+	var errs []error
+	for _, store := range []*MessageStore{s.Outbox, s.Archive, s.Drafts} {
+		if _, err := store.ReEncrypt(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MessageStore keeps built Messages encrypted on disk
+type MessageStore struct {
+	*EncryptedStore
+}
+
+func (s *MessageStore) Save(name string, msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.Put(name, data)
+}
+
+func (s *MessageStore) Load(name string) (*Message, error) {
+	data, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
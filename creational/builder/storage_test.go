@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *EncryptedStore {
+	t.Helper()
+	keyring := NewKeyring()
+	if _, err := keyring.Generate(KeyUseEncrypt); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewEncryptedStore(t.TempDir(), keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestEncryptedStoreRoundTrip(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.Put("msg", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get("msg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("Get = %q, want %q", got, "hello")
+	}
+
+	raw, err := os.ReadFile(filepath.Join(store.Dir, "msg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) == "hello" || len(raw) <= len("hello") {
+		t.Error("file is not encrypted")
+	}
+}
+
+func TestEncryptedStoreRejectsTampering(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.Put("msg", []byte("some message body")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(store.Dir, "msg")
+	orig, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idLen := int(orig[len(storageMagic)])
+	header := len(storageMagic) + 1 + idLen
+
+	tests := []struct {
+		name   string
+		tamper func([]byte) []byte
+	}{
+		{"magic", func(b []byte) []byte { b[0] ^= 1; return b }},
+		{"ephemeral key", func(b []byte) []byte { b[header] ^= 1; return b }},
+		{"wrapped data key", func(b []byte) []byte { b[header+32+20] ^= 1; return b }},
+		{"data nonce", func(b []byte) []byte { b[header+32+60] ^= 1; return b }},
+		{"ciphertext", func(b []byte) []byte { b[len(b)-20] ^= 1; return b }},
+		{"tag", func(b []byte) []byte { b[len(b)-1] ^= 1; return b }},
+		{"truncated", func(b []byte) []byte { return b[:len(b)-1] }},
+		{"header only", func(b []byte) []byte { return b[:header] }},
+		{"empty", func(b []byte) []byte { return nil }},
+	}
+	for _, tt := range tests {
+		data := tt.tamper(append([]byte(nil), orig...))
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Get("msg"); !errors.Is(err, ErrStoreTampered) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, ErrStoreTampered)
+		}
+	}
+}
+
+func TestEncryptedStoreRejectsSwappedFiles(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.Put("a", []byte("for a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("b", []byte("for b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(store.Dir, "a"), filepath.Join(store.Dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("b"); !errors.Is(err, ErrStoreTampered) {
+		t.Errorf("err = %v, want %v", err, ErrStoreTampered)
+	}
+}
+
+func TestEncryptedStoreInvalidNames(t *testing.T) {
+	store := newTestStore(t)
+	for _, name := range []string{"", ".", "..", "a/b", `a\b`, "msg.tmp"} {
+		if err := store.Put(name, []byte("x")); err == nil {
+			t.Errorf("Put(%q) succeeded", name)
+		}
+	}
+}
+
+func TestEncryptedStoreReEncrypt(t *testing.T) {
+	store := newTestStore(t)
+	old, err := store.Keyring.Active(KeyUseEncrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := store.Put(name, []byte("body "+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a file nobody can read must not stop the pass
+	if err := os.WriteFile(filepath.Join(store.Dir, "broken"), []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Keyring.Generate(KeyUseEncrypt); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Keyring.Retire(old.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// files under the retired key are still readable
+	if got, err := store.Get("a"); err != nil || string(got) != "body a" {
+		t.Fatalf("Get before re-encryption = %q, %v", got, err)
+	}
+
+	n, err := store.ReEncrypt(context.Background())
+	if n != 3 {
+		t.Errorf("rewrote %d files, want 3", n)
+	}
+	if !errors.Is(err, ErrStoreTampered) {
+		t.Errorf("err = %v, want %v", err, ErrStoreTampered)
+	}
+
+	n, _ = store.ReEncrypt(context.Background())
+	if n != 0 {
+		t.Errorf("second pass rewrote %d files, want 0", n)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		got, err := store.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "body "+name {
+			t.Errorf("Get(%q) = %q", name, got)
+		}
+	}
+}
+
+func TestMessageStoreSaveLoad(t *testing.T) {
+	keyring := NewKeyring()
+	if _, err := keyring.Generate(KeyUseEncrypt); err != nil {
+		t.Fatal(err)
+	}
+	stores, err := OpenMessageStores(t.TempDir(), keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &Message{ID: "1", Recipient: "santa@example.com", Body: []byte("{}"), Format: "JSON"}
+	if err := stores.Outbox.Save("1", msg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := stores.Outbox.Load("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Recipient != msg.Recipient || string(got.Body) != string(msg.Body) {
+		t.Errorf("Load = %+v, want %+v", got, msg)
+	}
+	if _, err := stores.Archive.Load("1"); !errors.Is(err, ErrStoreNotFound) {
+		t.Errorf("archive: err = %v, want %v", err, ErrStoreNotFound)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "sync"
+
+// JSONMessageBuilder and XMLMessageBuilder are plain structs and must not be
+// shared between goroutines. SyncBuilder makes any MessageBuilder safe to share:
+//
+//   - SetRecipient, SetText and Message may be called concurrently. Each call
+//     is atomic, so Message always sees a recipient and a text that were set
+//     completely, never a torn value.
+//   - A sequence of calls is NOT atomic. Two goroutines doing SetRecipient then
+//     Message may each get the other's recipient. Use Build when the recipient,
+//     text and resulting Message have to belong together.
+//   - Message is called with the lock held, so the wrapped builder never sees
+//     a setter running while it builds.
+type SyncBuilder struct {
+	mu      sync.Mutex
+	builder MessageBuilder
+}
+
+// NewSyncBuilder wraps builder. The builder must not be used directly afterwards.
+func NewSyncBuilder(builder MessageBuilder) *SyncBuilder {
+	return &SyncBuilder{builder: builder}
+}
+
+func (b *SyncBuilder) SetRecipient(recipient string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.builder.SetRecipient(recipient)
+}
+
+func (b *SyncBuilder) SetText(text string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.builder.SetText(text)
+}
+
+func (b *SyncBuilder) Message() (*Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.builder.Message()
+}
+
+// Build sets recipient and text and builds the Message as one atomic step
+func (b *SyncBuilder) Build(recipient, text string) (*Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.builder.SetRecipient(recipient)
+	b.builder.SetText(text)
+	return b.builder.Message()
+}
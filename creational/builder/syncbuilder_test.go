@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Run with -race: parallel setters and Message must not race, and every
+// message must carry values that were set completely
+func TestSyncBuilderParallelSetters(t *testing.T) {
+	builders := []struct {
+		name  string
+		new   func() MessageBuilder
+		parse func([]byte) (string, string, error)
+	}{
+		{"JSON", func() MessageBuilder { return &JSONMessageBuilder{} }, func(b []byte) (string, string, error) {
+			var m struct {
+				Recipient string `json:"recipient"`
+				Message   string `json:"message"`
+			}
+			err := json.Unmarshal(b, &m)
+			return m.Recipient, m.Message, err
+		}},
+		{"XML", func() MessageBuilder { return &XMLMessageBuilder{} }, func(b []byte) (string, string, error) {
+			var m struct {
+				Recipient string `xml:"recipient"`
+				Message   string `xml:"body"`
+			}
+			err := xml.Unmarshal(b, &m)
+			return m.Recipient, m.Message, err
+		}},
+	}
+
+	for _, tt := range builders {
+		b := NewSyncBuilder(tt.new())
+		b.SetRecipient("r0")
+		b.SetText("t0")
+
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					b.SetRecipient(fmt.Sprintf("r%d", i))
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					b.SetText(fmt.Sprintf("t%d", i))
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					msg, err := b.Message()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					recipient, text, err := tt.parse(msg.Body)
+					if err != nil {
+						t.Errorf("%s: torn body %q: %v", tt.name, msg.Body, err)
+						return
+					}
+					if !strings.HasPrefix(recipient, "r") || !strings.HasPrefix(text, "t") || msg.Recipient != recipient {
+						t.Errorf("%s: message %+v has recipient %q text %q", tt.name, msg, recipient, text)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func TestSyncBuilderBuildIsAtomic(t *testing.T) {
+	b := NewSyncBuilder(&JSONMessageBuilder{})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				recipient := fmt.Sprintf("user%d-%d", g, i)
+				msg, err := b.Build(recipient, "hello "+recipient)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var body struct {
+					Recipient string `json:"recipient"`
+					Message   string `json:"message"`
+				}
+				if err := json.Unmarshal(msg.Body, &body); err != nil {
+					t.Error(err)
+					return
+				}
+				if body.Recipient != recipient || body.Message != "hello "+recipient {
+					t.Errorf("Build(%q) = %+v", recipient, body)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
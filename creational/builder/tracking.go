@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Open tracking adds a 1x1 pixel with a signed per message token to HTML
+// messages. When the image is fetched the open is recorded as an engagement
+// event and the message moves to the opened state. Opens are counted once per
+// message, and fetches that look like they come from a machine (link
+// scanners, mail client prefetching) are recorded but not counted.
+
+// transparent 1x1 GIF
+var trackingPixel = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// User agent fragments of security scanners and prefetching proxies
+var prefetchAgents = []string{
+	"barracuda", "mimecast", "proofpoint", "symantec", "messagelabs",
+	"bot", "crawler", "spider", "preview", "scanner", "urldefense",
+}
+
+var ErrTrackingToken = errors.New("invalid tracking token")
+
+// EngagementEvent is a recipient interacting with a message
+type EngagementEvent struct {
+	MessageID string    `json:"message_id"`
+	Type      string    `json:"type"`
+	At        time.Time `json:"at"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	// Looked like a machine, not counted as an open
+	Machine bool `json:"machine,omitempty"`
+	// A later open of an already opened message
+	Repeat bool `json:"repeat,omitempty"`
+}
+
+// OpenTracker creates tracking pixels and records opens
+type OpenTracker struct {
+	// URL the pixel is served from, the token is added as the "t" parameter
+	BaseURL string
+	Secret  []byte
+	// Optional, opens move messages to the opened state
+	Lifecycle *LifecycleStore
+	// Fetches sooner than this after the message was sent are treated as
+	// prefetching, 2 seconds when zero
+	MinOpenDelay time.Duration
+	// How long the events of a message are kept after its last event, 30
+	// days when zero
+	Retention time.Duration
+	// Events kept per message, the oldest are dropped first. 100 when zero.
+	MaxEvents int
+	// Clock, time.Now when nil
+	Now func() time.Time
+
+	mu     sync.Mutex
+	events map[string]*trackedMessage
+	pruned time.Time
+}
+
+type trackedMessage struct {
+	events []EngagementEvent
+	// a person opened it, even if that event was dropped since
+	opened bool
+	last   time.Time
+}
+
+func (t *OpenTracker) now() time.Time {
+	if t.Now != nil {
+		return t.Now()
+	}
+	return time.Now()
+}
+
+// Token returns the signed token of a message
+func (t *OpenTracker) Token(messageID string) string {
+	return messageID + "." + base64.RawURLEncoding.EncodeToString(t.mac(messageID))
+}
+
+func (t *OpenTracker) mac(messageID string) []byte {
+	m := hmac.New(sha256.New, t.Secret)
+	m.Write([]byte("open:" + messageID))
+	return m.Sum(nil)[:16]
+}
+
+func (t *OpenTracker) verify(token string) (string, error) {
+	id, sig, ok := strings.Cut(token, ".")
+	if !ok || id == "" {
+		return "", ErrTrackingToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, t.mac(id)) {
+		return "", ErrTrackingToken
+	}
+	return id, nil
+}
+
+// InsertPixel adds the tracking pixel of a message at the end of the body
+func (t *OpenTracker) InsertPixel(doc, messageID string) (string, error) {
+	u, err := url.Parse(t.BaseURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("t", t.Token(messageID))
+	u.RawQuery = q.Encode()
+
+	pixel := `<img src="` + html.EscapeString(u.String()) + `" width="1" height="1" alt="" style="display: block; width: 1px; height: 1px; border: 0">`
+	if i := strings.LastIndex(strings.ToLower(doc), "</body>"); i >= 0 {
+		return doc[:i] + pixel + "\n" + doc[i:], nil
+	}
+	return doc + pixel, nil
+}
+
+// RecordOpen records a pixel fetch and returns the event
+func (t *OpenTracker) RecordOpen(messageID string, r *http.Request) EngagementEvent {
+	now := t.now()
+	ev := EngagementEvent{MessageID: messageID, Type: "open", At: now}
+	if r != nil {
+		ev.UserAgent = r.UserAgent()
+		ev.Machine = isPrefetch(r)
+	}
+	if !ev.Machine && t.Lifecycle != nil {
+		if rec, err := t.Lifecycle.Get(messageID); err == nil {
+			sent, ok := rec.At(StateSent)
+			if !ok {
+				sent, ok = rec.At(StateDelivered)
+			}
+			minDelay := t.MinOpenDelay
+			if minDelay <= 0 {
+				minDelay = 2 * time.Second
+			}
+			if ok && now.Sub(sent) < minDelay {
+				ev.Machine = true
+			}
+		}
+	}
+
+	maxEvents := t.MaxEvents
+	if maxEvents <= 0 {
+		maxEvents = 100
+	}
+	t.mu.Lock()
+	if t.events == nil {
+		t.events = make(map[string]*trackedMessage)
+	}
+	t.prune(now)
+	m := t.events[messageID]
+	if m == nil {
+		m = &trackedMessage{}
+		t.events[messageID] = m
+	}
+	ev.Repeat = m.opened
+	if !ev.Machine {
+		m.opened = true
+	}
+	if len(m.events) >= maxEvents {
+		m.events = append(m.events[:0], m.events[len(m.events)-maxEvents+1:]...)
+	}
+	m.events = append(m.events, ev)
+	m.last = now
+	t.mu.Unlock()
+
+	if !ev.Machine && !ev.Repeat && t.Lifecycle != nil {
+		t.Lifecycle.Transition(messageID, StateOpened, now, "")
+	}
+	return ev
+}
+
+// prune drops messages without events in the retention period, t.mu must be
+// held. It walks the map at most ten times per period.
+func (t *OpenTracker) prune(now time.Time) {
+	retention := t.Retention
+	if retention <= 0 {
+		retention = 30 * 24 * time.Hour
+	}
+	if now.Sub(t.pruned) < retention/10 {
+		return
+	}
+	t.pruned = now
+	for id, m := range t.events {
+		if now.Sub(m.last) > retention {
+			delete(t.events, id)
+		}
+	}
+}
+
+func isPrefetch(r *http.Request) bool {
+	for _, h := range []string{"Purpose", "Sec-Purpose", "X-Purpose", "X-Moz"} {
+		if strings.Contains(strings.ToLower(r.Header.Get(h)), "prefetch") {
+			return true
+		}
+	}
+	ua := strings.ToLower(r.UserAgent())
+	if ua == "" {
+		return true
+	}
+	for _, agent := range prefetchAgents {
+		if strings.Contains(ua, agent) {
+			return true
+		}
+	}
+	return false
+}
+
+// Events returns the engagement events of a message
+func (t *OpenTracker) Events(messageID string) []EngagementEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := t.events[messageID]
+	if m == nil {
+		return nil
+	}
+	return append([]EngagementEvent(nil), m.events...)
+}
+
+// Opened reports whether a message was opened by a person
+func (t *OpenTracker) Opened(messageID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := t.events[messageID]
+	return m != nil && m.opened
+}
+
+// ServeHTTP serves the pixel. The image is returned even for bad tokens, so a
+// broken image never shows up in a mail client.
+func (t *OpenTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if id, err := t.verify(r.URL.Query().Get("t")); err == nil {
+		t.RecordOpen(id, r)
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, private")
+	w.Header().Set("Pragma", "no-cache")
+	w.Write(trackingPixel)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOpenTrackerMovesDispatchedMessageToOpened(t *testing.T) {
+	store := NewLifecycleStore()
+	d := &Dispatcher{Transport: &recordingTransport{}, Lifecycle: store}
+	msg := &Message{Recipient: "kid@example.com", Format: "HTML"}
+	if err := d.Dispatch(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	later := time.Now().Add(time.Minute)
+	tracker := &OpenTracker{BaseURL: "https://example.com/o", Secret: []byte("s"), Lifecycle: store, Now: func() time.Time { return later }}
+
+	tests := []struct {
+		name        string
+		userAgent   string
+		wantMachine bool
+		wantRepeat  bool
+	}{
+		{"scanner", "Mimecast URL scanner", true, false},
+		{"person", "Mozilla/5.0", false, false},
+		{"person again", "Mozilla/5.0", false, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/o?t="+tracker.Token(msg.ID), nil)
+		r.Header.Set("User-Agent", tt.userAgent)
+		tracker.ServeHTTP(httptest.NewRecorder(), r)
+		events := tracker.Events(msg.ID)
+		ev := events[len(events)-1]
+		if ev.Machine != tt.wantMachine || ev.Repeat != tt.wantRepeat {
+			t.Errorf("%s: event = %+v", tt.name, ev)
+		}
+	}
+
+	rec, err := store.Get(msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.State != StateOpened {
+		t.Errorf("state = %s, want %s", rec.State, StateOpened)
+	}
+}
+
+func TestOpenTrackerBoundsEvents(t *testing.T) {
+	clock := newFakeClock()
+	tracker := &OpenTracker{Secret: []byte("s"), MaxEvents: 3, Retention: time.Hour, Now: clock.Now}
+	r := httptest.NewRequest("GET", "/o", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0")
+
+	for i := 0; i < 5; i++ {
+		tracker.RecordOpen("old", r)
+	}
+	if n := len(tracker.Events("old")); n != 3 {
+		t.Errorf("kept %d events, want 3", n)
+	}
+	if !tracker.Opened("old") {
+		t.Error("opened flag lost when the first event was dropped")
+	}
+
+	clock.Advance(2 * time.Hour)
+	tracker.RecordOpen("new", r)
+	if events := tracker.Events("old"); events != nil {
+		t.Errorf("events past retention kept: %v", events)
+	}
+	if tracker.Opened("old") {
+		t.Error("expired message still reported as opened")
+	}
+	if n := len(tracker.Events("new")); n != 1 {
+		t.Errorf("new message has %d events, want 1", n)
+	}
+}
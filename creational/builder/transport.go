@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Transport hands a built Message over to whatever delivers it
+type Transport interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// TransportFunc adapts a plain function to the Transport interface
+type TransportFunc func(ctx context.Context, msg *Message) error
+
+func (f TransportFunc) Send(ctx context.Context, msg *Message) error {
+	return f(ctx, msg)
+}
+
+// RefTransport is a Transport that also returns the provider's reference for
+// the message it handed over, so delivery callbacks can be mapped back to it
+type RefTransport interface {
+	Transport
+	SendRef(ctx context.Context, msg *Message) (string, error)
+}
+
+// RefTransportFunc adapts a plain function to the RefTransport interface
+type RefTransportFunc func(ctx context.Context, msg *Message) (string, error)
+
+func (f RefTransportFunc) Send(ctx context.Context, msg *Message) error {
+	_, err := f(ctx, msg)
+	return err
+}
+
+func (f RefTransportFunc) SendRef(ctx context.Context, msg *Message) (string, error) {
+	return f(ctx, msg)
+}
+
+// NewMessageID returns a random message identifier
+func NewMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}